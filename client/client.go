@@ -1,10 +1,39 @@
 package client
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
 	"github.com/navaz-alani/concord/core"
 	"github.com/navaz-alani/concord/packet"
 )
 
+// Internal request statuses.
+const (
+	requestStatusWaiting uint8 = iota
+	requestStatusError
+	requestStatusTimeout
+	requestStatusResolved
+)
+
+// requestCtx stores the status of the request as well as the response channel
+// over which the requestor can be delivered the response.
+type requestCtx struct {
+	respCh          chan packet.Packet
+	msg             string
+	status          uint8
+	retransmissions int
+	done            chan struct{} // closed when the request is no longer pending
+	expires         time.Time     // when a settled request is forgotten
+}
+
+type writePacket struct {
+	data []byte
+	ref  string
+}
+
 // Client defines the interface through which clients send and receive packets
 // to and from the Server. To send a packet, the process is as follows: create
 // the packet and write some data and/or metadata to it. Then, create a channel
@@ -21,8 +50,27 @@ type Client interface {
 	// responsibility of packet management to the user allows multiple packet
 	// types to be used.
 	Send(pkt packet.Packet, resp chan packet.Packet) error
-	// Cleanup purges the client's resources. The client should not be used after
-	// this method has been called.
+	// SendContext is like Send, except that if `ctx` is done before the response
+	// is received, the request is abandoned and an error packet is sent on the
+	// `resp` channel instead. Requests are also abandoned when the Client's
+	// timeout elapses, regardless of `ctx`.
+	SendContext(ctx context.Context, pkt packet.Packet, resp chan packet.Packet) error
+	// Request sends `pkt` and waits for its response, which is returned. If the
+	// response is an error packet, it is put back into the PacketCreator and a
+	// *ServerError is returned instead. If the Client fails the request itself,
+	// ctx.Err() (if `ctx` is done), ErrTimeout or a *RequestError is returned.
+	// The caller should PutBack the returned packet once done with it.
+	Request(ctx context.Context, pkt packet.Packet) (packet.Packet, error)
+	// RequestJSON is like Request, except that the response data is decoded, as
+	// JSON, into `v` and the response packet is put back into the PacketCreator.
+	RequestJSON(ctx context.Context, pkt packet.Packet, v interface{}) error
+	// SetTimeout sets the amount of time the Client waits for a response before
+	// abandoning a request. The default is DefaultTimeout and a non-positive
+	// timeout means that requests only expire through their context.
+	SetTimeout(timeout time.Duration)
+	// Cleanup purges the client's resources. Requests which are still pending
+	// are failed with a "client closed" RequestError. The client should not be
+	// used after this method has been called.
 	Cleanup() error
 	// Misc returns a channel over which packets without a ref/with an recognized
 	// ref are sent. The client can then handle these packets as desired. For
@@ -41,3 +89,22 @@ type Client interface {
 	// Access the internal packet processor
 	PacketProcessor() core.PacketProcessor
 }
+
+// Helper to generate a length-dependent ref for a packet.
+func genRef(n int) string {
+	var letters = []rune(`abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789`)
+	s := make([]rune, n)
+	for i := range s {
+		s[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(s)
+}
+
+// noopError returns the error reported when the data pipeline enforces a noop
+// on an outgoing packet, including the pipeline's message if any.
+func noopError(ctx *core.TransformContext) error {
+	if ctx.Msg != "" {
+		return fmt.Errorf("data pipeline enforced noop: " + ctx.Msg)
+	}
+	return fmt.Errorf("data pipeline enforced noop")
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	throttle "github.com/navaz-alani/concord/core/throttle"
+	"github.com/navaz-alani/concord/packet"
+)
+
+// ErrTimeout is returned by Client.Request when no response to the request is
+// received within the Client's timeout. It wraps context.DeadlineExceeded, so
+// errors.Is(err, context.DeadlineExceeded) holds for it.
+var ErrTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "request timeout" }
+func (timeoutError) Timeout() bool { return true }
+func (timeoutError) Unwrap() error { return context.DeadlineExceeded }
+
+// RequestError is the error returned by Client.Request when the Client itself
+// fails a request (other than by timing out), for example when it cannot be
+// written to the connection.
+type RequestError struct {
+	Ref string // the ref of the failed request
+	Msg string
+}
+
+func (e *RequestError) Error() string {
+	return "request error: " + e.Msg
+}
+
+// ServerError is the error returned by Client.Request when the response to a
+// request is an error packet sent by the server i.e. a packet whose
+// KeySvrStatus metadata is "-1".
+type ServerError struct {
+	Ref    string // the ref of the failed request
+	Status string // the KeySvrStatus of the response
+	Msg    string // the KeySvrMsg of the response
+	// RetryAfter is the time after which the request may be retried, if the
+	// server rate limited it (see throttle.PeerLimiter), and zero otherwise.
+	RetryAfter time.Duration
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Msg
+}
+
+// responseError returns the ServerError described by `resp`, if `resp` is an
+// error packet and nil otherwise.
+func responseError(resp packet.Packet) error {
+	if status := resp.Meta().Get(packet.KeySvrStatus); status == "-1" {
+		err := &ServerError{
+			Ref:    resp.Meta().Get(packet.KeyRef),
+			Status: status,
+			Msg:    resp.Meta().Get(packet.KeySvrMsg),
+		}
+		if ms, convErr := strconv.ParseInt(resp.Meta().Get(throttle.KeyRetryAfter), 10, 64); convErr == nil {
+			err.RetryAfter = time.Duration(ms) * time.Millisecond
+		}
+		return err
+	}
+	return nil
+}
+
+// failureError returns the error describing the failure of the request with
+// the given ref by the Client, if the Client failed it, and nil otherwise.
+func (rt *requestTracker) failureError(ref string) error {
+	req, ok := rt.getSettled(ref)
+	if !ok {
+		return nil
+	}
+	switch req.status {
+	case requestStatusTimeout:
+		return ErrTimeout
+	case requestStatusError:
+		return &RequestError{Ref: ref, Msg: req.msg}
+	}
+	return nil
+}
+
+// request implements Client.Request for the Client `c`, whose packets are
+// created by `pc` and whose requests are tracked by `rt`.
+func request(ctx context.Context, c Client, rt *requestTracker, pc packet.PacketCreator,
+	pkt packet.Packet) (packet.Packet, error) {
+	respCh := make(chan packet.Packet, 1)
+	if err := c.SendContext(ctx, pkt, respCh); err != nil {
+		return nil, err
+	}
+	resp := <-respCh
+	if err := responseError(resp); err != nil {
+		pc.PutBack(resp)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if failure := rt.failureError(pkt.Meta().Get(packet.KeyRef)); failure != nil {
+			return nil, failure
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// requestJSON implements Client.RequestJSON for the Client `c`, whose packets
+// are created by `pc` and whose requests are tracked by `rt`.
+func requestJSON(ctx context.Context, c Client, rt *requestTracker, pc packet.PacketCreator,
+	pkt packet.Packet, v interface{}) error {
+	resp, err := request(ctx, c, rt, pc, pkt)
+	if err != nil {
+		return err
+	}
+	defer pc.PutBack(resp)
+	if err := json.Unmarshal(resp.Data(), v); err != nil {
+		return fmt.Errorf("response decode error: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/navaz-alani/concord/core/clock"
+	throttle "github.com/navaz-alani/concord/core/throttle"
+	"github.com/navaz-alani/concord/packet"
+)
+
+// DefaultTimeout is the amount of time for which a Client waits for the
+// response to a request before failing it, unless configured otherwise using
+// the SetTimeout method.
+const DefaultTimeout = 10 * time.Second
+
+// requestTracker keeps track of the pending requests of a Client, by ref. A
+// request is pending from the time that it is sent until either its response
+// is received, or it is failed (for example, when it times out). Either way,
+// the request's ref is cleaned up so that the tracker does not grow unbounded
+// when responses are lost.
+//
+// Requests which have been retransmitted may receive duplicate responses and
+// requests which have failed (for example, timed out) may still receive late
+// responses. Their refs are remembered as "settled" for a while (see
+// settleTTL) after they are resolved or failed, so that these responses can be
+// recognized and discarded, instead of being delivered as miscellaneous
+// packets.
+//
+// If a congestion Controller is set, it is told about every response (as a
+// success) and every lost request (as a loss). A request is lost when it is
+// first retransmitted or, if it is never retransmitted, when it times out, so
+// that a request is counted as lost at most once however many times it is
+// retransmitted.
+type requestTracker struct {
+	mu        sync.Mutex // mu protects all of the tracker's fields, other than `pc`
+	timeout   time.Duration
+	clock     clock.Clock
+	ctrl      throttle.Controller
+	pc        packet.PacketCreator
+	requests  map[string]*requestCtx
+	settled   map[string]*requestCtx // settled requests, by ref
+	lastSweep time.Time              // time of the last purge of `settled`
+}
+
+func newRequestTracker(pc packet.PacketCreator) *requestTracker {
+	return &requestTracker{
+		mu:        sync.Mutex{},
+		timeout:   DefaultTimeout,
+		clock:     clock.Real,
+		pc:        pc,
+		requests:  make(map[string]*requestCtx),
+		settled:   make(map[string]*requestCtx),
+		lastSweep: clock.Real.Now(),
+	}
+}
+
+func (rt *requestTracker) setTimeout(timeout time.Duration) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.timeout = timeout
+}
+
+func (rt *requestTracker) setClock(clk clock.Clock) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.clock = clk
+	rt.lastSweep = clk.Now()
+}
+
+// getClock returns the Clock with which timeouts (and retransmission backoffs)
+// are measured.
+func (rt *requestTracker) getClock() clock.Clock {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.clock
+}
+
+func (rt *requestTracker) setController(ctrl throttle.Controller) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.ctrl = ctrl
+}
+
+// controller returns the tracker's congestion Controller, which may be nil.
+func (rt *requestTracker) controller() throttle.Controller {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.ctrl
+}
+
+// track registers a request with the given ref, whose response is to be
+// delivered over `respCh`. The request is failed when `ctx` is done or when the
+// tracker's timeout elapses, whichever happens first. The returned channel is
+// closed when the request is no longer pending.
+func (rt *requestTracker) track(ctx context.Context, ref string, respCh chan packet.Packet) <-chan struct{} {
+	req := &requestCtx{
+		respCh: respCh,
+		status: requestStatusWaiting,
+		done:   make(chan struct{}),
+	}
+	rt.mu.Lock()
+	rt.requests[ref] = req
+	delete(rt.settled, ref) // the ref is being reused
+	timeout, clk := rt.timeout, rt.clock
+	rt.mu.Unlock()
+
+	if timeout > 0 {
+		go rt.watch(ctx, clk.NewTimer(timeout), ref, req)
+	} else if ctx.Done() != nil { // no need to watch requests which never expire
+		go rt.watch(ctx, nil, ref, req)
+	}
+	return req.done
+}
+
+// watch fails the request `req` if `ctx` is done, or `timer` (if non-nil)
+// fires, before the request is. The timer is stopped once watching is over.
+func (rt *requestTracker) watch(ctx context.Context, timer clock.Timer,
+	ref string, req *requestCtx) {
+	var expired <-chan time.Time
+	if timer != nil {
+		defer timer.Stop()
+		expired = timer.C()
+	}
+	select {
+	case <-req.done:
+	case <-expired:
+		rt.expire(ref, req)
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			rt.expire(ref, req)
+		} else {
+			rt.fail(ref, req, requestStatusError, "request canceled: "+ctx.Err().Error())
+		}
+	}
+}
+
+// expire fails the request `req` with the given ref as timed out. Unless its
+// loss has already been reported, on its first retransmission, it is reported
+// to the Controller as a loss.
+func (rt *requestTracker) expire(ref string, req *requestCtx) {
+	rt.mu.Lock()
+	ctrl := rt.ctrl
+	lost := req.retransmissions == 0
+	rt.mu.Unlock()
+	if lost && ctrl != nil {
+		ctrl.OnLoss()
+	}
+	rt.fail(ref, req, requestStatusTimeout, "request timeout")
+}
+
+// resolve marks the request with the given ref as complete and returns it. The
+// boolean is false if there is no pending request with that ref.
+func (rt *requestTracker) resolve(ref string) (*requestCtx, bool) {
+	rt.mu.Lock()
+	req, ok := rt.requests[ref]
+	if ok {
+		delete(rt.requests, ref)
+		req.status = requestStatusResolved
+		close(req.done)
+		if req.retransmissions > 0 {
+			rt.settle(ref, req)
+		}
+	}
+	ctrl := rt.ctrl
+	rt.mu.Unlock()
+
+	if ok && ctrl != nil {
+		ctrl.OnSuccess()
+	}
+	return req, ok
+}
+
+// retransmitting records a retransmission of the request with the given ref.
+// The first retransmission of a request is reported to the Controller as a
+// loss. It returns false if the request is no longer pending, in which case it
+// should not be retransmitted.
+func (rt *requestTracker) retransmitting(ref string) bool {
+	rt.mu.Lock()
+	req, ok := rt.requests[ref]
+	if ok {
+		req.retransmissions++
+	}
+	lost := ok && req.retransmissions == 1
+	ctrl := rt.ctrl
+	rt.mu.Unlock()
+
+	if lost && ctrl != nil {
+		ctrl.OnLoss()
+	}
+	return ok
+}
+
+// abandon stops tracking the pending request with the given ref, without
+// delivering anything to the requestor. It is used for requests which could
+// not be sent.
+func (rt *requestTracker) abandon(ref string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if req, ok := rt.requests[ref]; ok {
+		delete(rt.requests, ref)
+		close(req.done)
+	}
+}
+
+// failAll fails every pending request with the given status and message. It
+// is used when the Client is closed, since the responses to pending requests
+// can no longer be received. The error packets are delivered from separate
+// routines, so that failAll does not block on requestors which are not
+// receiving.
+func (rt *requestTracker) failAll(status uint8, msg string) {
+	rt.mu.Lock()
+	pending := make(map[string]*requestCtx, len(rt.requests))
+	for ref, req := range rt.requests {
+		pending[ref] = req
+	}
+	rt.mu.Unlock()
+	for ref, req := range pending {
+		go rt.fail(ref, req, status, msg)
+	}
+}
+
+// settleTTL returns the time for which settled refs are remembered: the
+// tracker's timeout, but at least DefaultTimeout, since late responses may
+// arrive well after a short timeout. rt.mu must be held.
+func (rt *requestTracker) settleTTL() time.Duration {
+	if rt.timeout < DefaultTimeout {
+		return DefaultTimeout
+	}
+	return rt.timeout
+}
+
+// settle remembers the request `req` with the given ref as settled. Expired
+// settled requests are purged, at most once per settleTTL. rt.mu must be held.
+func (rt *requestTracker) settle(ref string, req *requestCtx) {
+	now := rt.clock.Now()
+	if now.Sub(rt.lastSweep) > rt.settleTTL() {
+		for r, settled := range rt.settled {
+			if now.After(settled.expires) {
+				delete(rt.settled, r)
+			}
+		}
+		rt.lastSweep = now
+	}
+	req.expires = now.Add(rt.settleTTL())
+	rt.settled[ref] = req
+}
+
+// getSettled returns the request with the given ref, if it has recently been
+// settled i.e. resolved after being retransmitted, or failed.
+func (rt *requestTracker) getSettled(ref string) (*requestCtx, bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	req, ok := rt.settled[ref]
+	if !ok || rt.clock.Now().After(req.expires) {
+		return nil, false
+	}
+	return req, true
+}
+
+// isSettled reports whether the given ref belongs to a request which has
+// recently been settled.
+func (rt *requestTracker) isSettled(ref string) bool {
+	_, ok := rt.getSettled(ref)
+	return ok
+}
+
+// fail marks the request `req` with the given ref as failed, with the given
+// status and message, and delivers an error packet to the requestor. If `req`
+// is nil, the request currently pending under `ref` is failed. Nothing is done
+// if the request is no longer pending.
+func (rt *requestTracker) fail(ref string, req *requestCtx, status uint8, msg string) {
+	rt.mu.Lock()
+	if pending, ok := rt.requests[ref]; !ok || (req != nil && pending != req) {
+		rt.mu.Unlock()
+		return
+	} else {
+		req = pending
+	}
+	delete(rt.requests, ref)
+	req.status = status
+	req.msg = msg
+	close(req.done)
+	rt.settle(ref, req)
+	rt.mu.Unlock()
+
+	if req.respCh != nil {
+		req.respCh <- rt.pc.NewErrPkt(ref, "", msg)
+	}
+}
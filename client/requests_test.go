@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/core/clock/clocktest"
+	"github.com/navaz-alani/concord/packet"
+)
+
+// countingController is a Controller which counts the signals it is given.
+type countingController struct {
+	successes, losses int32
+}
+
+func (c *countingController) OnSuccess() { atomic.AddInt32(&c.successes, 1) }
+func (c *countingController) OnLoss()    { atomic.AddInt32(&c.losses, 1) }
+
+func (c *countingController) counts() (successes, losses int32) {
+	return atomic.LoadInt32(&c.successes), atomic.LoadInt32(&c.losses)
+}
+
+func TestRequestTrackerLossCountedOnce(t *testing.T) {
+	const timeout = time.Second
+	tests := []struct {
+		name            string
+		retransmissions int
+		resolved        bool
+		successes       int32
+		losses          int32
+	}{
+		{"resolved", 0, true, 1, 0},
+		{"resolved after retransmissions", 3, true, 1, 1},
+		{"timed out", 0, false, 0, 1},
+		{"timed out after retransmissions", 3, false, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk := clocktest.NewManual(time.Unix(0, 0))
+			ctrl := &countingController{}
+			rt := newRequestTracker(packet.NewJSONPktCreator(10))
+			rt.setTimeout(timeout)
+			rt.setClock(clk)
+			rt.setController(ctrl)
+
+			done := rt.track(context.Background(), "ref", make(chan packet.Packet, 1))
+			for i := 0; i < tt.retransmissions; i++ {
+				if !rt.retransmitting("ref") {
+					t.Fatalf("retransmission %d of a pending request refused", i+1)
+				}
+			}
+			if tt.resolved {
+				rt.resolve("ref")
+			} else {
+				clk.Advance(timeout)
+			}
+			<-done
+			if successes, losses := ctrl.counts(); successes != tt.successes || losses != tt.losses {
+				t.Errorf("Controller told of %d successes and %d losses, want %d and %d",
+					successes, losses, tt.successes, tt.losses)
+			}
+		})
+	}
+}
+
+func TestRequestTrackerTimeout(t *testing.T) {
+	const timeout = time.Second
+	clk := clocktest.NewManual(time.Unix(0, 0))
+	rt := newRequestTracker(packet.NewJSONPktCreator(10))
+	rt.setTimeout(timeout)
+	rt.setClock(clk)
+
+	respCh := make(chan packet.Packet, 1)
+	done := rt.track(context.Background(), "ref", respCh)
+	clk.Advance(timeout - time.Nanosecond)
+	select {
+	case <-done:
+		t.Fatalf("request failed before its timeout of %v", timeout)
+	default:
+	}
+	clk.Advance(time.Nanosecond)
+	select {
+	case resp := <-respCh:
+		if msg := resp.Meta().Get(packet.KeySvrMsg); msg != "request timeout" {
+			t.Errorf("timed out request failed with %q, want %q", msg, "request timeout")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request not failed after its timeout of %v", timeout)
+	}
+	<-done
+	if _, ok := rt.resolve("ref"); ok {
+		t.Error("late response resolved a timed out request")
+	}
+	if !rt.isSettled("ref") {
+		t.Error("timed out request is not settled")
+	}
+	// settled refs are forgotten once the late responses they are kept for
+	// can no longer arrive
+	clk.Advance(DefaultTimeout + time.Nanosecond)
+	if rt.isSettled("ref") {
+		t.Error("timed out request is still settled after DefaultTimeout")
+	}
+}
@@ -0,0 +1,32 @@
+package client
+
+import "time"
+
+// RetryPolicy configures the retransmission of unanswered requests by a
+// UDPClient, providing at-least-once delivery of requests over UDP. A request
+// which has not been answered after `Backoff` is retransmitted under the same
+// ref, and the wait doubles after every retransmission (up to `MaxBackoff`, if
+// it is positive). At most `Retries` retransmissions are made for a request.
+//
+// Since a request may be delivered more than once, servers should enable
+// duplicate suppression (see server.UDPServer.SetDuplicateSuppression) so that
+// the callback queue of the request's target is not executed more than once.
+type RetryPolicy struct {
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// enabled reports whether the policy calls for any retransmissions.
+func (p RetryPolicy) enabled() bool {
+	return p.Retries > 0 && p.Backoff > 0
+}
+
+// next returns the wait before the retransmission following one which was
+// preceded by a wait of `backoff`.
+func (p RetryPolicy) next(backoff time.Duration) time.Duration {
+	if backoff *= 2; p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return backoff
+}
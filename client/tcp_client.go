@@ -0,0 +1,189 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/core/framing"
+	"github.com/navaz-alani/concord/packet"
+)
+
+// TCPClient is a Client implementation over a TCP connection, to a TCPServer.
+// Unlike the UDPClient, it is not throttled since TCP provides its own flow
+// and congestion control.
+type TCPClient struct {
+	ReadBuffSize int
+	pc           packet.PacketCreator
+	addr         *net.TCPAddr
+	conn         *net.TCPConn
+	pipelines    struct {
+		data   *core.DataPipeline
+		packet *core.PacketPipeline
+	}
+	writeStream chan *writePacket
+	miscStream  chan packet.Packet
+	doneStream  chan bool
+	requests    *requestTracker
+}
+
+func NewTCPClient(svrAddr *net.TCPAddr, readBuffSize int, pc packet.PacketCreator) (Client, error) {
+	conn, err := net.DialTCP("tcp", nil, svrAddr)
+	if err != nil {
+		return nil, err
+	}
+	client := &TCPClient{
+		ReadBuffSize: readBuffSize,
+		pc:           pc,
+		addr:         svrAddr,
+		conn:         conn,
+		pipelines: struct {
+			data   *core.DataPipeline
+			packet *core.PacketPipeline
+		}{
+			data:   core.NewDataPipeline(),
+			packet: core.NewPacketPipeline(),
+		},
+		writeStream: make(chan *writePacket),
+		miscStream:  make(chan packet.Packet),
+		doneStream:  make(chan bool),
+		requests:    newRequestTracker(pc),
+	}
+	// initialize client routines
+	go client.recv()
+	go client.write()
+	return client, nil
+}
+
+func (c *TCPClient) Misc() <-chan packet.Packet {
+	return c.miscStream
+}
+
+func (c *TCPClient) PacketProcessor() core.PacketProcessor {
+	return c.pipelines.packet
+}
+
+func (c *TCPClient) DataProcessor() core.DataProcessor {
+	return c.pipelines.data
+}
+
+func (c *TCPClient) Cleanup() error {
+	close(c.doneStream)
+	c.requests.failAll(requestStatusError, "client closed")
+	return c.conn.Close() // close underlying tcp connection
+}
+
+// Send attempts to send the given packet to the server. Its semantics are the
+// same as those of UDPClient.Send.
+func (c *TCPClient) Send(pkt packet.Packet, respCh chan packet.Packet) error {
+	return c.SendContext(context.Background(), pkt, respCh)
+}
+
+func (c *TCPClient) SendContext(ctx context.Context, pkt packet.Packet, respCh chan packet.Packet) error {
+	// create ref for packet, if doesn't already exist
+	var ref string
+	if ref = pkt.Meta().Get(packet.KeyRef); ref == "" {
+		ref = genRef(5)
+		pkt.Meta().Add(packet.KeyRef, ref)
+	}
+	bin, err := pkt.Marshal()
+	if err != nil {
+		return fmt.Errorf("packet encode failure")
+	}
+	transformCtx := &core.TransformContext{
+		PipelineCtx: core.PipelineCtx{
+			Pkt: pkt,
+		},
+		PipelineName: "_out_",
+	}
+	if bin, err = c.pipelines.data.Process(transformCtx, bin); err != nil {
+		return fmt.Errorf("data pipeline error: " + err.Error())
+	} else if transformCtx.Stat == core.CodeStopNoop {
+		return noopError(transformCtx)
+	}
+	// the request is tracked before it is written so that a fast response
+	// cannot arrive before its ref is known
+	done := c.requests.track(ctx, ref, respCh)
+	select {
+	case <-c.doneStream:
+		c.requests.abandon(ref)
+		return fmt.Errorf("client closed")
+	case <-done: // request abandoned before it could be written
+	case c.writeStream <- &writePacket{
+		data: bin,
+		ref:  ref,
+	}:
+	}
+	return nil
+}
+
+func (c *TCPClient) Request(ctx context.Context, pkt packet.Packet) (packet.Packet, error) {
+	return request(ctx, c, c.requests, c.pc, pkt)
+}
+
+func (c *TCPClient) RequestJSON(ctx context.Context, pkt packet.Packet, v interface{}) error {
+	return requestJSON(ctx, c, c.requests, c.pc, pkt, v)
+}
+
+func (c *TCPClient) SetTimeout(timeout time.Duration) {
+	c.requests.setTimeout(timeout)
+}
+
+func (c *TCPClient) write() {
+	for {
+		select {
+		case <-c.doneStream:
+			return
+		case pkt := <-c.writeStream:
+			if _, err := framing.WriteFrame(c.conn, pkt.data); err != nil {
+				c.requests.fail(pkt.ref, nil, requestStatusError, "packet write error: "+err.Error())
+			}
+		}
+	}
+}
+
+// recv routine reads packet frames from the underlying connection and spawns a
+// routine to process each of them. It exits when the connection is closed or
+// the stream can no longer be decoded into frames. ReadBuffSize is the maximum
+// size of a frame.
+func (c *TCPClient) recv() {
+	fr := framing.NewReader(c.conn, c.ReadBuffSize)
+	for {
+		data, err := fr.ReadFrame()
+		if err != nil {
+			return
+		}
+		go c.processIncoming(data)
+	}
+}
+
+func (c *TCPClient) processIncoming(data []byte) {
+	transformCtx := &core.TransformContext{
+		PipelineName: "_in_",
+		From:         c.addr.String(),
+	}
+	var err error
+	if data, err = c.pipelines.data.Process(transformCtx, data); err != nil {
+		return // ignoring packet if pipeline fails to process it
+	} else if transformCtx.Stat == core.CodeStopNoop {
+		return
+	}
+
+	pkt := c.pc.NewPkt("", "")
+	if err := pkt.Unmarshal(data); err == nil {
+		// ignoring malformed response error
+		ref := pkt.Meta().Get(packet.KeyRef)
+		ctx, refValid := c.requests.resolve(ref)
+		if refValid && ctx.respCh != nil {
+			ctx.respCh <- pkt
+		} else if !refValid && c.requests.isSettled(ref) {
+			c.pc.PutBack(pkt) // late or duplicate response to a settled request
+		} else {
+			// miscellaneous packets are sent to the client's miscCh channel and can
+			// be handled by the client.
+			c.miscStream <- pkt
+		}
+	}
+}
@@ -1,39 +1,21 @@
 package client
 
 import (
+	"context"
 	"fmt"
-	"math/rand"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/core/clock"
 	throttle "github.com/navaz-alani/concord/core/throttle"
 	"github.com/navaz-alani/concord/packet"
 )
 
-// Internal request statuses.
-const (
-	requestStatusWaiting uint8 = iota
-	requestStatusError
-	requestStatusTimeout
-)
-
-// requestCtx stores the status of the request as well as the response channel
-// over which the requestor can be delivered the response.
-type requestCtx struct {
-	respCh chan packet.Packet
-	msg    string
-	status uint8
-}
-
-type writePacket struct {
-	data   []byte
-	respCh chan packet.Packet
-}
-
 // UDPClient is a Client implementation over a UDP connection, to a UDPServer.
 type UDPClient struct {
-	mu           sync.RWMutex
+	mu           sync.RWMutex // mu protects `retry`
 	ReadBuffSize int
 	pc           packet.PacketCreator
 	addr         *net.UDPAddr
@@ -44,14 +26,25 @@ type UDPClient struct {
 	}
 	th          throttle.Throttle
 	writeStream chan *writePacket
-	sendStream  chan packet.Packet
 	miscStream  chan packet.Packet
 	doneStream  chan bool
-	requests    map[string]requestCtx
+	requests    *requestTracker
+	retry       RetryPolicy
 }
 
+// NewUDPClient creates a UDPClient for the server at `svrAddr`, whose reads and
+// writes are throttled by a UDPThrottle (see throttle.SleepFactory).
 func NewUDPClient(svrAddr *net.UDPAddr, listenAddr *net.UDPAddr, readBuffSize int,
 	pc packet.PacketCreator, throttleRate throttle.Rate) (Client, error) {
+	return NewUDPClientWithThrottle(svrAddr, listenAddr, readBuffSize, pc, throttleRate,
+		throttle.SleepFactory)
+}
+
+// NewUDPClientWithThrottle creates a UDPClient for the server at `svrAddr`,
+// whose reads and writes are throttled by a Throttle created with
+// `newThrottle`.
+func NewUDPClientWithThrottle(svrAddr *net.UDPAddr, listenAddr *net.UDPAddr, readBuffSize int,
+	pc packet.PacketCreator, throttleRate throttle.Rate, newThrottle throttle.Factory) (Client, error) {
 	if listenAddr == nil {
 		listenAddr = &net.UDPAddr{IP: []byte{0, 0, 0, 0}}
 	}
@@ -72,12 +65,11 @@ func NewUDPClient(svrAddr *net.UDPAddr, listenAddr *net.UDPAddr, readBuffSize in
 			data:   core.NewDataPipeline(),
 			packet: core.NewPacketPipeline(),
 		},
-		th:          throttle.NewUDPThrottle(throttleRate, conn, readBuffSize),
+		th:          newThrottle(throttleRate, conn, readBuffSize),
 		writeStream: make(chan *writePacket),
-		sendStream:  make(chan packet.Packet),
 		miscStream:  make(chan packet.Packet),
 		doneStream:  make(chan bool),
-		requests:    make(map[string]requestCtx),
+		requests:    newRequestTracker(pc),
 	}
 	// initialize client routines
 	go client.recv()
@@ -99,63 +91,159 @@ func (c *UDPClient) DataProcessor() core.DataProcessor {
 
 func (c *UDPClient) Cleanup() error {
 	close(c.doneStream)
+	c.requests.failAll(requestStatusError, "client closed")
 	c.th.Shutdown() // purge throttle resources
 	c.conn.Close()  // close underlying udp connection
 	return nil
 }
 
-// Helper to generate a length-dependent ref for a packet.
-func genRef(n int) string {
-	var letters = []rune(`abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789`)
-	s := make([]rune, n)
-	for i := range s {
-		s[i] = letters[rand.Intn(len(letters))]
-	}
-	return string(s)
-}
-
 // Send attempts to send the given packet to its set destination address. If
 // there are any errors with processing this packet, they will be returned.
 // When a packet is received by the user in respCh, it should be checked that it
-// is not an error packet informing the caller that the write operation failed.
-// This can be done by checking the "_stat" (should be -1) and "_msg" metadata
-// fields. Note that error packets sent by the clients will set the same error
-// fields as the ones sent from the server, the only difference being that, the
-// internally sent client error packets will not have a ref metadata value,
-// whereas server sent error packets do.
+// is not an error packet informing the caller that the write operation failed
+// or that the request timed out. This can be done by checking the "_stat"
+// (should be -1) and "_msg" metadata fields. Note that error packets sent by
+// the clients will set the same error fields as the ones sent from the server.
 func (c *UDPClient) Send(pkt packet.Packet, respCh chan packet.Packet) error {
+	return c.SendContext(context.Background(), pkt, respCh)
+}
+
+func (c *UDPClient) SendContext(ctx context.Context, pkt packet.Packet, respCh chan packet.Packet) error {
 	// create ref for packet, if doesn't already exist
 	var ref string
 	if ref = pkt.Meta().Get(packet.KeyRef); ref == "" {
 		ref = genRef(5)
 		pkt.Meta().Add(packet.KeyRef, ref)
 	}
-	if bin, err := pkt.Marshal(); err != nil {
+	plain, err := pkt.Marshal()
+	if err != nil {
 		return fmt.Errorf("packet encode failure")
-	} else {
-		transformCtx := &core.TransformContext{
-			PipelineCtx: core.PipelineCtx{
-				Pkt: pkt,
-			},
-			PipelineName: "_out_",
+	}
+	bin, err := c.transform(pkt, plain)
+	if err != nil {
+		return err
+	}
+	// the request is tracked before it is written so that a fast response
+	// cannot arrive before its ref is known
+	done := c.requests.track(ctx, ref, respCh)
+	select {
+	case <-c.doneStream:
+		c.requests.abandon(ref)
+		return fmt.Errorf("client closed")
+	case <-done: // request abandoned before it could be written
+		return nil
+	case c.writeStream <- &writePacket{
+		data: bin,
+		ref:  ref,
+	}:
+	}
+	c.mu.RLock()
+	policy := c.retry
+	c.mu.RUnlock()
+	if policy.enabled() {
+		go c.retransmit(done, policy, ref, pkt.Dest(), plain)
+	}
+	return nil
+}
+
+// transform runs the encoded packet `bin` through the client's outgoing data
+// pipeline, returning the data to be written to the connection.
+func (c *UDPClient) transform(pkt packet.Packet, bin []byte) ([]byte, error) {
+	transformCtx := &core.TransformContext{
+		PipelineCtx: core.PipelineCtx{
+			Pkt: pkt,
+		},
+		PipelineName: "_out_",
+	}
+	bin, err := c.pipelines.data.Process(transformCtx, bin)
+	if err != nil {
+		return nil, fmt.Errorf("data pipeline error: " + err.Error())
+	} else if transformCtx.Stat == core.CodeStopNoop {
+		return nil, noopError(transformCtx)
+	}
+	return bin, nil
+}
+
+// retransmit is a routine which retransmits the request with the given ref,
+// according to `policy`, until the request is no longer pending. Since the
+// requestor may reuse the original packet once Send has returned, the packet
+// is reconstructed from its encoding, `plain`, for every retransmission and
+// sent through the data pipeline afresh.
+func (c *UDPClient) retransmit(done <-chan struct{}, policy RetryPolicy,
+	ref, dest string, plain []byte) {
+	backoff := policy.Backoff
+	clk := c.requests.getClock()
+	for i := 0; i < policy.Retries; i++ {
+		timer := clk.NewTimer(backoff)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-c.doneStream:
+			timer.Stop()
+			return
+		case <-timer.C():
 		}
-		var err error
-		if bin, err = c.pipelines.data.Process(transformCtx, bin); err != nil {
-			return fmt.Errorf("data pipeline error: " + err.Error())
-		} else if transformCtx.Stat == core.CodeStopNoop {
-			return fmt.Errorf("data pipeline enforced noop")
+		if !c.requests.retransmitting(ref) {
+			return
 		}
-		c.writeStream <- &writePacket{
-			data:   bin,
-			respCh: respCh,
+		pkt := c.pc.NewPkt("", dest)
+		if err := pkt.Unmarshal(plain); err == nil {
+			if bin, err := c.transform(pkt, plain); err == nil {
+				select {
+				case <-done:
+				case <-c.doneStream:
+				case c.writeStream <- &writePacket{data: bin, ref: ref}:
+				}
+			}
 		}
+		c.pc.PutBack(pkt)
+		backoff = policy.next(backoff)
 	}
+}
+
+// SetRetryPolicy configures the retransmission of unanswered requests sent
+// after the call. The zero RetryPolicy disables retransmissions, which is the
+// default.
+func (c *UDPClient) SetRetryPolicy(policy RetryPolicy) {
 	c.mu.Lock()
-	c.requests[ref] = requestCtx{
-		respCh: respCh,
-	}
-	c.mu.Unlock()
-	return nil
+	defer c.mu.Unlock()
+	c.retry = policy
+}
+
+// SetClock sets the Clock with which request timeouts and retransmission
+// backoffs are measured (clock.Real by default). The client's Throttle keeps
+// its own Clock, which is set when it is created (see, for example,
+// throttle.NewUDPThrottleWithClock).
+func (c *UDPClient) SetClock(clk clock.Clock) {
+	c.requests.setClock(clk)
+}
+
+// SetController sets the congestion Controller which adjusts the throughput of
+// the client's Throttle (see Throttle). It is told about every response, as a
+// success, and every lost request, as a loss. A request is lost once: when it
+// is first retransmitted or, if it is not retransmitted, when it times out. A
+// nil Controller, the default, leaves the throughput fixed.
+func (c *UDPClient) SetController(ctrl throttle.Controller) {
+	c.requests.setController(ctrl)
+}
+
+// Throttle returns the Throttle which limits the client's reads and writes,
+// for example to create a Controller for it.
+func (c *UDPClient) Throttle() throttle.Throttle {
+	return c.th
+}
+
+func (c *UDPClient) Request(ctx context.Context, pkt packet.Packet) (packet.Packet, error) {
+	return request(ctx, c, c.requests, c.pc, pkt)
+}
+
+func (c *UDPClient) RequestJSON(ctx context.Context, pkt packet.Packet, v interface{}) error {
+	return requestJSON(ctx, c, c.requests, c.pc, pkt, v)
+}
+
+func (c *UDPClient) SetTimeout(timeout time.Duration) {
+	c.requests.setTimeout(timeout)
 }
 
 func (c *UDPClient) write() {
@@ -165,9 +253,7 @@ func (c *UDPClient) write() {
 			return
 		case pkt := <-c.writeStream:
 			if _, err := c.th.WriteTo(pkt.data, c.addr); err != nil {
-				if pkt.respCh != nil {
-					pkt.respCh <- c.pc.NewErrPkt("", "", "packet write error: "+err.Error())
-				}
+				c.requests.fail(pkt.ref, nil, requestStatusError, "packet write error: "+err.Error())
 			}
 		}
 	}
@@ -196,24 +282,23 @@ func (c *UDPClient) processIncoming(data []byte) {
 	var err error
 	if data, err = c.pipelines.data.Process(transformCtx, data); err != nil {
 		return // ignoring packet if pipeline fails to process it
+	} else if transformCtx.Stat == core.CodeStopNoop {
+		return
 	}
 
 	pkt := c.pc.NewPkt("", "")
 	if err := pkt.Unmarshal(data); err == nil {
 		// ignoring malformed response error
 		ref := pkt.Meta().Get(packet.KeyRef)
-		c.mu.RLock()
-		ctx, refValid := c.requests[ref]
-		c.mu.RUnlock()
+		ctx, refValid := c.requests.resolve(ref)
 		if refValid && ctx.respCh != nil {
 			ctx.respCh <- pkt
+		} else if !refValid && c.requests.isSettled(ref) {
+			c.pc.PutBack(pkt) // late or duplicate response to a settled request
 		} else {
 			// miscellaneous packets are sent to the client's miscCh channel and can
 			// be handled by the client.
 			c.miscStream <- pkt
 		}
-		c.mu.Lock()
-		delete(c.requests, ref)
-		c.mu.Unlock()
 	}
 }
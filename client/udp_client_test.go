@@ -0,0 +1,180 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/core/clock/clocktest"
+	throttle "github.com/navaz-alani/concord/core/throttle"
+	"github.com/navaz-alani/concord/packet"
+)
+
+// newTestUDPServer listens on a loopback port and calls `handle` with every
+// request packet received, returning the address of the listener.
+func newTestUDPServer(t *testing.T, pc packet.PacketCreator,
+	handle func(conn *net.UDPConn, from net.Addr, req packet.Packet)) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: []byte{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buff := make([]byte, 4096)
+		for {
+			n, from, err := conn.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			req := pc.NewPkt("", "")
+			if err := req.Unmarshal(buff[:n]); err == nil {
+				go handle(conn, from, req)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func newTestUDPClient(t *testing.T, svrAddr *net.UDPAddr, pc packet.PacketCreator) *UDPClient {
+	cl, err := NewUDPClient(svrAddr, &net.UDPAddr{IP: []byte{127, 0, 0, 1}}, 4096, pc, throttle.Rate10k)
+	if err != nil {
+		t.Fatalf("NewUDPClient: %v", err)
+	}
+	return cl.(*UDPClient)
+}
+
+func TestUDPClientSendAfterCleanup(t *testing.T) {
+	pc := packet.NewJSONPktCreator(10)
+	svrAddr := newTestUDPServer(t, pc, func(*net.UDPConn, net.Addr, packet.Packet) {})
+	cl := newTestUDPClient(t, svrAddr, pc)
+	cl.Cleanup()
+	sent := make(chan error, 1)
+	go func() { sent <- cl.Send(pc.NewPkt("", ""), nil) }()
+	select {
+	case err := <-sent:
+		if err == nil {
+			t.Fatal("Send on a closed client succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send on a closed client blocked")
+	}
+}
+
+func TestUDPClientSendCanceled(t *testing.T) {
+	pc := packet.NewJSONPktCreator(10)
+	svrAddr := newTestUDPServer(t, pc, func(*net.UDPConn, net.Addr, packet.Packet) {})
+	cl := newTestUDPClient(t, svrAddr, pc)
+	defer cl.Cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cl.Request(ctx, pc.NewPkt("", "")); err != context.Canceled {
+		t.Fatalf("Request = %v, want context.Canceled", err)
+	}
+}
+
+func TestUDPClientLateResponse(t *testing.T) {
+	pc := packet.NewJSONPktCreator(10)
+	const timeout = 50 * time.Millisecond
+	svrAddr := newTestUDPServer(t, pc, func(conn *net.UDPConn, from net.Addr, req packet.Packet) {
+		time.Sleep(2 * timeout) // respond after the request has timed out
+		resp := pc.NewPkt(req.Meta().Get(packet.KeyRef), "")
+		bin, _ := resp.Marshal()
+		conn.WriteTo(bin, from)
+	})
+	cl := newTestUDPClient(t, svrAddr, pc)
+	defer cl.Cleanup()
+	cl.SetTimeout(timeout)
+	pkt := pc.NewPkt("", "")
+	_, err := cl.Request(context.Background(), pkt)
+	if err != ErrTimeout || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Request = %v, want ErrTimeout, wrapping context.DeadlineExceeded", err)
+	}
+	ref := pkt.Meta().Get(packet.KeyRef)
+	select {
+	case late := <-cl.Misc():
+		t.Fatalf("late response %q delivered as a miscellaneous packet", late.Meta().Get(packet.KeyRef))
+	case <-time.After(4 * timeout):
+	}
+	if !cl.requests.isSettled(ref) {
+		t.Errorf("timed out request %q is not settled", ref)
+	}
+}
+
+func TestUDPClientServerError(t *testing.T) {
+	pc := packet.NewJSONPktCreator(10)
+	svrAddr := newTestUDPServer(t, pc, func(conn *net.UDPConn, from net.Addr, req packet.Packet) {
+		resp := pc.NewErrPkt(req.Meta().Get(packet.KeyRef), "", "request timeout")
+		bin, _ := resp.Marshal()
+		conn.WriteTo(bin, from)
+	})
+	cl := newTestUDPClient(t, svrAddr, pc)
+	defer cl.Cleanup()
+	// an error sent by the server is a ServerError, whatever its message
+	_, err := cl.Request(context.Background(), pc.NewPkt("", ""))
+	if svrErr, ok := err.(*ServerError); !ok || svrErr.Msg != "request timeout" {
+		t.Fatalf("Request = %v, want a *ServerError", err)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("server error %v is a context.DeadlineExceeded", err)
+	}
+}
+
+func TestUDPClientTimeoutClock(t *testing.T) {
+	pc := packet.NewJSONPktCreator(10)
+	svrAddr := newTestUDPServer(t, pc, func(*net.UDPConn, net.Addr, packet.Packet) {})
+	cl := newTestUDPClient(t, svrAddr, pc)
+	defer cl.Cleanup()
+	clk := clocktest.NewManual(time.Unix(0, 0))
+	cl.SetClock(clk)
+	cl.SetTimeout(time.Hour)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := cl.Request(context.Background(), pc.NewPkt("", ""))
+		errs <- err
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(time.Hour - time.Nanosecond)
+	if clk.Timers() != 1 {
+		t.Fatal("request timed out before an hour had passed")
+	}
+	clk.Advance(time.Nanosecond)
+	select {
+	case err := <-errs:
+		if err != ErrTimeout {
+			t.Fatalf("Request = %v, want ErrTimeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request not timed out after an hour had passed")
+	}
+}
+
+func TestUDPClientCleanupPending(t *testing.T) {
+	pc := packet.NewJSONPktCreator(10)
+	received := make(chan struct{}, 1)
+	svrAddr := newTestUDPServer(t, pc, func(*net.UDPConn, net.Addr, packet.Packet) {
+		received <- struct{}{} // never respond
+	})
+	cl := newTestUDPClient(t, svrAddr, pc)
+	cl.SetTimeout(0) // the request can only be failed by Cleanup
+	errs := make(chan error, 1)
+	go func() {
+		_, err := cl.Request(context.Background(), pc.NewPkt("", ""))
+		errs <- err
+	}()
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("request not received by the server")
+	}
+	cl.Cleanup()
+	select {
+	case err := <-errs:
+		if reqErr, ok := err.(*RequestError); !ok || reqErr.Msg != "client closed" {
+			t.Fatalf("Request = %v, want a client closed *RequestError", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending request not failed by Cleanup")
+	}
+}
@@ -0,0 +1,52 @@
+// Package clock abstracts the passage of time, so that time-based behaviour
+// (such as throttling, request timeouts and key expiry) can be driven by a
+// fake clock in tests, instead of waiting in real time. Components which take
+// a Clock use Real by default; see the clocktest package for a manual Clock.
+package clock
+
+import "time"
+
+// Clock tells the time and waits for durations of time to pass.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Sleep blocks until the duration `d` has passed.
+	Sleep(d time.Duration)
+	// NewTimer creates a Timer which fires once the duration `d` has passed.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer delivers the time over its channel once, when it fires (like
+// time.Timer).
+type Timer interface {
+	// C returns the channel over which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the Timer from firing. It returns false if the Timer has
+	// already fired or been stopped.
+	Stop() bool
+}
+
+// Real is the Clock of the system's time, from the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
@@ -0,0 +1,123 @@
+// Package clocktest provides a manual clock.Clock, for tests of time-based
+// behaviour which run in milliseconds and do not depend on scheduling.
+package clocktest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/navaz-alani/concord/core/clock"
+)
+
+// Manual is a clock.Clock whose time only moves when it is advanced. Timers
+// (and sleeps) fire once the clock has been advanced past their deadlines, so
+// a test can, for example, check that a throttled operation is still blocked
+// just before its deadline and has completed just after it.
+//
+// Since the code under test usually waits on the clock from other go-routines,
+// tests should use BlockUntil to wait for that code to start waiting before
+// advancing the clock.
+type Manual struct {
+	mu     sync.Mutex // mu protects `now` and `timers`
+	cond   *sync.Cond // broadcast whenever a timer is added
+	now    time.Time
+	timers []*timer // pending timers
+}
+
+// NewManual creates a Manual clock, whose time is `start`.
+func NewManual(start time.Time) *Manual {
+	m := &Manual{
+		mu:  sync.Mutex{},
+		now: start,
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+func (m *Manual) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// Sleep blocks until the clock has been advanced by `d`.
+func (m *Manual) Sleep(d time.Duration) {
+	<-m.NewTimer(d).C()
+}
+
+// NewTimer creates a Timer which fires once the clock has been advanced by
+// `d`. A Timer with a non-positive `d` fires immediately.
+func (m *Manual) NewTimer(d time.Duration) clock.Timer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := &timer{
+		m:    m,
+		c:    make(chan time.Time, 1),
+		when: m.now.Add(d),
+	}
+	if d <= 0 {
+		t.c <- m.now
+		return t
+	}
+	m.timers = append(m.timers, t)
+	m.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward by `d`, firing the timers whose deadlines
+// have been reached, in order of their deadlines.
+func (m *Manual) Advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = m.now.Add(d)
+	sort.SliceStable(m.timers, func(i, j int) bool {
+		return m.timers[i].when.Before(m.timers[j].when)
+	})
+	n := 0
+	for ; n < len(m.timers) && !m.timers[n].when.After(m.now); n++ {
+		m.timers[n].c <- m.now
+	}
+	m.timers = m.timers[n:]
+}
+
+// Timers returns the number of pending timers (including sleeps).
+func (m *Manual) Timers() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.timers)
+}
+
+// BlockUntil blocks until there are at least `n` pending timers (including
+// sleeps).
+func (m *Manual) BlockUntil(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.timers) < n {
+		m.cond.Wait()
+	}
+}
+
+// timer is a clock.Timer of a Manual clock. Its channel is buffered, so that
+// it can be fired while the clock is locked.
+type timer struct {
+	m    *Manual
+	c    chan time.Time
+	when time.Time
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *timer) Stop() bool {
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	for i, pending := range t.m.timers {
+		if pending == t {
+			t.m.timers = append(t.m.timers[:i], t.m.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// AEAD is an authenticated encryption scheme, with additional data, which can
+// be used by a cipher Suite. Its keys are KeySize bytes long.
+type AEAD interface {
+	// Name returns the name of the scheme.
+	Name() string
+	// New returns the scheme's cipher.AEAD, using `key`.
+	New(key []byte) (cipher.AEAD, error)
+}
+
+type aesGCM struct{}
+
+func (aesGCM) Name() string { return "aes256gcm" }
+
+func (aesGCM) New(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("cipher init fail: " + err.Error())
+	}
+	return cipher.NewGCM(block)
+}
+
+type chaCha20Poly1305 struct{}
+
+func (chaCha20Poly1305) Name() string { return "chacha20poly1305" }
+
+func (chaCha20Poly1305) New(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
+
+// The AEAD schemes provided by Crypto.
+var (
+	// AES256GCM is AES-256 in GCM mode. It is the faster scheme on hardware
+	// with AES instructions.
+	AES256GCM AEAD = aesGCM{}
+	// ChaCha20Poly1305 is the ChaCha20-Poly1305 scheme of RFC 8439. It is the
+	// faster scheme on hardware without AES instructions.
+	ChaCha20Poly1305 AEAD = chaCha20Poly1305{}
+)
+
+// encrypt seals `data` with the scheme `a` under `key`, authenticating the
+// additional data `ad` along with it. The random nonce is prepended to the
+// returned ciphertext.
+func encrypt(a AEAD, key, data, ad []byte) ([]byte, error) {
+	aead, err := a.New(key)
+	if err != nil {
+		return data, fmt.Errorf(a.Name() + " init fail: " + err.Error())
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return data, fmt.Errorf("nonce gen fail: " + err.Error())
+	}
+	return aead.Seal(nonce, nonce, data, ad), nil
+}
+
+// decrypt opens the ciphertext `data`, produced by encrypt with the same scheme
+// `a`, `key` and additional data `ad`.
+func decrypt(a AEAD, key, data, ad []byte) ([]byte, error) {
+	aead, err := a.New(key)
+	if err != nil {
+		return data, fmt.Errorf(a.Name() + " init fail: " + err.Error())
+	}
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize {
+		return data, fmt.Errorf("decrypt fail: ciphertext too short")
+	}
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	if decrypted, err := aead.Open(nil, nonce, ciphertext, ad); err != nil {
+		return data, fmt.Errorf("decrypt fail: " + err.Error())
+	} else {
+		return decrypted, nil
+	}
+}
@@ -1,8 +1,9 @@
 package crypto
 
 import (
+	"context"
 	"crypto/ecdsa"
-	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 
@@ -18,7 +19,10 @@ func (cr *Crypto) installOnClient(p core.Processor) error {
 // IsKeyExchanged reports whether or not a successful handshake has been
 // performed with the given address.
 func (cr *Crypto) IsKeyExchanged(addr string) bool {
-	_, ok := cr.getKeyStore(addr)
+	if _, ok := cr.getSession(addr); ok {
+		return true
+	}
+	_, ok := cr.getPeer(addr)
 	return ok
 }
 
@@ -27,27 +31,39 @@ func (cr *Crypto) IsKeyExchanged(addr string) bool {
 // svrAddr. If successful, the connection between the server and the returned
 // client will be secure i.e. packets sent between the server and the client
 // will be encrypted with AES, using a shared key generated using ECDH. The
-// `pkt` parameter will be used to compose the key exchange packet with the
-// server (ownership of `pkt` is assumed by ConfigureClient).
-func ConfigureClient(client client.Client, svrAddr string, pkt packet.Packet) (*Crypto, error) {
-	// generate private key
-	privKey, err := ecdsa.GenerateKey(Curve, rand.Reader)
-	if err != nil {
-		return nil, fmt.Errorf("public key gen fail: %s", err.Error())
-	}
-	// initialize Crypto extension
+// key exchange fails unless the server's key is signed by an identity key
+// trusted by `trust` for `svrAddr`. The cipher suite of the session is
+// negotiated with the server (see Crypto.SetSuites). The `pkt` parameter will be used to
+// compose the key exchange packet with the server (ownership of `pkt` is
+// assumed by ConfigureClient).
+//
+// The client is given a fresh identity key. To keep the client's identity
+// across restarts (for example, so that its peers' pins remain valid), use
+// ConfigureClientWithKey.
+func ConfigureClient(client client.Client, svrAddr string, trust *TrustStore,
+	pkt packet.Packet) (*Crypto, error) {
+	return ConfigureClientWithKey(client, svrAddr, trust, nil, pkt)
+}
+
+// ConfigureClientWithKey is like ConfigureClient, but the client's identity
+// key is `privKey` (such as one loaded with LoadOrCreateIdentityKey). If
+// `privKey` is nil, a fresh identity key is generated.
+func ConfigureClientWithKey(client client.Client, svrAddr string, trust *TrustStore,
+	privKey *ecdsa.PrivateKey, pkt packet.Packet) (*Crypto, error) {
+	// initialize Crypto extension (generating a private key if need be)
 	cr, err := NewCrypto(privKey)
 	if err != nil {
 		return nil, fmt.Errorf("Crypto extension error: %s", err.Error())
 	}
-	// perform key-exchange with server
-	if err := cr.ServerKEx(client, svrAddr, pkt); err != nil {
-		return nil, fmt.Errorf("handshake error: %s", err.Error())
-	}
+	cr.SetTrustStore(trust)
 	// install extension on client pipelines to provide transport encryption
 	if err = cr.Extend("client", client); err != nil {
 		return nil, fmt.Errorf("Crypto install err: %s", err.Error())
 	}
+	// perform key-exchange with server
+	if err := cr.ServerKEx(client, svrAddr, pkt); err != nil {
+		return nil, err
+	}
 	return cr, nil
 }
 
@@ -59,19 +75,92 @@ func ConfigureClient(client client.Client, svrAddr string, pkt packet.Packet) (*
 func (cr *Crypto) ConfigureKeyExClientPkt(addr string, pw packet.Writer) {
 	pw.Clear()
 	pw.Meta().Add(packet.KeyTarget, TargetKeyExchangeClient)
+	pw.Meta().Add(KeyVersion, ProtocolVersion)
 	pw.Write([]byte(fmt.Sprintf(`{"ip":"%s"}`, addr)))
 	pw.Close()
 }
 
+// kexOffer is a client's offer in a server key exchange: the cipher suites
+// offered, in order of preference, and the private and public key shares for
+// their key agreements, by KeyAgreement name.
+type kexOffer struct {
+	suites        []*Suite
+	names         []string
+	privs, shares map[string][]byte
+}
+
+// newOffer creates an offer of the Crypto's suites, with fresh ephemeral key
+// shares for their key agreements. The Crypto's identity key is never used as
+// a key share, so that the compromise of a session's keys reveals nothing of
+// the identity key (and sessions keep forward secrecy).
+func (cr *Crypto) newOffer() (*kexOffer, error) {
+	offer := &kexOffer{
+		suites: cr.getSuites(),
+		privs:  make(map[string][]byte),
+		shares: make(map[string][]byte),
+	}
+	for _, suite := range offer.suites {
+		offer.names = append(offer.names, suite.Name)
+		ka := suite.KeyAgreement
+		if _, ok := offer.shares[ka.Name()]; ok {
+			continue
+		} else if priv, pub, err := ka.GenerateKey(); err != nil {
+			return nil, fmt.Errorf(ka.Name() + " key gen fail: " + err.Error())
+		} else {
+			offer.privs[ka.Name()], offer.shares[ka.Name()] = priv, pub
+		}
+	}
+	return offer, nil
+}
+
+// suite returns the offered suite with the given name.
+func (o *kexOffer) suite(name string) (*Suite, bool) {
+	for _, suite := range o.suites {
+		if suite.Name == name {
+			return suite, true
+		}
+	}
+	return nil, false
+}
+
+func (cr *Crypto) setOffer(offer *kexOffer) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.offer = offer
+}
+
+func (cr *Crypto) getOffer() *kexOffer {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.offer
+}
+
 // ConfigureKeyExServerPkt writes the configuration (target, metadata, body, etc)
-// for a client-server key-exchange. The packet being written to must be new and
-// after a call to this method, the packet's Write method should not be used.
-// Also, this method will clear pw's underlying packet.
-func (cr *Crypto) ConfigureKeyExServerPkt(pw packet.Writer) {
+// for a client-server key-exchange, offering the Crypto's cipher suites. The
+// packet being written to must be new and after a call to this method, the
+// packet's Write method should not be used. Also, this method will clear pw's
+// underlying packet. Since the offer is kept to process the response, only
+// one server key exchange may be performed at a time.
+func (cr *Crypto) ConfigureKeyExServerPkt(pw packet.Writer) error {
+	offer, err := cr.newOffer()
+	if err != nil {
+		return err
+	}
+	own := cr.IdentityKey()
+	req, _ := json.Marshal(kexRequest{
+		PublicKey: own,
+		Suites:    offer.names,
+		Shares:    offer.shares,
+		Agreement: cr.signed,
+	})
+	cr.setOffer(offer)
 	pw.Clear()
 	pw.Meta().Add(packet.KeyTarget, TargetKeyExchangeServer)
-	pw.Write(cr.publicKey)
+	pw.Meta().Add(KeyVersion, ProtocolVersion)
+	pw.Meta().Add(KeyNoCrypto, "true")
+	pw.Write(req)
 	pw.Close()
+	return nil
 }
 
 // EncryptFor encrypts the given data for the given address using the
@@ -82,9 +171,17 @@ func (cr *Crypto) ConfigureKeyExServerPkt(pw packet.Writer) {
 // server-relayed to `addr`. To generate a shared key with `addr`, a
 // client-client key exchange has to be performed.
 func (cr *Crypto) EncryptFor(addr string, data []byte) ([]byte, error) {
-	if ks, ok := cr.getKeyStore(addr); !ok {
+	return cr.encryptFor(addr, data, nil)
+}
+
+// encryptFor encrypts `data` for `addr`, binding the additional data `ad`.
+func (cr *Crypto) encryptFor(addr string, data, ad []byte) ([]byte, error) {
+	ks, ok := cr.getPeer(addr)
+	if !ok {
 		return nil, fmt.Errorf("keys not exchanged")
-	} else if encrypted, err := encryptAES(ks.shared.Bytes(), data); err != nil {
+	}
+	sk := ks.current()
+	if encrypted, err := encrypt(sk.aead, sk.tx, data, ad); err != nil {
 		return nil, fmt.Errorf("encryption error: " + err.Error())
 	} else {
 		return encrypted, nil
@@ -99,9 +196,18 @@ func (cr *Crypto) EncryptFor(addr string, data []byte) ([]byte, error) {
 // been server-relayed from the given address. To generate a shared key with
 // `addr`, a client-client key exchange has to be performed.
 func (cr *Crypto) DecryptFrom(addr string, data []byte) ([]byte, error) {
-	if ks, ok := cr.getKeyStore(addr); !ok {
+	return cr.decryptFrom(addr, data, nil)
+}
+
+// decryptFrom decrypts `data` from `addr`, which must be bound to the
+// additional data `ad`.
+func (cr *Crypto) decryptFrom(addr string, data, ad []byte) ([]byte, error) {
+	ks, ok := cr.getPeer(addr)
+	if !ok {
 		return nil, fmt.Errorf("keys not exchanged")
-	} else if decrypted, err := decryptAES(ks.shared.Bytes(), data); err != nil {
+	}
+	sk := ks.current()
+	if decrypted, err := decrypt(sk.aead, sk.rx, data, ad); err != nil {
 		return nil, fmt.Errorf("encryption error: " + err.Error())
 	} else {
 		return decrypted, nil
@@ -134,35 +240,140 @@ func (cr *Crypto) EncryptE2E(to string, pkt packet.Packet) error {
 
 // DecryptE2E performs decryption on end-to-end encrypted packet data from the
 // specified sender. The packet is modified so that its Data method returns the
-// decrypted data. Clients should use this to decrypt packets.
+// decrypted data. Clients should use this to decrypt packets. If the data was
+// encrypted with EncryptE2ESealed, the metadata sealed with it is also restored
+// on the packet, replacing any plain text values of the same keys.
 //
 // Note that before this function can work, it needs a shared key with the
 // sender of the packet. If a key exchange has been successfully performed, then
 // there will most likely be no errors.
 func (cr *Crypto) DecryptE2E(sender string, pkt packet.Packet) error {
-	if decrypted, err := cr.DecryptFrom(sender, pkt.Data()); err != nil {
-		return fmt.Errorf("e2e decrypt error: %s", err.Error())
-	} else {
+	if decrypted, err := cr.DecryptFrom(sender, pkt.Data()); err == nil {
 		writer := pkt.Writer()
 		writer.Clear()
 		writer.Write(decrypted)
 		writer.Close()
 		return nil
+	} else if envelope, sealErr := cr.decryptFrom(sender, pkt.Data(), []byte(sealedContext)); sealErr != nil {
+		return fmt.Errorf("e2e decrypt error: %s", err.Error())
+	} else if err := unseal(envelope, pkt); err != nil {
+		return fmt.Errorf("e2e decrypt error: %s", err.Error())
 	}
+	return nil
 }
 
-// ProcessKeyExResp processes the response to a key-exchange with the given
-// address (server address if server and client address otherwise).
+// ProcessKeyExResp processes the response to a client-client key-exchange with
+// the given client address. The peer's agreement key is only accepted if it has
+// been signed by the peer's identity key, and that identity key is trusted: if
+// the Crypto's TrustStore pins identity keys for `addr`, it must be one of them.
+// Otherwise, the identity key is trusted on first use and must not change in
+// later key exchanges with `addr` (until it is forgotten, see Crypto.Forget).
+// Such identity keys should be verified out of band (see Crypto.SafetyNumber).
 func (cr *Crypto) ProcessKeyExResp(addr string, resp packet.Packet) error {
-	var pk PublicKey
+	if err := checkRespVersion(resp); err != nil {
+		return err
+	}
+	var pk PeerKey
 	if err := json.Unmarshal(resp.Data(), &pk); err != nil {
 		return fmt.Errorf("packet decode error: " + err.Error())
+	} else if !pk.PublicKey.valid() {
+		return fmt.Errorf("invalid public key")
+	} else if err := verifyAgreement(&pk.PublicKey, &pk.SignedKey); err != nil {
+		return err
+	} else if err := cr.checkPeerIdentity(addr, &pk.PublicKey); err != nil {
+		return err
 	}
 	// store key
-	cr.setKeyStore(addr, &keyStore{
-		keySent: true,
-		public:  &pk,
-		shared:  cr.computeSharedKey(&pk),
+	secret, err := P256.SharedSecret(cr.agreement, pk.Key)
+	if err != nil {
+		return fmt.Errorf("invalid peer key")
+	}
+	tx, rx := deriveE2EKeys(secret, cr.signed.Key, pk.Key)
+	cr.setPeer(addr, &keyStore{
+		state:     sessionEstablished,
+		addr:      addr,
+		suite:     SuiteP256AES256GCM,
+		public:    &pk.PublicKey,
+		agreement: &pk.SignedKey,
+		cur:       newSessionKeys(SuiteP256AES256GCM.AEAD, tx, rx, cr.now()),
+	})
+	return nil
+}
+
+// checkPeerIdentity verifies that the identity key `identity`, presented for
+// the client at `addr`, is trusted.
+func (cr *Crypto) checkPeerIdentity(addr string, identity *PublicKey) error {
+	if trust := cr.getTrustStore(); trust != nil {
+		if pinned, trusted := trust.verifyPeer(addr, identity); pinned && !trusted {
+			return fmt.Errorf("peer identity key not trusted")
+		} else if pinned {
+			return nil
+		}
+	}
+	if ks, ok := cr.getPeer(addr); ok && !ks.public.equal(identity) {
+		return fmt.Errorf("peer identity key changed")
+	}
+	return nil
+}
+
+// checkRespVersion verifies that the key exchange response `resp` uses this
+// Crypto's protocol version. If the response is an error packet, the error is
+// returned instead.
+func checkRespVersion(resp packet.Packet) error {
+	if resp.Meta().Get(packet.KeySvrStatus) == "-1" {
+		return fmt.Errorf("server error: " + resp.Meta().Get(packet.KeySvrMsg))
+	} else if v := resp.Meta().Get(KeyVersion); v != ProtocolVersion {
+		return fmt.Errorf("unsupported crypto protocol version \"%s\" (client uses \"%s\")",
+			v, ProtocolVersion)
+	}
+	return nil
+}
+
+// ProcessKeyExServerResp processes the response to a client-server
+// key-exchange with the server at `svrAddr`. The server's key is only accepted
+// if it has been signed by an identity key which the Crypto's TrustStore
+// trusts for `svrAddr`. The session established is identified by the session
+// ID issued by the server.
+func (cr *Crypto) ProcessKeyExServerResp(svrAddr string, resp packet.Packet) error {
+	trust := cr.getTrustStore()
+	if trust == nil {
+		return fmt.Errorf("no trust store to verify server key")
+	} else if err := checkRespVersion(resp); err != nil {
+		return err
+	}
+	offer := cr.getOffer()
+	if offer == nil {
+		return fmt.Errorf("no key exchange offer")
+	}
+	var sk SignedKey
+	if err := json.Unmarshal(resp.Data(), &sk); err != nil {
+		return fmt.Errorf("packet decode error: " + err.Error())
+	}
+	suite, ok := offer.suite(sk.Suite)
+	if !ok {
+		return fmt.Errorf("server selected cipher suite \"%s\", which was not offered", sk.Suite)
+	}
+	ka := suite.KeyAgreement.Name()
+	if err := trust.verifySignedKey(svrAddr, offer.names, offer.shares[ka], &sk); err != nil {
+		return err
+	}
+	id, err := parseSessionID(resp.Meta().Get(KeySession))
+	if err != nil {
+		return err
+	}
+	secret, err := suite.KeyAgreement.SharedSecret(offer.privs[ka], sk.Key)
+	if err != nil {
+		return fmt.Errorf("invalid server key")
+	}
+	// store key
+	tx, rx := deriveKeys(secret, transcript(suite.Name, offer.shares[ka], sk.Key), true)
+	keys := newSessionKeys(suite.AEAD, tx, rx, cr.now())
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.setSession(id, svrAddr, &keyStore{
+		state: sessionEstablished,
+		suite: suite,
+		cur:   keys,
 	})
 	return nil
 }
@@ -175,27 +386,76 @@ func (cr *Crypto) ProcessKeyExResp(addr string, resp packet.Packet) error {
 // encryption (metadata and data), in contrast to end-to-end encryption which is
 // just a data encrytion i.e. the packet's metadata will still possibly be in
 // plain text.
+//
+// The handshake is completed by proving to the server that the session keys
+// have been derived, after which the server may send packets in the session.
+// Until the handshake is complete, packets to `svrAddr` which would be
+// encrypted are rejected, rather than being sent in plain text. `pkt` is used
+// for both of the handshake's requests.
 func (cr *Crypto) ServerKEx(client client.Client, svrAddr string, pkt packet.Packet) error {
-	cr.ConfigureKeyExServerPkt(pkt.Writer())
-	kexResp := make(chan packet.Packet)
-	client.Send(pkt, kexResp)
-	if err := cr.ProcessKeyExResp(svrAddr, <-kexResp); err != nil {
+	placeholder := &keyStore{state: sessionPending}
+	if _, err := cr.newSession(svrAddr, placeholder); err != nil {
+		return fmt.Errorf("handshake error: %s", err.Error())
+	}
+	if err := cr.serverKEx(client, svrAddr, pkt); err != nil {
+		cr.abandon(placeholder)
 		return fmt.Errorf("handshake error: %s", err.Error())
 	}
 	return nil
 }
 
+func (cr *Crypto) serverKEx(client client.Client, svrAddr string, pkt packet.Packet) error {
+	if err := cr.ConfigureKeyExServerPkt(pkt.Writer()); err != nil {
+		return err
+	}
+	resp, err := client.Request(context.Background(), pkt)
+	if err != nil {
+		return err
+	} else if err := cr.ProcessKeyExServerResp(svrAddr, resp); err != nil {
+		return err
+	}
+	ks, ok := cr.getSession(svrAddr)
+	if !ok {
+		return fmt.Errorf("session removed during handshake")
+	}
+	// prove possession of the session keys to the server
+	sk := ks.current()
+	proof, err := encrypt(sk.aead, sk.tx, nil, []byte(kexFinContext))
+	if err != nil {
+		return fmt.Errorf("proof gen fail: " + err.Error())
+	}
+	pw := pkt.Writer()
+	pw.Clear()
+	pw.Meta().Add(packet.KeyRef, "") // a new request
+	pw.Meta().Add(packet.KeyTarget, TargetKeyExchangeFin)
+	pw.Meta().Add(KeySession, hex.EncodeToString([]byte(ks.id)))
+	pw.Write(proof)
+	pw.Close()
+	if resp, err = client.Request(context.Background(), pkt); err != nil {
+		cr.abandon(ks)
+		return err
+	} else if err := checkRespVersion(resp); err != nil {
+		cr.abandon(ks)
+		return err
+	}
+	return nil
+}
+
 // ClientKEx performs a key exchange between the client and the client at
 // clientAddr. If successful, there will then exist a shared key between
 // `clientAddr` (remote) and `client` (local). This shared key can be used for
 // end-to-end encryption with `clientAddr` with the {Encrypt,Decrypt}E2E
-// methods.
+// methods. The key received for `clientAddr` is verified as described for
+// ProcessKeyExResp. The key exchange fails if the request cannot be sent (for
+// example, while the session with the server is pending, or its keys have
+// expired) or is not answered within the client's timeout.
 func (cr *Crypto) ClientKEx(client client.Client, clientAddr string, pkt packet.Packet) error {
 	cr.ConfigureKeyExClientPkt(clientAddr, pkt.Writer())
-	respChan := make(chan packet.Packet)
-	client.Send(pkt, respChan)
-	if err := cr.ProcessKeyExResp(clientAddr, <-respChan); err != nil {
-		return fmt.Errorf("client-kex ferror: %s", err.Error())
+	resp, err := client.Request(context.Background(), pkt)
+	if err != nil {
+		return fmt.Errorf("client-kex error: %s", err.Error())
+	} else if err := cr.ProcessKeyExResp(clientAddr, resp); err != nil {
+		return fmt.Errorf("client-kex error: %s", err.Error())
 	}
 	return nil
 }
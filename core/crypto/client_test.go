@@ -0,0 +1,292 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/client"
+	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/core/clock/clocktest"
+	throttle "github.com/navaz-alani/concord/core/throttle"
+	"github.com/navaz-alani/concord/packet"
+	"github.com/navaz-alani/concord/server"
+)
+
+// cleartextMarker is the data of the test's application packets, which must
+// never be seen by the server in cleartext.
+var cleartextMarker = []byte("concord-cleartext-marker")
+
+// newTestUDPServer starts a UDPServer on a loopback port, with Crypto `cr`
+// installed and an "app.echo" target. If `onKEx` is not nil, it is called on
+// every server key exchange, before the key exchange is processed. It returns
+// the server's address and the number of packets read by the server with
+// cleartextMarker in cleartext.
+func newTestUDPServer(t *testing.T, cr *Crypto, onKEx func()) (*net.UDPAddr, *int64) {
+	// reserve a port for the server
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: []byte{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+	svr, err := server.NewUDPServer(addr, 4096, testPC, throttle.Rate10k)
+	if err != nil {
+		t.Fatalf("NewUDPServer: %v", err)
+	}
+	var leaked int64
+	// installed before Crypto, so that it sees packets as they were sent
+	svr.DataProcessor().AddTransform("_in_", func(ctx *core.TransformContext, buff []byte) []byte {
+		if bytes.Contains(buff, cleartextMarker) {
+			atomic.AddInt64(&leaked, 1)
+		}
+		return buff
+	})
+	if onKEx != nil {
+		svr.PacketProcessor().AddCallback(TargetKeyExchangeServer, func(*core.TargetCtx, packet.Writer) {
+			onKEx()
+		})
+	}
+	if err := cr.Extend("server", svr); err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+	svr.PacketProcessor().AddCallback("app.echo", func(ctx *core.TargetCtx, pw packet.Writer) {
+		pw.Write(ctx.Pkt.Data())
+		ctx.Stat = core.CodeStopCloseSend
+	})
+	go svr.Serve()
+	t.Cleanup(func() { svr.Shutdown(context.Background()) })
+	return addr, &leaked
+}
+
+func echoPkt(svrAddr string) packet.Packet {
+	pkt := testPC.NewPkt("", svrAddr)
+	pkt.Meta().Add(packet.KeyTarget, "app.echo")
+	pkt.Writer().Write(cleartextMarker)
+	pkt.Writer().Close()
+	return pkt
+}
+
+func TestServerKExConcurrentTraffic(t *testing.T) {
+	svr, err := NewCrypto(newTestIdentity(t))
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	// hold the key exchange on the server until the client's traffic is done
+	svrAddr, leaked := newTestUDPServer(t, svr, func() {
+		once.Do(func() { close(started) })
+		<-release
+	})
+
+	cl, err := client.NewUDPClient(svrAddr, &net.UDPAddr{IP: []byte{127, 0, 0, 1}}, 4096,
+		testPC, throttle.Rate10k)
+	if err != nil {
+		t.Fatalf("NewUDPClient: %v", err)
+	}
+	defer cl.Cleanup()
+	cl.SetTimeout(5 * time.Second)
+	cr, err := NewCrypto(nil)
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	trust := NewTrustStore()
+	trust.Pin(svrAddr.String(), &svr.privKey.PublicKey)
+	cr.SetTrustStore(trust)
+	if err := cr.Extend("client", cl); err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+
+	kex := make(chan error, 1)
+	go func() { kex <- cr.ServerKEx(cl, svrAddr.String(), testPC.NewPkt("", svrAddr.String())) }()
+	<-started
+	const numSenders, numPkts = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, numSenders*numPkts)
+	for i := 0; i < numSenders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numPkts; j++ {
+				if _, err := cl.Request(context.Background(), echoPkt(svrAddr.String())); err == nil ||
+					!strings.Contains(err.Error(), "data pipeline enforced noop: handshake in progress") {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+	close(errs)
+	for err := range errs {
+		t.Errorf("Request during the handshake = %v, want a noop error", err)
+	}
+	if err := <-kex; err != nil {
+		t.Fatalf("ServerKEx: %v", err)
+	}
+	if resp, err := cl.Request(context.Background(), echoPkt(svrAddr.String())); err != nil {
+		t.Fatalf("Request after the handshake: %v", err)
+	} else if !bytes.Equal(resp.Data(), cleartextMarker) {
+		t.Errorf("echo = %q, want %q", resp.Data(), cleartextMarker)
+	}
+	if n := atomic.LoadInt64(leaked); n != 0 {
+		t.Errorf("server read %d packets in cleartext", n)
+	}
+}
+
+func TestConfigureClientUntrusted(t *testing.T) {
+	svr, err := NewCrypto(newTestIdentity(t))
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	svrAddr, _ := newTestUDPServer(t, svr, nil)
+	cl, err := client.NewUDPClient(svrAddr, &net.UDPAddr{IP: []byte{127, 0, 0, 1}}, 4096,
+		testPC, throttle.Rate10k)
+	if err != nil {
+		t.Fatalf("NewUDPClient: %v", err)
+	}
+	defer cl.Cleanup()
+	cl.SetTimeout(time.Second)
+	// the server's identity key is not trusted
+	_, err = ConfigureClient(cl, svrAddr.String(), NewTrustStore(), testPC.NewPkt("", svrAddr.String()))
+	if err == nil {
+		t.Fatal("ConfigureClient succeeded with an untrusted server key")
+	} else if msg := err.Error(); !strings.HasPrefix(msg, "handshake error: ") ||
+		strings.Count(msg, "handshake error") != 1 {
+		t.Errorf("ConfigureClient error = %q, want a single \"handshake error: \" prefix", msg)
+	}
+	// the abandoned key exchange does not stop the server responding to the
+	// client in cleartext
+	if resp, err := cl.Request(context.Background(), echoPkt(svrAddr.String())); err != nil {
+		t.Fatalf("Request after a failed handshake: %v", err)
+	} else if !bytes.Equal(resp.Data(), cleartextMarker) {
+		t.Errorf("echo = %q, want %q", resp.Data(), cleartextMarker)
+	}
+}
+
+func TestNewOfferEphemeral(t *testing.T) {
+	cr, err := NewCrypto(nil)
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	first, err := cr.newOffer()
+	if err != nil {
+		t.Fatalf("newOffer: %v", err)
+	}
+	second, err := cr.newOffer()
+	if err != nil {
+		t.Fatalf("newOffer: %v", err)
+	}
+	own := cr.IdentityKey()
+	for _, ka := range []KeyAgreement{P256, X25519} {
+		share := first.shares[ka.Name()]
+		if len(share) == 0 {
+			t.Fatalf("no %s key share offered", ka.Name())
+		} else if bytes.Equal(share, own.bytes()) {
+			t.Errorf("%s key share is the identity key", ka.Name())
+		} else if bytes.Equal(share, second.shares[ka.Name()]) {
+			t.Errorf("%s key share reused across offers", ka.Name())
+		}
+	}
+}
+
+func TestConfigureClientWithKey(t *testing.T) {
+	svr, err := NewCrypto(newTestIdentity(t))
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	svrAddr, _ := newTestUDPServer(t, svr, nil)
+	cl, err := client.NewUDPClient(svrAddr, &net.UDPAddr{IP: []byte{127, 0, 0, 1}}, 4096,
+		testPC, throttle.Rate10k)
+	if err != nil {
+		t.Fatalf("NewUDPClient: %v", err)
+	}
+	defer cl.Cleanup()
+	cl.SetTimeout(5 * time.Second)
+	trust := NewTrustStore()
+	trust.Pin(svrAddr.String(), &svr.privKey.PublicKey)
+	identity := newTestIdentity(t)
+	cr, err := ConfigureClientWithKey(cl, svrAddr.String(), trust, identity,
+		testPC.NewPkt("", svrAddr.String()))
+	if err != nil {
+		t.Fatalf("ConfigureClientWithKey: %v", err)
+	}
+	if own := cr.IdentityKey(); !own.equal(&PublicKey{X: identity.X, Y: identity.Y}) {
+		t.Error("client identity key is not the key given")
+	}
+	// the server knows the client by the identity key given
+	own, _ := cr.getSession(svrAddr.String())
+	if ks, ok := svr.getSessionByID(own.id); !ok {
+		t.Fatal("no session on the server")
+	} else if !ks.public.equal(&PublicKey{X: identity.X, Y: identity.Y}) {
+		t.Error("server session has another identity key")
+	}
+}
+
+func TestClientKExUnsendable(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, cr *Crypto, cl client.Client, svrAddr string, clk *clocktest.Manual)
+	}{
+		{"handshake in progress", func(t *testing.T, cr *Crypto, cl client.Client, svrAddr string, clk *clocktest.Manual) {
+			if _, err := cr.newSession(svrAddr, &keyStore{state: sessionPending}); err != nil {
+				t.Fatalf("newSession: %v", err)
+			}
+		}},
+		{"session keys expired", func(t *testing.T, cr *Crypto, cl client.Client, svrAddr string, clk *clocktest.Manual) {
+			cr.SetKeyLifetime(KeyLifetime{Duration: time.Minute})
+			if err := cr.ServerKEx(cl, svrAddr, testPC.NewPkt("", svrAddr)); err != nil {
+				t.Fatalf("ServerKEx: %v", err)
+			}
+			clk.Advance(time.Minute)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svr, err := NewCrypto(newTestIdentity(t))
+			if err != nil {
+				t.Fatalf("NewCrypto: %v", err)
+			}
+			svrAddr, _ := newTestUDPServer(t, svr, nil)
+			cl, err := client.NewUDPClient(svrAddr, &net.UDPAddr{IP: []byte{127, 0, 0, 1}}, 4096,
+				testPC, throttle.Rate10k)
+			if err != nil {
+				t.Fatalf("NewUDPClient: %v", err)
+			}
+			defer cl.Cleanup()
+			cl.SetTimeout(5 * time.Second)
+			cr, err := NewCrypto(nil)
+			if err != nil {
+				t.Fatalf("NewCrypto: %v", err)
+			}
+			clk := clocktest.NewManual(time.Unix(0, 0))
+			cr.SetClock(clk)
+			trust := NewTrustStore()
+			trust.Pin(svrAddr.String(), &svr.privKey.PublicKey)
+			cr.SetTrustStore(trust)
+			if err := cr.Extend("client", cl); err != nil {
+				t.Fatalf("Extend: %v", err)
+			}
+			tt.setup(t, cr, cl, svrAddr.String(), clk)
+
+			kex := make(chan error, 1)
+			go func() {
+				kex <- cr.ClientKEx(cl, "127.0.0.1:7000", testPC.NewPkt("", svrAddr.String()))
+			}()
+			select {
+			case err := <-kex:
+				if err == nil || !strings.Contains(err.Error(), tt.name) {
+					t.Errorf("ClientKEx = %v, want an error mentioning %q", err, tt.name)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("ClientKEx blocked")
+			}
+		})
+	}
+}
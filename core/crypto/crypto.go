@@ -4,28 +4,45 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"math/big"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/core/clock"
 )
 
 // Target names the Crypto extension reserves.
 const (
 	TargetKeyExchangeServer = "crypto.kex-cs"
 	TargetKeyExchangeClient = "crypto.kex-cc"
+	TargetKeyExchangeFin    = "crypto.kex-fin"
+	TargetRekey             = "crypto.rekey"
 )
 
+// ProtocolVersion is the version of the Crypto key exchange protocol. It is
+// advertised in key exchange packets (under KeyVersion) and peers refuse key
+// exchanges with other versions, rather than deriving incompatible keys. Since
+// peers which agree on a version must also agree on how packets are encrypted,
+// it changes whenever the format of key exchange packets or of transport
+// encrypted data (such as its sid || seq header) changes.
+const ProtocolVersion = "6"
+
 // Metadata keys for Crypto extension
 const (
 	// KeyNoCipher is a metadata key, which when set to "true" in a packet causes
 	// the Crypto extension to skip that packet.
 	KeyNoCrypto = "_no_crypto"
+	// KeyVersion is a metadata key, which holds the Crypto protocol version in
+	// key exchange packets.
+	KeyVersion = "_crypto_v"
 )
 
-// Curve is the elliptic curve used by Crypto.
+// Curve is the elliptic curve of identity keys.
 var Curve = elliptic.P256()
 
 // PublicKey is the structure of the public key used by Crypto, and its clients.
@@ -35,28 +52,152 @@ type PublicKey struct {
 	Y *big.Int `json:"y"`
 }
 
+// sessionKeys are a generation of the keys of a session with a peer, for use
+// with the AEAD scheme `aead`. Each generation has separate keys for each
+// direction: `tx` is used to encrypt data sent to the peer and `rx` is used to
+// decrypt data received from the peer.
+//
+// Transport-encrypted data sent to the peer is numbered with `sendSeq` and the
+// sequence numbers of data received from the peer are checked against `window`
+// to detect replays.
+type sessionKeys struct {
+	sendSeq uint64 // accessed atomically, first for 64-bit alignment
+	aead    AEAD
+	tx, rx  []byte
+	window  replayWindow
+	created time.Time
+}
+
+func newSessionKeys(aead AEAD, tx, rx []byte, created time.Time) *sessionKeys {
+	return &sessionKeys{
+		aead:    aead,
+		tx:      tx,
+		rx:      rx,
+		created: created,
+	}
+}
+
+// packets returns the number of packets which have been encrypted with the
+// keys, in the direction which has used them the most.
+func (sk *sessionKeys) packets() uint64 {
+	sent := atomic.LoadUint64(&sk.sendSeq)
+	if recvd := sk.window.highestSeq(); recvd > sent {
+		return recvd
+	}
+	return sent
+}
+
+// Session states. A client-server session is pending from the start of the
+// key exchange until the peer has proven that it has derived the session keys,
+// and is rekeying while new keys are being negotiated.
+const (
+	sessionPending uint8 = iota
+	sessionEstablished
+	sessionRekeying
+)
+
+// keyStore holds the session with a peer. A session's keys are rotated by
+// rekeying, during which three generations may be in use: `cur` is used to
+// encrypt data, `next` is a generation which has been negotiated but not yet
+// used by the peer and `prev` is the generation replaced by the last rotation,
+// which is kept so that data encrypted with it while the rotation was in
+// flight can still be decrypted.
+//
+// Client-server sessions are identified by `id` and their peer's last known
+// address, `addr`, is protected by the Crypto's mutex. End-to-end sessions are
+// identified by their peer's address alone. `suite` is the cipher suite of the
+// session, `public` is the identity key of the peer and `agreement` is the
+// peer's end-to-end agreement key, signed by `public`.
 type keyStore struct {
-	mu      sync.RWMutex // mu protects `ketSent`
-	keySent bool         // indicates whether or not this key has been shared
-	shared  *big.Int
-	public  *PublicKey
+	mu        sync.RWMutex // mu protects `state` and the key generations
+	state     uint8
+	id        string
+	addr      string
+	suite     *Suite
+	public    *PublicKey
+	agreement *SignedKey
+	cur       *sessionKeys
+	prev      *sessionKeys
+	next      *sessionKeys
 }
 
-func (ks *keyStore) getKeySent() bool {
+func (ks *keyStore) getState() uint8 {
 	ks.mu.RLock()
 	defer ks.mu.RUnlock()
-	return ks.keySent
+	return ks.state
 }
 
-func (ks *keyStore) setKeySent(s bool) {
+// transition changes the state of the session from `from` to `to`, reporting
+// whether the session was in state `from`.
+func (ks *keyStore) transition(from, to uint8) bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.state != from {
+		return false
+	}
+	ks.state = to
+	return true
+}
+
+// current returns the generation of keys used to encrypt data for the peer.
+func (ks *keyStore) current() *sessionKeys {
 	ks.mu.RLock()
 	defer ks.mu.RUnlock()
-	ks.keySent = s
+	return ks.cur
+}
+
+// generations returns the generations of keys with which data from the peer may
+// have been encrypted, in the order in which they should be tried.
+func (ks *keyStore) generations() []*sessionKeys {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	var gens []*sessionKeys
+	if ks.cur != nil {
+		gens = append(gens, ks.cur)
+	}
+	if ks.next != nil {
+		gens = append(gens, ks.next)
+	}
+	if ks.prev != nil {
+		gens = append(gens, ks.prev)
+	}
+	return gens
+}
+
+// rotate makes `sk` the current generation of keys, completing a rekey.
+func (ks *keyStore) rotate(sk *sessionKeys) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.prev, ks.cur, ks.next = ks.cur, sk, nil
+	ks.state = sessionEstablished
+}
+
+// setNext sets the generation of keys to be rotated to once the peer uses it.
+func (ks *keyStore) setNext(sk *sessionKeys) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.next = sk
+	ks.state = sessionRekeying
+}
+
+// confirm records that the peer has used the keys `sk`. This establishes a
+// pending session and, if `sk` is (still) the pending generation of keys,
+// completes the rotation to it.
+func (ks *keyStore) confirm(sk *sessionKeys) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.state == sessionPending && sk == ks.cur {
+		ks.state = sessionEstablished
+	} else if ks.next == sk {
+		ks.prev, ks.cur, ks.next = ks.cur, sk, nil
+		ks.state = sessionEstablished
+	}
 }
 
 // Crypto is a cyrptographic extension for a Server/Client. It provides, mainly,
-// the ability to share keys and establish shared secrets. It uses the ECDSA
-// algorithm with (currenly) NIST P-256 for the curve.
+// the ability to share keys and establish shared secrets. Identity keys are
+// ECDSA keys on NIST P-256, while the key agreement and encryption of sessions
+// depend on the cipher Suite negotiated for them.
 //
 // Before installation onto a Processor, a key exchange to
 // the server will need to be performed. Due to the transforms that it installs
@@ -67,11 +208,46 @@ func (ks *keyStore) setKeySent(s bool) {
 // key exchange and then use Cryto.ProcessKeyExServer method to process the
 // response, which when successful, will add the key to the internal key store,
 // after which the pipelines will be unblocked.
+//
+// The private key of a Crypto is its long-term identity key. On a server, it is
+// used to sign the ephemeral keys generated for every key exchange, which
+// clients verify against the server identity keys in their TrustStore. This
+// prevents an attacker from intercepting a key exchange with the server.
+//
+// End-to-end encryption uses a separate agreement key, which is generated for
+// every Crypto and signed with its identity key. Clients register their signed
+// agreement keys with the server during key exchanges and the server
+// distributes them in client-client key exchanges, in which clients verify the
+// signature and the identity of the peer (see TrustStore.PinPeer and
+// Crypto.SafetyNumber). The server therefore cannot substitute keys without
+// being detected.
+//
+// Session keys can be given a KeyLifetime, after which they expire and must be
+// replaced using an in-band rekey (see Crypto.Rekey). Sessions whose key
+// exchange is not completed within the handshake timeout are removed (see
+// Crypto.SetHandshakeTimeout).
+//
+// Client-server sessions are identified by a session ID, issued by the server
+// during the key exchange, rather than by the client's address. This way, a
+// session survives changes to the client's address (for example, when it is
+// behind a NAT) and cannot be claimed by spoofing the client's address.
 type Crypto struct {
-	mu        sync.RWMutex // mu protects the `keys` field
-	keys      map[string]*keyStore
+	mu        sync.RWMutex         // mu protects the session maps, `lifetime`, `handshake`, `clock` & `lastSweep`
+	sessions  map[string]*keyStore // client-server sessions, by ID
+	addrs     map[string]string    // session IDs, by peer address
+	peers     map[string]*keyStore // end-to-end sessions, by peer address
 	privKey   *ecdsa.PrivateKey
 	publicKey []byte
+	trust     *TrustStore
+	counters  *counters
+	lifetime  KeyLifetime
+	handshake time.Duration // timeout of pending sessions
+	clock     clock.Clock
+	lastSweep time.Time
+	suites    []*Suite
+	offer     *kexOffer  // the client's last server key exchange offer
+	agreement []byte     // the private end-to-end agreement key
+	signed    *SignedKey // the signed public end-to-end agreement key
 }
 
 func NewCrypto(privKey *ecdsa.PrivateKey) (*Crypto, error) {
@@ -89,18 +265,54 @@ func NewCrypto(privKey *ecdsa.PrivateKey) (*Crypto, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to encode public key: " + err.Error())
 	}
+	agreement, agreementPub, err := P256.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("agreement key gen fail: " + err.Error())
+	}
+	signed, err := signAgreement(privKey, agreementPub)
+	if err != nil {
+		return nil, fmt.Errorf("agreement key sign fail: " + err.Error())
+	}
 	cr := &Crypto{
 		mu:        sync.RWMutex{},
-		keys:      make(map[string]*keyStore),
+		sessions:  make(map[string]*keyStore),
+		addrs:     make(map[string]string),
+		peers:     make(map[string]*keyStore),
 		privKey:   privKey,
 		publicKey: publicKey,
+		counters:  &counters{},
+		handshake: DefaultHandshakeTimeout,
+		clock:     clock.Real,
+		lastSweep: clock.Real.Now(),
+		suites:    DefaultSuites,
+		agreement: agreement,
+		signed:    signed,
 	}
 	return cr, nil
 }
 
-func (cr *Crypto) computeSharedKey(pk *PublicKey) *big.Int {
-	x, _ := Curve.ScalarMult(pk.X, pk.Y, cr.privKey.D.Bytes())
-	return x
+// IdentityKey returns the public part of the Crypto's identity key. Servers
+// should distribute this key to their clients, to be pinned in their
+// TrustStores.
+func (cr *Crypto) IdentityKey() PublicKey {
+	return PublicKey{
+		X: cr.privKey.PublicKey.X,
+		Y: cr.privKey.PublicKey.Y,
+	}
+}
+
+// SetTrustStore sets the TrustStore against which the keys received in server
+// key exchanges are verified.
+func (cr *Crypto) SetTrustStore(ts *TrustStore) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.trust = ts
+}
+
+func (cr *Crypto) getTrustStore() *TrustStore {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.trust
 }
 
 // Extend installs Crypto onto the given Processor's pipeline.
@@ -124,64 +336,98 @@ func (cr *Crypto) Extend(kind string, target core.Processor) error {
 	return nil
 }
 
-// setKeyStore sets the keyStore for the given address in the shared
-// interal `keys` map, by first acquiring the mutex for write.
-func (cr *Crypto) setKeyStore(addr string, ks *keyStore) {
-	cr.mu.Lock()
-	defer cr.mu.Unlock()
-	cr.keys[addr] = ks
-}
-
-// getKeyStore obtains the keyStore for the given address from the shared
-// interal `keys` map, by first acquiring the mutex for read.
-func (cr *Crypto) getKeyStore(addr string) (*keyStore, bool) {
-	cr.mu.RLock()
-	defer cr.mu.RUnlock()
-	ks, ok := cr.keys[addr]
-	return ks, ok
-}
-
 // encryptTransport is the data pipeline BufferTransform which encrypts packet
 // data based on the destination of the packet. If a key exchange with the
 // destination has not been performed, then the transform will be the identity
 // transform (will do nothing to the contents of the buffer).
+//
+// Encrypted data is prefixed with a cleartext header holding the session ID
+// and a sequence number, which is unique to every packet sent in the session.
+// The header is bound to the ciphertext. Packets for sessions whose handshake
+// is in progress are dropped (with a CodeStopNoop status), since they could
+// not be decrypted by the destination.
 func (cr *Crypto) encryptTransport(ctx *core.TransformContext, buff []byte) []byte {
 	switch ctx.Pkt.Meta().Get(KeyNoCrypto) {
 	case "true", "t", "yes", "y", "1":
 		return buff
 	}
-	if k, ok := cr.getKeyStore(ctx.Pkt.Dest()); !ok {
-		return buff
-	} else if !k.getKeySent() { // ctx.Dest does not have public key for server yet...
-		// Here, it is being assumed that the first outgoing packet to `ctx.Dest` is
-		// the public key of the server. This implies that the connection should be
-		// used atomically when the key-exchange is being performed i.e. no other
-		// packets should be going between the server and `ctx.Dest` from the time
-		// that the key exchange request is sent to when the server has sent a
-		// response.
-		k.setKeySent(true)
+	if k, ok := cr.getSession(ctx.Pkt.Dest()); !ok {
 		return buff
-	} else if ciphertext, err := encryptAES(k.shared.Bytes(), buff); err != nil {
-		ctx.Stat = core.CodeStopError
-		ctx.Msg = "encryption error: " + err.Error()
+	} else if k.getState() == sessionPending {
+		// the destination cannot yet decrypt packets in the session (the key
+		// exchange packets themselves are sent without encryption)
+		ctx.Stat = core.CodeStopNoop
+		ctx.Msg = "handshake in progress"
 		return buff
 	} else {
-		return ciphertext
+		sk := k.current()
+		if cr.getKeyLifetime().expired(sk, cr.now()) {
+			ctx.Stat = core.CodeStopNoop
+			ctx.Msg = "session keys expired"
+			return buff
+		}
+		hdr := append([]byte(k.id), seqHeader(atomic.AddUint64(&sk.sendSeq, 1))...)
+		if ciphertext, err := encrypt(sk.aead, sk.tx, buff, hdr); err != nil {
+			ctx.Stat = core.CodeStopError
+			ctx.Msg = "encryption error: " + err.Error()
+			return buff
+		} else {
+			return append(hdr, ciphertext...)
+		}
 	}
 }
 
 // decryptTransport is the data pipeline BufferTransform which decrypts packet
-// data based on the sender of the packet. If a key exchange with the
-// sender has not been performed, then the transform will be the identity
-// transform (will do nothing to the contents of the buffer).
+// data based on the session ID in its header. If there is no such session, then
+// the transform will be the identity transform (will do nothing to the
+// contents of the buffer).
+//
+// Authentic packets whose sequence numbers have already been received, or are
+// too old to be checked, are dropped (with a CodeStopNoop status) and counted
+// in the Crypto's Stats. So are packets encrypted with expired keys. The first
+// authentic packet in a pending session establishes it and the first packet
+// encrypted with the keys negotiated by a rekey completes the rotation to
+// those keys. Authentic packets from a new address migrate the session to
+// that address.
 func (cr *Crypto) decryptTransport(ctx *core.TransformContext, buff []byte) []byte {
-	if k, ok := cr.getKeyStore(ctx.From); !ok {
+	if len(buff) < sidSize+seqSize {
+		return buff
+	}
+	k, ok := cr.getSessionByID(string(buff[:sidSize]))
+	if !ok {
 		return buff
-	} else if decrypted, err := decryptAES(k.shared.Bytes(), buff); err != nil {
+	}
+	hdr, ciphertext := buff[:sidSize+seqSize], buff[sidSize+seqSize:]
+	var sk *sessionKeys
+	var decrypted []byte
+	for _, gen := range k.generations() {
+		if d, err := decrypt(gen.aead, gen.rx, ciphertext, hdr); err == nil {
+			sk, decrypted = gen, d
+			break
+		}
+	}
+	if sk == nil {
 		// the payload could not be encrypted - do not know yet... so this
 		// decryption error may not really be a processing error.
 		return buff
-	} else {
-		return decrypted
+	} else if cr.getKeyLifetime().expired(sk, cr.now()) {
+		ctx.Stat = core.CodeStopNoop
+		ctx.Msg = "session keys expired"
+		return buff
+	}
+	switch sk.window.accept(binary.BigEndian.Uint64(hdr[sidSize:])) {
+	case seqReplayed:
+		atomic.AddUint64(&cr.counters.replayed, 1)
+		ctx.Stat = core.CodeStopNoop
+		ctx.Msg = "replayed packet dropped"
+		return buff
+	case seqStale:
+		atomic.AddUint64(&cr.counters.stale, 1)
+		ctx.Stat = core.CodeStopNoop
+		ctx.Msg = "stale packet dropped"
+		return buff
 	}
+	k.confirm(sk)
+	cr.migrate(k, ctx.From)
+	return decrypted
 }
@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// fingerprintContext is the domain separation prefix of identity key
+// fingerprints.
+const fingerprintContext = "concord/crypto.fingerprint"
+
+// fingerprintDigest computes the SHA-256 digest from which the fingerprint of
+// the identity key `pk` is taken.
+func fingerprintDigest(pk PublicKey) [sha256.Size]byte {
+	return sha256.Sum256(append([]byte(fingerprintContext), pk.bytes()...))
+}
+
+// groups splits `s` into groups of `size` characters, separated by spaces.
+func groups(s string, size int) string {
+	var grouped []string
+	for ; len(s) > size; s = s[size:] {
+		grouped = append(grouped, s[:size])
+	}
+	return strings.Join(append(grouped, s), " ")
+}
+
+// Fingerprint returns the fingerprint of the identity key `pk`, as hex digits
+// in groups of four. Fingerprints can be published, or compared out of band,
+// to verify identity keys before pinning them. It returns the empty string if
+// `pk` is not a valid identity key (such as the zero PublicKey).
+func Fingerprint(pk PublicKey) string {
+	if !pk.valid() {
+		return ""
+	}
+	digest := fingerprintDigest(pk)
+	return groups(hex.EncodeToString(digest[:]), 4)
+}
+
+// fingerprintNumber returns the 30 decimal digit half of a safety number which
+// belongs to the identity key `pk`.
+func fingerprintNumber(pk PublicKey) string {
+	digest := fingerprintDigest(pk)
+	var digits strings.Builder
+	for i := 0; i < 30; i += 5 {
+		var chunk [8]byte
+		copy(chunk[3:], digest[i:i+5])
+		fmt.Fprintf(&digits, "%05d", binary.BigEndian.Uint64(chunk[:])%100000)
+	}
+	return digits.String()
+}
+
+// SafetyNumber returns the safety number of the identity keys `a` and `b`: 60
+// decimal digits, in groups of five. It does not depend on the order of the
+// keys, so two clients can compare the safety number of their identity keys
+// out of band (for example, by reading it out to each other) to verify that
+// neither identity key has been substituted by the server relaying their
+// client-client key exchange. It returns the empty string if either key is
+// not a valid identity key.
+func SafetyNumber(a, b PublicKey) string {
+	if !a.valid() || !b.valid() {
+		return ""
+	}
+	na, nb := fingerprintNumber(a), fingerprintNumber(b)
+	if nb < na {
+		na, nb = nb, na
+	}
+	return groups(na+nb, 5)
+}
+
+// PeerIdentityKey returns the identity key of the client at `addr`, as
+// presented in the last client-client key exchange with `addr`.
+func (cr *Crypto) PeerIdentityKey(addr string) (PublicKey, bool) {
+	if ks, ok := cr.getPeer(addr); !ok {
+		return PublicKey{}, false
+	} else {
+		return *ks.public, true
+	}
+}
+
+// SafetyNumber returns the safety number of the Crypto's identity key and the
+// identity key of the client at `addr`, for end-to-end encryption with which a
+// client-client key exchange must have been performed. If the safety numbers
+// computed by both clients match, the peer's identity key can be pinned (see
+// TrustStore.PinPeer).
+func (cr *Crypto) SafetyNumber(addr string) (string, error) {
+	peer, ok := cr.PeerIdentityKey(addr)
+	if !ok {
+		return "", fmt.Errorf("keys not exchanged")
+	}
+	return SafetyNumber(cr.IdentityKey(), peer), nil
+}
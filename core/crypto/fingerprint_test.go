@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"math/big"
+	"regexp"
+	"testing"
+)
+
+func TestFingerprintInvalidKey(t *testing.T) {
+	cr, err := NewCrypto(nil)
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	valid := cr.IdentityKey()
+	for _, pk := range []PublicKey{
+		{},
+		{X: valid.X},
+		{X: big.NewInt(1), Y: big.NewInt(1)}, // not on the curve
+	} {
+		if fp := Fingerprint(pk); fp != "" {
+			t.Errorf("Fingerprint(%v) = %q, want the empty string", pk, fp)
+		}
+		if sn := SafetyNumber(valid, pk); sn != "" {
+			t.Errorf("SafetyNumber with %v = %q, want the empty string", pk, sn)
+		}
+		if sn := SafetyNumber(pk, valid); sn != "" {
+			t.Errorf("SafetyNumber with %v = %q, want the empty string", pk, sn)
+		}
+	}
+	if fp := Fingerprint(valid); fp == "" {
+		t.Error("no fingerprint for a valid identity key")
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	alice, bob := newE2EPeers(t)
+	a, b := alice.IdentityKey(), bob.IdentityKey()
+	sn := SafetyNumber(a, b)
+	if !regexp.MustCompile(`^\d{5}( \d{5}){11}$`).MatchString(sn) {
+		t.Errorf("SafetyNumber = %q, want 60 digits in groups of five", sn)
+	}
+	if other := SafetyNumber(b, a); other != sn {
+		t.Errorf("SafetyNumber(b, a) = %q, want SafetyNumber(a, b) = %q", other, sn)
+	}
+	// both clients compute the same safety number for their exchange
+	if got, err := alice.SafetyNumber(testBobAddr); err != nil || got != sn {
+		t.Errorf("alice's safety number = %q, %v; want %q", got, err, sn)
+	}
+	if got, err := bob.SafetyNumber(testAliceAddr); err != nil || got != sn {
+		t.Errorf("bob's safety number = %q, %v; want %q", got, err, sn)
+	}
+	if _, err := alice.SafetyNumber("127.0.0.1:7003"); err == nil {
+		t.Error("safety number computed for a peer without a key exchange")
+	}
+}
+
+func TestProcessKeyExRespIdentityChanged(t *testing.T) {
+	alice, bob := newE2EPeers(t)
+	mallory, err := NewCrypto(nil)
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	// bob's identity key was trusted on first use, so another key is rejected
+	err = alice.ProcessKeyExResp(testBobAddr, peerKeyResp(mallory))
+	if err == nil || err.Error() != "peer identity key changed" {
+		t.Fatalf("ProcessKeyExResp with a changed key = %v, want peer identity key changed", err)
+	}
+	bobKey := bob.IdentityKey()
+	if pk, ok := alice.PeerIdentityKey(testBobAddr); !ok || !pk.equal(&bobKey) {
+		t.Error("rejected key exchange replaced bob's identity key")
+	}
+	// a later key exchange with the same identity key is accepted
+	if err := alice.ProcessKeyExResp(testBobAddr, peerKeyResp(bob)); err != nil {
+		t.Errorf("ProcessKeyExResp with the same key: %v", err)
+	}
+	// once bob is forgotten, a new identity key is trusted on first use
+	alice.Forget(testBobAddr)
+	if err := alice.ProcessKeyExResp(testBobAddr, peerKeyResp(mallory)); err != nil {
+		t.Errorf("ProcessKeyExResp after Forget: %v", err)
+	}
+}
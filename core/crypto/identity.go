@@ -0,0 +1,220 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// Domain separation prefixes of the digests signed with identity keys: the
+// server's key shares in key exchanges and clients' end-to-end agreement keys.
+const (
+	kexContext       = "concord/crypto.kex-cs"
+	agreementContext = "concord/crypto.kex-cc"
+)
+
+// SignedKey is a key share, signed by the long-term identity key of its
+// owner. The server responds to key exchanges with a SignedKey so that clients
+// can verify that the key exchange was not tampered with.
+type SignedKey struct {
+	Suite string `json:"suite"` // the name of the cipher suite selected
+	Key   []byte `json:"key"`   // the key share, encoded by the suite's KeyAgreement
+	Sig   []byte `json:"sig"`
+}
+
+// PeerKey is the key material of a client, which the server distributes in
+// client-client key exchanges: the client's identity key and its end-to-end
+// agreement key, signed by that identity key.
+type PeerKey struct {
+	PublicKey
+	SignedKey
+}
+
+// bytes returns the uncompressed encoding of the public key point.
+func (pk *PublicKey) bytes() []byte {
+	size := (Curve.Params().BitSize + 7) / 8
+	buf := make([]byte, 1+2*size)
+	buf[0] = 4 // uncompressed point
+	pk.X.FillBytes(buf[1 : 1+size])
+	pk.Y.FillBytes(buf[1+size:])
+	return buf
+}
+
+// valid reports whether the public key is a point on Curve. Keys received from
+// peers must be validated before they are used in ECDH.
+func (pk *PublicKey) valid() bool {
+	return pk.X != nil && pk.Y != nil && Curve.IsOnCurve(pk.X, pk.Y)
+}
+
+// equal reports whether `pk` and `other` are the same point.
+func (pk *PublicKey) equal(other *PublicKey) bool {
+	return pk.X.Cmp(other.X) == 0 && pk.Y.Cmp(other.Y) == 0
+}
+
+// writeField writes `field` to the hash `h`, prefixed with its length so that
+// consecutive fields cannot be confused.
+func writeField(h hash.Hash, field []byte) {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+	h.Write(length[:])
+	h.Write(field)
+}
+
+// kexDigest computes the digest signed by the server during a key exchange. It
+// binds the server's key share to the suite selected, to the suites offered by
+// the client (so that the offer cannot be downgraded) and to the client's key
+// share (so that a signed key cannot be replayed to another client).
+func kexDigest(suite string, offered []string, clientShare, serverShare []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(kexContext))
+	writeField(h, []byte(suite))
+	writeField(h, []byte(strings.Join(offered, ",")))
+	writeField(h, clientShare)
+	writeField(h, serverShare)
+	return h.Sum(nil)
+}
+
+// signKey signs the key share `serverShare`, exchanged with `clientShare`
+// using `suite`, with the identity key `identity`.
+func signKey(identity *ecdsa.PrivateKey, suite string, offered []string,
+	clientShare, serverShare []byte) (*SignedKey, error) {
+	digest := kexDigest(suite, offered, clientShare, serverShare)
+	sig, err := ecdsa.SignASN1(rand.Reader, identity, digest)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedKey{Suite: suite, Key: serverShare, Sig: sig}, nil
+}
+
+// agreementDigest computes the digest signed by a client to bind its
+// end-to-end agreement key `key`, for use with `suite`, to its identity.
+func agreementDigest(suite string, key []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(agreementContext))
+	writeField(h, []byte(suite))
+	writeField(h, key)
+	return h.Sum(nil)
+}
+
+// signAgreement signs the end-to-end agreement key `key` with the identity key
+// `identity`. End-to-end encryption always uses SuiteP256AES256GCM.
+func signAgreement(identity *ecdsa.PrivateKey, key []byte) (*SignedKey, error) {
+	suite := SuiteP256AES256GCM.Name
+	sig, err := ecdsa.SignASN1(rand.Reader, identity, agreementDigest(suite, key))
+	if err != nil {
+		return nil, err
+	}
+	return &SignedKey{Suite: suite, Key: key, Sig: sig}, nil
+}
+
+// verifyAgreement verifies that the end-to-end agreement key `sk` has been
+// signed by the identity key `identity`.
+func verifyAgreement(identity *PublicKey, sk *SignedKey) error {
+	key, err := ParseIdentityKey(*identity)
+	if err != nil {
+		return fmt.Errorf("invalid public key")
+	} else if sk.Suite != SuiteP256AES256GCM.Name {
+		return fmt.Errorf("unsupported end-to-end cipher suite \"%s\"", sk.Suite)
+	} else if len(sk.Sig) == 0 {
+		return fmt.Errorf("peer key not signed")
+	} else if !ecdsa.VerifyASN1(key, agreementDigest(sk.Suite, sk.Key), sk.Sig) {
+		return fmt.Errorf("peer key signature invalid")
+	}
+	return nil
+}
+
+// TrustStore holds the identity keys of trusted servers and peers. A server key
+// can either be pinned for a particular server address or trusted for all
+// servers. A peer key is pinned for the address of a client with which
+// end-to-end encryption is performed.
+type TrustStore struct {
+	mu    sync.RWMutex // mu protects `keys` & `peers`
+	keys  map[string][]*ecdsa.PublicKey
+	peers map[string][]*ecdsa.PublicKey
+}
+
+func NewTrustStore() *TrustStore {
+	return &TrustStore{
+		mu:    sync.RWMutex{},
+		keys:  make(map[string][]*ecdsa.PublicKey),
+		peers: make(map[string][]*ecdsa.PublicKey),
+	}
+}
+
+// Pin trusts `key` as the identity key of the server at `addr`. If `addr` is
+// empty, `key` is trusted for every server.
+func (ts *TrustStore) Pin(addr string, key *ecdsa.PublicKey) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.keys[addr] = append(ts.keys[addr], key)
+}
+
+// PinPeer trusts `key` as the identity key of the client at `addr`, in
+// client-client key exchanges. Peer keys should only be pinned once they have
+// been verified out of band, for example by comparing safety numbers (see
+// Crypto.SafetyNumber).
+func (ts *TrustStore) PinPeer(addr string, key *ecdsa.PublicKey) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.peers[addr] = append(ts.peers[addr], key)
+}
+
+// verifyPeer reports whether any identity keys are pinned for the client at
+// `addr` and, if so, whether `pk` is one of them.
+func (ts *TrustStore) verifyPeer(addr string, pk *PublicKey) (pinned, trusted bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	for _, key := range ts.peers[addr] {
+		if pk.equal(&PublicKey{X: key.X, Y: key.Y}) {
+			return true, true
+		}
+	}
+	return len(ts.peers[addr]) > 0, false
+}
+
+// verify reports whether `sig` is a signature of `digest` by one of the keys
+// trusted for the server at `addr`.
+func (ts *TrustStore) verify(addr string, digest, sig []byte) bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	for _, trusted := range [][]*ecdsa.PublicKey{ts.keys[addr], ts.keys[""]} {
+		for _, key := range trusted {
+			if ecdsa.VerifyASN1(key, digest, sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifySignedKey verifies the key `sk`, received from the server at `addr`
+// in response to a key exchange in which the client offered the suites
+// `offered` and sent the key share `clientShare`.
+func (ts *TrustStore) verifySignedKey(addr string, offered []string, clientShare []byte,
+	sk *SignedKey) error {
+	if len(sk.Sig) == 0 {
+		return fmt.Errorf("server key not signed")
+	} else if !ts.verify(addr, kexDigest(sk.Suite, offered, clientShare, sk.Key), sk.Sig) {
+		return fmt.Errorf("server key signature not trusted")
+	}
+	return nil
+}
+
+// ParseIdentityKey returns the identity public key with the given point
+// coordinates, as encoded in a PublicKey.
+func ParseIdentityKey(pk PublicKey) (*ecdsa.PublicKey, error) {
+	if !pk.valid() {
+		return nil, fmt.Errorf("point not on curve")
+	}
+	return &ecdsa.PublicKey{
+		Curve: Curve,
+		X:     new(big.Int).Set(pk.X),
+		Y:     new(big.Int).Set(pk.Y),
+	}, nil
+}
@@ -0,0 +1,130 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"testing"
+)
+
+func newTestIdentity(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(Curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return key
+}
+
+func TestVerifySignedKey(t *testing.T) {
+	const svrAddr = "127.0.0.1:5000"
+	identity, untrusted := newTestIdentity(t), newTestIdentity(t)
+	offered := []string{SuiteX25519ChaCha20Poly1305.Name, SuiteP256AES256GCM.Name}
+	clientShare, otherShare := []byte("client share"), []byte("other client share")
+	serverShare := []byte("server share")
+	sign := func(key *ecdsa.PrivateKey, suite string, offered []string, clientShare []byte) *SignedKey {
+		sk, err := signKey(key, suite, offered, clientShare, serverShare)
+		if err != nil {
+			t.Fatalf("signKey: %v", err)
+		}
+		return sk
+	}
+	valid := sign(identity, offered[0], offered, clientShare)
+
+	tests := []struct {
+		name        string
+		trust       func(ts *TrustStore)
+		offered     []string
+		clientShare []byte
+		sk          *SignedKey
+		ok          bool
+	}{
+		{
+			name:  "pinned",
+			trust: func(ts *TrustStore) { ts.Pin(svrAddr, &identity.PublicKey) },
+			sk:    valid, ok: true,
+		},
+		{
+			name:  "trusted for all servers",
+			trust: func(ts *TrustStore) { ts.Pin("", &identity.PublicKey) },
+			sk:    valid, ok: true,
+		},
+		{
+			name:  "pinned for another server",
+			trust: func(ts *TrustStore) { ts.Pin("127.0.0.1:5001", &identity.PublicKey) },
+			sk:    valid,
+		},
+		{
+			name:  "unsigned",
+			trust: func(ts *TrustStore) { ts.Pin(svrAddr, &identity.PublicKey) },
+			sk:    &SignedKey{Suite: valid.Suite, Key: valid.Key},
+		},
+		{
+			name:  "untrusted identity",
+			trust: func(ts *TrustStore) { ts.Pin(svrAddr, &identity.PublicKey) },
+			sk:    sign(untrusted, offered[0], offered, clientShare),
+		},
+		{
+			// the offer, as sent by the client, was stripped of its first suite
+			name:  "downgraded offer",
+			trust: func(ts *TrustStore) { ts.Pin(svrAddr, &identity.PublicKey) },
+			sk:    sign(identity, offered[1], offered[1:], clientShare),
+		},
+		{
+			name:  "downgraded suite",
+			trust: func(ts *TrustStore) { ts.Pin(svrAddr, &identity.PublicKey) },
+			sk:    &SignedKey{Suite: offered[1], Key: valid.Key, Sig: valid.Sig},
+		},
+		{
+			name:  "tampered key",
+			trust: func(ts *TrustStore) { ts.Pin(svrAddr, &identity.PublicKey) },
+			sk:    &SignedKey{Suite: valid.Suite, Key: []byte("tampered share"), Sig: valid.Sig},
+		},
+		{
+			// a signed key, sent to another client, replayed to this one
+			name:  "replayed to another client share",
+			trust: func(ts *TrustStore) { ts.Pin(svrAddr, &identity.PublicKey) },
+			sk:    sign(identity, offered[0], offered, otherShare),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := NewTrustStore()
+			tt.trust(ts)
+			err := ts.verifySignedKey(svrAddr, offered, clientShare, tt.sk)
+			if tt.ok && err != nil {
+				t.Errorf("verifySignedKey = %v, want nil", err)
+			} else if !tt.ok && err == nil {
+				t.Error("verifySignedKey succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestVerifyAgreement(t *testing.T) {
+	identity, untrusted := newTestIdentity(t), newTestIdentity(t)
+	pub := PublicKey{X: identity.X, Y: identity.Y}
+	key := []byte("agreement key")
+	valid, err := signAgreement(identity, key)
+	if err != nil {
+		t.Fatalf("signAgreement: %v", err)
+	}
+	forged, err := signAgreement(untrusted, key)
+	if err != nil {
+		t.Fatalf("signAgreement: %v", err)
+	}
+	tests := []struct {
+		name string
+		sk   *SignedKey
+		ok   bool
+	}{
+		{"valid", valid, true},
+		{"unsigned", &SignedKey{Suite: valid.Suite, Key: key}, false},
+		{"untrusted identity", forged, false},
+		{"tampered key", &SignedKey{Suite: valid.Suite, Key: []byte("tampered"), Sig: valid.Sig}, false},
+		{"unsupported suite", &SignedKey{Suite: SuiteX25519ChaCha20Poly1305.Name, Key: key, Sig: valid.Sig}, false},
+	}
+	for _, tt := range tests {
+		if err := verifyAgreement(&pub, tt.sk); (err == nil) != tt.ok {
+			t.Errorf("%s: verifyAgreement = %v, want ok = %t", tt.name, err, tt.ok)
+		}
+	}
+}
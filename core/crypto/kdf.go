@@ -0,0 +1,71 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeySize is the size, in bytes, of the symmetric keys derived by Crypto, which
+// is the key size of every AEAD scheme.
+const KeySize = 32
+
+// HKDF info labels for the keys of each direction of a session. The initiator
+// of a key exchange (the client, in client-server key exchanges) sends with
+// the "c2s" key and receives with the "s2c" key.
+const (
+	labelC2S = "concord/crypto c2s"
+	labelS2C = "concord/crypto s2c"
+)
+
+// hkdfExpand derives a key of KeySize bytes for the purpose `info` from the
+// pseudorandom key `prk`, using HKDF-Expand with SHA-256.
+func hkdfExpand(prk []byte, info string) []byte {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(info)), key); err != nil {
+		// only possible if more than 255 * sha256.Size bytes are read
+		panic("crypto: hkdf expand: " + err.Error())
+	}
+	return key
+}
+
+// transcript computes the handshake transcript hash for a key exchange using
+// `suite`, between the initiator's key share `initiator` and the responder's
+// key share `responder`. It binds the derived keys to the protocol version,
+// the suite and the keys exchanged.
+func transcript(suite string, initiator, responder []byte) []byte {
+	h := sha256.New()
+	writeField(h, []byte(ProtocolVersion))
+	writeField(h, []byte(suite))
+	writeField(h, initiator)
+	writeField(h, responder)
+	return h.Sum(nil)
+}
+
+// deriveKeys derives the per-direction session keys from the shared secret
+// `secret`, using HKDF with the handshake transcript `th` as the salt. The
+// keys returned are the sending and receiving keys of the initiator of the
+// key exchange if `initiator` is true and of the responder otherwise.
+func deriveKeys(secret, th []byte, initiator bool) (tx, rx []byte) {
+	prk := hkdf.Extract(sha256.New, secret, th)
+	c2s, s2c := hkdfExpand(prk, labelC2S), hkdfExpand(prk, labelS2C)
+	if initiator {
+		return c2s, s2c
+	}
+	return s2c, c2s
+}
+
+// deriveE2EKeys derives the per-direction keys for end-to-end encryption
+// between the agreement keys `own` and `peer`, whose shared secret is `secret`.
+// End-to-end encryption always uses SuiteP256AES256GCM. Since client-client key
+// exchanges are symmetric, the peer with the lesser key acts as the initiator.
+func deriveE2EKeys(secret, own, peer []byte) (tx, rx []byte) {
+	suite := SuiteP256AES256GCM.Name
+	if bytes.Compare(own, peer) < 0 {
+		return deriveKeys(secret, transcript(suite, own, peer), true)
+	} else {
+		return deriveKeys(secret, transcript(suite, peer, own), false)
+	}
+}
@@ -0,0 +1,36 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+func TestHKDFExpand(t *testing.T) {
+	// RFC 5869, test case 1 (the first KeySize bytes of the output)
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	okm, _ := hex.DecodeString("3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf")
+	if key := hkdfExpand(hkdf.Extract(sha256.New, ikm, salt), string(info)); !bytes.Equal(key, okm) {
+		t.Errorf("hkdfExpand = %x, want %x", key, okm)
+	}
+}
+
+func TestDeriveKeys(t *testing.T) {
+	secret, th := []byte("shared secret"), transcript("suite", []byte("a"), []byte("b"))
+	itx, irx := deriveKeys(secret, th, true)
+	rtx, rrx := deriveKeys(secret, th, false)
+	if len(itx) != KeySize || len(irx) != KeySize {
+		t.Fatalf("derived %d and %d byte keys, want %d", len(itx), len(irx), KeySize)
+	}
+	if !bytes.Equal(itx, rrx) || !bytes.Equal(irx, rtx) {
+		t.Error("initiator and responder keys do not pair up")
+	}
+	if bytes.Equal(itx, irx) {
+		t.Error("both directions use the same key")
+	}
+}
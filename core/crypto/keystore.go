@@ -0,0 +1,276 @@
+package crypto
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyGeneration is a snapshot of a generation of the keys of a session.
+type KeyGeneration struct {
+	Tx      []byte    `json:"tx"`
+	Rx      []byte    `json:"rx"`
+	SendSeq uint64    `json:"send_seq"` // the last sequence number sent
+	RecvSeq uint64    `json:"recv_seq"` // the highest sequence number received
+	Created time.Time `json:"created"`
+}
+
+// SessionState is a snapshot of an established session, for persistence in a
+// KeyStore. Client-server sessions have an ID, while end-to-end sessions do
+// not. Since it holds the session's keys, it must be stored securely.
+type SessionState struct {
+	ID        []byte         `json:"id,omitempty"`
+	Addr      string         `json:"addr"`
+	Suite     string         `json:"suite"`
+	Identity  *PublicKey     `json:"identity,omitempty"`
+	Agreement *SignedKey     `json:"agreement,omitempty"`
+	Current   KeyGeneration  `json:"current"`
+	Next      *KeyGeneration `json:"next,omitempty"` // negotiated by a rekey
+}
+
+// KeyStore persists the sessions of a Crypto (see Crypto.SaveSessions and
+// Crypto.LoadSessions), so that they survive restarts.
+type KeyStore interface {
+	// Save replaces the stored sessions with `states`.
+	Save(states []SessionState) error
+	// Load returns the stored sessions.
+	Load() ([]SessionState, error)
+	// Delete removes the stored sessions. Since the sequence numbers of a
+	// restored session are reused, sessions should be deleted once they have
+	// been loaded, so that they are not restored twice.
+	Delete() error
+}
+
+// MemoryKeyStore is a KeyStore which holds sessions in memory.
+type MemoryKeyStore struct {
+	mu     sync.RWMutex // mu protects `states`
+	states []SessionState
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{mu: sync.RWMutex{}}
+}
+
+func (m *MemoryKeyStore) Save(states []SessionState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states = append([]SessionState(nil), states...)
+	return nil
+}
+
+func (m *MemoryKeyStore) Load() ([]SessionState, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]SessionState(nil), m.states...), nil
+}
+
+func (m *MemoryKeyStore) Delete() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states = nil
+	return nil
+}
+
+// FileKeyStore is a KeyStore which holds sessions in a JSON file, which is
+// only readable by its owner. The file is replaced atomically on every Save.
+type FileKeyStore struct {
+	path string
+}
+
+func NewFileKeyStore(path string) *FileKeyStore {
+	return &FileKeyStore{path: path}
+}
+
+func (f *FileKeyStore) Save(states []SessionState) error {
+	encoded, err := json.Marshal(states)
+	if err != nil {
+		return fmt.Errorf("session encode error: " + err.Error())
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		return err
+	} else if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// Load returns the sessions stored in the file. If the file does not exist,
+// there are no sessions.
+func (f *FileKeyStore) Load() ([]SessionState, error) {
+	encoded, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var states []SessionState
+	if err := json.Unmarshal(encoded, &states); err != nil {
+		return nil, fmt.Errorf("session decode error: " + err.Error())
+	}
+	return states, nil
+}
+
+// Delete removes the file. If the file does not exist, there is nothing to do.
+func (f *FileKeyStore) Delete() error {
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// snapshot returns a snapshot of the keys `sk`.
+func (sk *sessionKeys) snapshot() KeyGeneration {
+	return KeyGeneration{
+		Tx:      sk.tx,
+		Rx:      sk.rx,
+		SendSeq: atomic.LoadUint64(&sk.sendSeq),
+		RecvSeq: sk.window.highestSeq(),
+		Created: sk.created,
+	}
+}
+
+// restore returns the keys of the snapshot `g`, for use with `aead`. Since the
+// snapshot does not record which sequence numbers below RecvSeq have been
+// received, they are all treated as received.
+func (g *KeyGeneration) restore(aead AEAD) (*sessionKeys, error) {
+	if len(g.Tx) != KeySize || len(g.Rx) != KeySize {
+		return nil, fmt.Errorf("invalid session key size")
+	}
+	sk := newSessionKeys(aead, g.Tx, g.Rx, g.Created)
+	sk.sendSeq = g.SendSeq
+	sk.window.highest, sk.window.bitmap = g.RecvSeq, ^uint64(0)
+	return sk, nil
+}
+
+// snapshot returns a snapshot of the session, unless it is pending. ks.addr
+// must be protected by the caller.
+func (ks *keyStore) snapshot() (SessionState, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if ks.state == sessionPending || ks.cur == nil {
+		return SessionState{}, false
+	}
+	st := SessionState{
+		Addr:      ks.addr,
+		Suite:     ks.suite.Name,
+		Identity:  ks.public,
+		Agreement: ks.agreement,
+		Current:   ks.cur.snapshot(),
+	}
+	if ks.next != nil {
+		next := ks.next.snapshot()
+		st.Next = &next
+	}
+	return st, true
+}
+
+// Snapshot returns snapshots of the Crypto's established client-server and
+// end-to-end sessions. Pending sessions are not included.
+func (cr *Crypto) Snapshot() []SessionState {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	var states []SessionState
+	for id, ks := range cr.sessions {
+		if st, ok := ks.snapshot(); ok {
+			st.ID = []byte(id)
+			states = append(states, st)
+		}
+	}
+	for _, ks := range cr.peers {
+		if st, ok := ks.snapshot(); ok {
+			states = append(states, st)
+		}
+	}
+	return states
+}
+
+// restore returns the session of the snapshot `st`.
+func (cr *Crypto) restore(st *SessionState) (*keyStore, error) {
+	suite, ok := cr.selectSuite([]string{st.Suite})
+	if len(st.ID) == 0 {
+		// end-to-end sessions always use SuiteP256AES256GCM
+		suite, ok = SuiteP256AES256GCM, st.Suite == SuiteP256AES256GCM.Name
+		if st.Identity == nil || !st.Identity.valid() {
+			return nil, fmt.Errorf("end-to-end session with %s has no identity key", st.Addr)
+		}
+	} else if len(st.ID) != sidSize {
+		return nil, fmt.Errorf("malformed session id")
+	}
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher suite \"%s\"", st.Suite)
+	}
+	cur, err := st.Current.restore(suite.AEAD)
+	if err != nil {
+		return nil, err
+	}
+	ks := &keyStore{
+		state:     sessionEstablished,
+		addr:      st.Addr,
+		suite:     suite,
+		public:    st.Identity,
+		agreement: st.Agreement,
+		cur:       cur,
+	}
+	if st.Next != nil {
+		if ks.next, err = st.Next.restore(suite.AEAD); err != nil {
+			return nil, err
+		}
+		ks.state = sessionRekeying
+	}
+	return ks, nil
+}
+
+// Restore restores the sessions of the snapshots `states`, replacing any
+// sessions with the same peers. Either all of the sessions are restored or, if
+// any snapshot is invalid, none are.
+func (cr *Crypto) Restore(states []SessionState) error {
+	restored := make([]*keyStore, len(states))
+	for i := range states {
+		ks, err := cr.restore(&states[i])
+		if err != nil {
+			return fmt.Errorf("session restore error: " + err.Error())
+		}
+		restored[i] = ks
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	for i, ks := range restored {
+		if len(states[i].ID) == 0 {
+			cr.peers[ks.addr] = ks
+		} else {
+			cr.setSession(string(states[i].ID), ks.addr, ks)
+		}
+	}
+	return nil
+}
+
+// SaveSessions saves snapshots of the Crypto's sessions to `store`. Since
+// packets sent after a snapshot reuse its sequence numbers once it is
+// restored (and are then dropped as replays by the peer), sessions should be
+// saved when the Crypto is no longer in use, for example on shutdown.
+func (cr *Crypto) SaveSessions(store KeyStore) error {
+	return store.Save(cr.Snapshot())
+}
+
+// LoadSessions restores the sessions saved to `store`. The Crypto should have
+// the identity key with which the sessions were established, since peers
+// verify it in later key exchanges (see LoadOrCreateIdentityKey). The sessions
+// should then be deleted from `store` (see KeyStore.Delete).
+func (cr *Crypto) LoadSessions(store KeyStore) error {
+	states, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("session load error: " + err.Error())
+	}
+	return cr.Restore(states)
+}
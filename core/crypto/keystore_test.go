@@ -0,0 +1,160 @@
+package crypto
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/core"
+)
+
+// transfer encrypts `data` with `from`, for `dest`, and decrypts it with `to`,
+// as received from `src`, returning the data decrypted.
+func transfer(t *testing.T, from, to *Crypto, dest, src string, data string) string {
+	t.Helper()
+	ctx := &core.TransformContext{
+		PipelineCtx:  core.PipelineCtx{Pkt: testPC.NewPkt("", dest)},
+		PipelineName: "_out_",
+	}
+	buff := from.encryptTransport(ctx, []byte(data))
+	if ctx.Stat != core.CodeContinue {
+		t.Fatalf("encryption for %s failed: %s", dest, ctx.Msg)
+	}
+	dctx, decrypted := decryptFrom(to, src, buff)
+	if dctx.Stat != core.CodeContinue {
+		t.Fatalf("decryption from %s failed: %s", src, dctx.Msg)
+	}
+	return string(decrypted)
+}
+
+func TestKeyStores(t *testing.T) {
+	states := []SessionState{{
+		ID:    []byte("01234567"),
+		Addr:  "127.0.0.1:6000",
+		Suite: SuiteP256AES256GCM.Name,
+		Current: KeyGeneration{
+			Tx:      make([]byte, KeySize),
+			Rx:      make([]byte, KeySize),
+			SendSeq: 3,
+			RecvSeq: 5,
+			Created: time.Unix(1000, 0).UTC(),
+		},
+	}}
+	stores := []struct {
+		name  string
+		store KeyStore
+	}{
+		{"memory", NewMemoryKeyStore()},
+		{"file", NewFileKeyStore(filepath.Join(t.TempDir(), "sessions.json"))},
+	}
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			if loaded, err := tt.store.Load(); err != nil || len(loaded) != 0 {
+				t.Fatalf("Load of an empty store = %v, %v; want no sessions", loaded, err)
+			}
+			if err := tt.store.Save(states); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			loaded, err := tt.store.Load()
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			want, _ := json.Marshal(states)
+			if got, _ := json.Marshal(loaded); string(got) != string(want) {
+				t.Errorf("Load = %s, want %s", got, want)
+			}
+			if err := tt.store.Delete(); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if loaded, err := tt.store.Load(); err != nil || len(loaded) != 0 {
+				t.Errorf("Load after Delete = %v, %v; want no sessions", loaded, err)
+			}
+			if err := tt.store.Delete(); err != nil {
+				t.Errorf("Delete of an empty store: %v", err)
+			}
+		})
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	const addr = "127.0.0.1:6000"
+	svr, cl := newTestPeers(t)
+	kexCS(t, svr, cl, addr)
+	kexFin(t, svr, kexFinPkt(t, cl), addr)
+	transfer(t, cl, svr, testSvrAddr, addr, "before")
+	transfer(t, svr, cl, addr, testSvrAddr, "before")
+	_, captured := encryptTo(cl, []byte("captured"))
+	transfer(t, cl, svr, testSvrAddr, addr, "after the captured packet")
+
+	// both ends restart, restoring their sessions
+	store := NewMemoryKeyStore()
+	restored := make([]*Crypto, 2)
+	for i, cr := range []*Crypto{svr, cl} {
+		if err := cr.SaveSessions(store); err != nil {
+			t.Fatalf("SaveSessions: %v", err)
+		}
+		var err error
+		if restored[i], err = NewCrypto(cr.privKey); err != nil {
+			t.Fatalf("NewCrypto: %v", err)
+		} else if err := restored[i].LoadSessions(store); err != nil {
+			t.Fatalf("LoadSessions: %v", err)
+		}
+	}
+	svr, cl = restored[0], restored[1]
+	if got := transfer(t, cl, svr, testSvrAddr, addr, "hello"); got != "hello" {
+		t.Errorf("restored server decrypted %q, want %q", got, "hello")
+	}
+	if got := transfer(t, svr, cl, addr, testSvrAddr, "hello"); got != "hello" {
+		t.Errorf("restored client decrypted %q, want %q", got, "hello")
+	}
+	// packets received before the snapshot are not accepted again
+	if ctx, _ := decryptFrom(svr, addr, captured); ctx.Stat != core.CodeStopNoop {
+		t.Errorf("packet received before the snapshot accepted after the restore (status %d)", ctx.Stat)
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	const addr = "127.0.0.1:6000"
+	svr, cl := newTestPeers(t)
+	kexCS(t, svr, cl, addr)
+	kexFin(t, svr, kexFinPkt(t, cl), addr)
+	valid := svr.Snapshot()
+	if len(valid) != 1 {
+		t.Fatalf("Snapshot returned %d sessions, want 1", len(valid))
+	}
+	tests := []struct {
+		name    string
+		corrupt func(st *SessionState)
+	}{
+		{"short key", func(st *SessionState) { st.Current.Tx = st.Current.Tx[:KeySize-1] }},
+		{"short next key", func(st *SessionState) {
+			next := st.Current
+			next.Rx = nil
+			st.Next = &next
+		}},
+		{"malformed session id", func(st *SessionState) { st.ID = st.ID[:sidSize-1] }},
+		{"unsupported suite", func(st *SessionState) { st.Suite = "NOPE" }},
+		{"end-to-end without identity", func(st *SessionState) {
+			st.ID = nil
+			st.Identity = nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corrupt := valid[0]
+			corrupt.Addr = "127.0.0.1:6001"
+			tt.corrupt(&corrupt)
+			cr, err := NewCrypto(nil)
+			if err != nil {
+				t.Fatalf("NewCrypto: %v", err)
+			}
+			if err := cr.Restore([]SessionState{valid[0], corrupt}); err == nil {
+				t.Fatal("Restore of a corrupt session succeeded")
+			}
+			if n := len(cr.Snapshot()); n != 0 {
+				t.Errorf("%d sessions restored from corrupt state, want 0", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// pemPrivateKey is the PEM block type of PKCS #8 private keys.
+const pemPrivateKey = "PRIVATE KEY"
+
+// MarshalIdentityKey encodes the identity key `privKey` as a PEM encoded
+// PKCS #8 private key.
+func MarshalIdentityKey(privKey *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("identity key encode error: " + err.Error())
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemPrivateKey, Bytes: der}), nil
+}
+
+// ParsePrivateIdentityKey decodes a PEM encoded PKCS #8 identity key. The key
+// must be an ECDSA key on Curve.
+func ParsePrivateIdentityKey(encoded []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(encoded)
+	if block == nil || block.Type != pemPrivateKey {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("identity key decode error: " + err.Error())
+	}
+	privKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || privKey.Curve != Curve {
+		return nil, fmt.Errorf("identity key is not an ECDSA key on %s", Curve.Params().Name)
+	}
+	return privKey, nil
+}
+
+// LoadIdentityKey reads a PEM encoded PKCS #8 identity key from the file at
+// `path`.
+func LoadIdentityKey(path string) (*ecdsa.PrivateKey, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateIdentityKey(encoded)
+}
+
+// SaveIdentityKey writes the identity key `privKey` to the file at `path` as
+// a PEM encoded PKCS #8 private key. The file is only readable by its owner.
+func SaveIdentityKey(path string, privKey *ecdsa.PrivateKey) error {
+	encoded, err := MarshalIdentityKey(privKey)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, encoded, 0600)
+}
+
+// LoadOrCreateIdentityKey reads the identity key from the file at `path`. If
+// the file does not exist, a new identity key is generated and saved to it.
+// Servers should use a persistent identity key, since clients pin it: a new
+// identity key invalidates every client.
+func LoadOrCreateIdentityKey(path string) (*ecdsa.PrivateKey, error) {
+	privKey, err := LoadIdentityKey(path)
+	if !os.IsNotExist(err) {
+		return privKey, err
+	}
+	if privKey, err = ecdsa.GenerateKey(Curve, rand.Reader); err != nil {
+		return nil, fmt.Errorf("identity key gen fail: " + err.Error())
+	} else if err := SaveIdentityKey(path, privKey); err != nil {
+		return nil, err
+	}
+	return privKey, nil
+}
+
+// SaveIdentityKey writes the Crypto's identity key to the file at `path` (see
+// SaveIdentityKey).
+func (cr *Crypto) SaveIdentityKey(path string) error {
+	return SaveIdentityKey(path, cr.privKey)
+}
@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentityKeyPEMRoundTrip(t *testing.T) {
+	key := newTestIdentity(t)
+	encoded, err := MarshalIdentityKey(key)
+	if err != nil {
+		t.Fatalf("MarshalIdentityKey: %v", err)
+	}
+	parsed, err := ParsePrivateIdentityKey(encoded)
+	if err != nil {
+		t.Fatalf("ParsePrivateIdentityKey: %v", err)
+	}
+	if parsed.D.Cmp(key.D) != 0 || parsed.X.Cmp(key.X) != 0 || parsed.Y.Cmp(key.Y) != 0 {
+		t.Error("parsed identity key is not the key encoded")
+	}
+}
+
+func TestParsePrivateIdentityKeyInvalid(t *testing.T) {
+	otherCurve, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(otherCurve)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	tests := []struct {
+		name    string
+		encoded []byte
+	}{
+		{"empty", nil},
+		{"not PEM", []byte("not a key")},
+		{"wrong block type", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})},
+		{"not PKCS #8", pem.EncodeToMemory(&pem.Block{Type: pemPrivateKey, Bytes: []byte{1, 2, 3}})},
+		{"wrong curve", pem.EncodeToMemory(&pem.Block{Type: pemPrivateKey, Bytes: der})},
+	}
+	for _, tt := range tests {
+		if _, err := ParsePrivateIdentityKey(tt.encoded); err == nil {
+			t.Errorf("%s: ParsePrivateIdentityKey succeeded, want error", tt.name)
+		}
+	}
+}
+
+func TestLoadOrCreateIdentityKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.pem")
+	created, err := LoadOrCreateIdentityKey(path)
+	if err != nil {
+		t.Fatalf("LoadOrCreateIdentityKey of a new file: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatalf("identity key not saved: %v", err)
+	} else if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("identity key file mode = %o, want 600", mode)
+	}
+	loaded, err := LoadOrCreateIdentityKey(path)
+	if err != nil {
+		t.Fatalf("LoadOrCreateIdentityKey of an existing file: %v", err)
+	}
+	if loaded.D.Cmp(created.D) != 0 {
+		t.Error("existing identity key replaced by a new one")
+	}
+
+	// a corrupt key file is an error, rather than being replaced
+	if err := ioutil.WriteFile(path, []byte("corrupt"), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := LoadOrCreateIdentityKey(path); err == nil {
+		t.Error("LoadOrCreateIdentityKey of a corrupt file succeeded")
+	}
+	if encoded, _ := ioutil.ReadFile(path); string(encoded) != "corrupt" {
+		t.Error("corrupt identity key file overwritten")
+	}
+}
@@ -0,0 +1,262 @@
+package crypto
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/navaz-alani/concord/client"
+	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/core/clock"
+	"github.com/navaz-alani/concord/packet"
+)
+
+// rekeyContext is the additional data with which the client's key is sealed in
+// rekey requests.
+const rekeyContext = "concord/crypto.rekey"
+
+// rekeyRequest is the data of a rekey request, once unsealed. It holds the
+// client's new key share, for the KeyAgreement of the session's suite.
+type rekeyRequest struct {
+	Key []byte `json:"key"`
+}
+
+// KeyLifetime limits the use of the keys of client-server sessions. Keys
+// expire once they are older than Duration, or once Packets packets have been
+// encrypted with them in either direction. A zero limit is no limit.
+//
+// Packets encrypted with expired keys are dropped, so sessions should be
+// rekeyed before their keys expire (see Crypto.NeedsRekey). The keys of
+// end-to-end sessions do not expire.
+type KeyLifetime struct {
+	Duration time.Duration
+	Packets  uint64
+}
+
+// expired reports whether the keys `sk` have expired at `now`.
+func (l KeyLifetime) expired(sk *sessionKeys, now time.Time) bool {
+	return (l.Duration > 0 && now.Sub(sk.created) >= l.Duration) ||
+		(l.Packets > 0 && sk.packets() >= l.Packets)
+}
+
+// halfSpent reports whether half of the lifetime of the keys `sk` has elapsed
+// at `now`.
+func (l KeyLifetime) halfSpent(sk *sessionKeys, now time.Time) bool {
+	return (l.Duration > 0 && now.Sub(sk.created) >= l.Duration/2) ||
+		(l.Packets > 0 && sk.packets() >= l.Packets/2)
+}
+
+// SetKeyLifetime sets the lifetime of the keys of client-server sessions. Both
+// ends of a session should use the same lifetime. The default KeyLifetime has
+// no limits.
+func (cr *Crypto) SetKeyLifetime(l KeyLifetime) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.lifetime = l
+}
+
+func (cr *Crypto) getKeyLifetime() KeyLifetime {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.lifetime
+}
+
+// DefaultHandshakeTimeout is the default time within which clients must
+// complete server key exchanges.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// SetHandshakeTimeout sets the time within which clients must complete server
+// key exchanges (see TargetKeyExchangeFin). Pending sessions older than `d`
+// are removed when sessions are swept. The default is DefaultHandshakeTimeout.
+func (cr *Crypto) SetHandshakeTimeout(d time.Duration) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.handshake = d
+}
+
+// SetClock sets the Clock with which the ages of keys are measured against
+// their KeyLifetime (clock.Real by default). Since keys record the time at
+// which they were created, it should be set before any keys are exchanged.
+func (cr *Crypto) SetClock(clk clock.Clock) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.clock = clk
+	cr.lastSweep = clk.Now()
+}
+
+// now returns the current time, according to the Crypto's Clock.
+func (cr *Crypto) now() time.Time {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.clock.Now()
+}
+
+// NeedsRekey reports whether the session with `addr` should be rekeyed i.e.
+// whether half of the lifetime of its keys has been spent. Rekeying then leaves
+// the other half of the lifetime for the rekey to complete.
+func (cr *Crypto) NeedsRekey(addr string) bool {
+	if ks, ok := cr.getSession(addr); !ok || ks.getState() != sessionEstablished {
+		return false
+	} else {
+		return cr.getKeyLifetime().halfSpent(ks.current(), cr.now())
+	}
+}
+
+// Forget removes the client-server and end-to-end sessions with `addr`, if
+// any. Packets to and from `addr` are no longer encrypted until another key
+// exchange is performed.
+func (cr *Crypto) Forget(addr string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.removeSession(addr)
+	delete(cr.peers, addr)
+}
+
+// Sweep removes the client-server sessions whose keys have expired, as well as
+// pending sessions whose handshake has timed out, and returns the number of
+// sessions removed. Sessions are also swept when keys are exchanged, at most
+// once per KeyLifetime.Duration (or handshake timeout, if shorter), so that
+// long-running servers need only call Sweep when using packet-limited
+// lifetimes.
+func (cr *Crypto) Sweep() int {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.sweep(cr.clock.Now())
+}
+
+// sweep removes the sessions whose keys have expired at `now` and the pending
+// sessions whose handshake has timed out. cr.mu must be held.
+func (cr *Crypto) sweep(now time.Time) int {
+	n := 0
+	for id, ks := range cr.sessions {
+		sk := ks.current()
+		if sk == nil {
+			continue // a client's placeholder, removed if its handshake fails
+		}
+		timedOut := cr.handshake > 0 && ks.getState() == sessionPending &&
+			now.Sub(sk.created) >= cr.handshake
+		if timedOut || cr.lifetime.expired(sk, now) {
+			if cr.addrs[ks.addr] == id {
+				delete(cr.addrs, ks.addr)
+			}
+			delete(cr.sessions, id)
+			n++
+		}
+	}
+	cr.lastSweep = now
+	return n
+}
+
+// Rekey replaces the keys of the session with the server at `svrAddr` with
+// fresh ones, without interrupting traffic. A new key is sent to the server
+// (sealed with the current session keys) using `pkt` and the server responds
+// with a new ephemeral key, signed as in a key exchange. The client switches to
+// the new keys once the response has been verified and the server switches to
+// them when it receives the first packet encrypted with them. Until then, both
+// ends still accept packets encrypted with the previous keys.
+//
+// Only established sessions can be rekeyed, one rekey at a time. A session
+// whose keys have expired cannot be rekeyed; a new key exchange needs to be
+// performed instead.
+func (cr *Crypto) Rekey(client client.Client, svrAddr string, pkt packet.Packet) error {
+	ks, ok := cr.getSession(svrAddr)
+	if !ok {
+		return fmt.Errorf("keys not exchanged")
+	}
+	trust := cr.getTrustStore()
+	if trust == nil {
+		return fmt.Errorf("no trust store to verify server key")
+	}
+	if !ks.transition(sessionEstablished, sessionRekeying) {
+		return fmt.Errorf("session not established or already rekeying")
+	}
+	if err := cr.rekey(client, svrAddr, pkt, ks, trust); err != nil {
+		ks.transition(sessionRekeying, sessionEstablished)
+		return err
+	}
+	return nil
+}
+
+func (cr *Crypto) rekey(client client.Client, svrAddr string, pkt packet.Packet,
+	ks *keyStore, trust *TrustStore) error {
+	ka := ks.suite.KeyAgreement
+	ephemeral, ephemeralPub, err := ka.GenerateKey()
+	if err != nil {
+		return fmt.Errorf("key gen fail: " + err.Error())
+	}
+	encoded, _ := json.Marshal(rekeyRequest{Key: ephemeralPub})
+	cur := ks.current()
+	sealed, err := encrypt(cur.aead, cur.tx, encoded, []byte(rekeyContext))
+	if err != nil {
+		return fmt.Errorf("key seal fail: " + err.Error())
+	}
+	pw := pkt.Writer()
+	pw.Clear()
+	pw.Meta().Add(packet.KeyTarget, TargetRekey)
+	pw.Meta().Add(KeyVersion, ProtocolVersion)
+	pw.Meta().Add(KeySession, hex.EncodeToString([]byte(ks.id)))
+	pw.Write(sealed)
+	pw.Close()
+	resp, err := client.Request(context.Background(), pkt)
+	if err != nil {
+		return fmt.Errorf("rekey error: " + err.Error())
+	} else if err := checkRespVersion(resp); err != nil {
+		return fmt.Errorf("rekey error: " + err.Error())
+	}
+	var sk SignedKey
+	if err := json.Unmarshal(resp.Data(), &sk); err != nil {
+		return fmt.Errorf("packet decode error: " + err.Error())
+	} else if sk.Suite != ks.suite.Name {
+		return fmt.Errorf("cipher suite changed during rekey")
+	} else if err := trust.verifySignedKey(svrAddr, nil, ephemeralPub, &sk); err != nil {
+		return err
+	}
+	secret, err := ka.SharedSecret(ephemeral, sk.Key)
+	if err != nil {
+		return fmt.Errorf("invalid server key")
+	}
+	tx, rx := deriveKeys(secret, transcript(sk.Suite, ephemeralPub, sk.Key), true)
+	ks.rotate(newSessionKeys(ks.suite.AEAD, tx, rx, cr.now()))
+	return nil
+}
+
+// rekeyServer performs the server side of a rekey of the session identified in
+// the request. The client's new key is only accepted if it has been sealed with
+// the current keys of that session. The new keys are kept pending until the
+// client uses them.
+func (cr *Crypto) rekeyServer(ctx *core.TargetCtx, pw packet.Writer) {
+	if !checkVersion(ctx) {
+		return
+	}
+	ks, ok := cr.sessionFor(ctx)
+	if !ok {
+		return
+	}
+	cur := ks.current()
+	encoded, err := decrypt(cur.aead, cur.rx, ctx.Pkt.Data(), []byte(rekeyContext))
+	if err != nil {
+		ctx.Stat = core.CodeStopError
+		ctx.Msg = "rekey not authenticated"
+		return
+	}
+	var req rekeyRequest
+	if err := json.Unmarshal(encoded, &req); err != nil {
+		ctx.Stat = core.CodeStopError
+		ctx.Msg = "malformed packet"
+		return
+	}
+	signed, keys, err := cr.exchangeKey(ks.suite, nil, req.Key)
+	if err != nil {
+		ctx.Stat = core.CodeStopError
+		ctx.Msg = err.Error()
+		return
+	}
+	signedKey, _ := json.Marshal(signed)
+	ks.setNext(keys)
+	// the response is encrypted with the current keys
+	pw.Meta().Add(KeyVersion, ProtocolVersion)
+	pw.Write(signedKey)
+	ctx.Stat = core.CodeStopCloseSend
+}
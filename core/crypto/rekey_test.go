@@ -0,0 +1,216 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/client"
+	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/core/clock/clocktest"
+	throttle "github.com/navaz-alani/concord/core/throttle"
+)
+
+// encryptTo encrypts `data` with `cl`, for the server at testSvrAddr,
+// returning the transform's context and result.
+func encryptTo(cl *Crypto, data []byte) (*core.TransformContext, []byte) {
+	ctx := &core.TransformContext{
+		PipelineCtx:  core.PipelineCtx{Pkt: testPC.NewPkt("", testSvrAddr)},
+		PipelineName: "_out_",
+	}
+	return ctx, cl.encryptTransport(ctx, data)
+}
+
+// decryptFrom decrypts `buff` with `svr`, as received from `from`, returning
+// the transform's context and result.
+func decryptFrom(svr *Crypto, from string, buff []byte) (*core.TransformContext, []byte) {
+	ctx := &core.TransformContext{
+		PipelineName: "_in_",
+		From:         from,
+	}
+	return ctx, svr.decryptTransport(ctx, buff)
+}
+
+func TestKeyLifetimeExpiry(t *testing.T) {
+	const addr = "127.0.0.1:6000"
+	const lifetime = time.Minute
+	svr, cl := newTestPeers(t)
+	clk := clocktest.NewManual(time.Unix(0, 0))
+	for _, cr := range []*Crypto{svr, cl} {
+		cr.SetClock(clk)
+		cr.SetKeyLifetime(KeyLifetime{Duration: lifetime})
+	}
+	kexCS(t, svr, cl, addr)
+	kexFin(t, svr, kexFinPkt(t, cl), addr)
+
+	tests := []struct {
+		at        time.Duration // time since the key exchange
+		needRekey bool
+	}{
+		{0, false},
+		{lifetime/2 - time.Nanosecond, false},
+		{lifetime / 2, true},
+		{lifetime - time.Nanosecond, true},
+	}
+	elapsed := time.Duration(0)
+	for _, tt := range tests {
+		clk.Advance(tt.at - elapsed)
+		elapsed = tt.at
+		if got := cl.NeedsRekey(testSvrAddr); got != tt.needRekey {
+			t.Errorf("NeedsRekey after %v = %t, want %t", tt.at, got, tt.needRekey)
+		}
+		ctx, buff := encryptTo(cl, []byte("hello"))
+		if ctx.Stat != core.CodeContinue {
+			t.Fatalf("encryption after %v failed: %s", tt.at, ctx.Msg)
+		}
+		if ctx, data := decryptFrom(svr, addr, buff); ctx.Stat != core.CodeContinue || string(data) != "hello" {
+			t.Fatalf("decryption after %v = %q (%s), want %q", tt.at, data, ctx.Msg, "hello")
+		}
+	}
+
+	// a packet encrypted just before the keys expire, but received after
+	_, late := encryptTo(cl, []byte("late"))
+	clk.Advance(lifetime - elapsed)
+	if ctx, _ := encryptTo(cl, []byte("hello")); ctx.Stat != core.CodeStopNoop || ctx.Msg != "session keys expired" {
+		t.Errorf("encryption with expired keys not dropped: status %d (%s)", ctx.Stat, ctx.Msg)
+	}
+	if ctx, _ := decryptFrom(svr, addr, late); ctx.Stat != core.CodeStopNoop || ctx.Msg != "session keys expired" {
+		t.Errorf("packet encrypted with expired keys not dropped: status %d (%s)", ctx.Stat, ctx.Msg)
+	}
+	if n := svr.Sweep(); n != 1 {
+		t.Errorf("Sweep after the keys expired removed %d sessions, want 1", n)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	svr, err := NewCrypto(newTestIdentity(t))
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	svrAddr, leaked := newTestUDPServer(t, svr, nil)
+	cl, err := client.NewUDPClient(svrAddr, &net.UDPAddr{IP: []byte{127, 0, 0, 1}}, 4096,
+		testPC, throttle.Rate10k)
+	if err != nil {
+		t.Fatalf("NewUDPClient: %v", err)
+	}
+	defer cl.Cleanup()
+	cl.SetTimeout(5 * time.Second)
+	trust := NewTrustStore()
+	trust.Pin(svrAddr.String(), &svr.privKey.PublicKey)
+	cr, err := ConfigureClient(cl, svrAddr.String(), trust, testPC.NewPkt("", svrAddr.String()))
+	if err != nil {
+		t.Fatalf("ConfigureClient: %v", err)
+	}
+	own, _ := cr.getSession(svrAddr.String())
+	svrKS, _ := svr.getSessionByID(own.id)
+	old := svrKS.current()
+
+	// traffic continues throughout the rekey
+	const numSenders = 4
+	stop, errs := make(chan struct{}), make(chan error, numSenders)
+	var wg sync.WaitGroup
+	for i := 0; i < numSenders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if resp, err := cl.Request(context.Background(), echoPkt(svrAddr.String())); err != nil {
+					errs <- err
+					return
+				} else if !bytes.Equal(resp.Data(), cleartextMarker) {
+					errs <- fmt.Errorf("echo = %q, want %q", resp.Data(), cleartextMarker)
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := cr.Rekey(cl, svrAddr.String(), testPC.NewPkt("", svrAddr.String())); err != nil {
+		t.Fatalf("Rekey: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Request during the rekey: %v", err)
+	}
+
+	// the server has rotated to the keys used by the client since the rekey
+	if _, err := cl.Request(context.Background(), echoPkt(svrAddr.String())); err != nil {
+		t.Fatalf("Request after the rekey: %v", err)
+	}
+	if state := svrKS.getState(); state != sessionEstablished {
+		t.Errorf("server session state after the rekey = %d, want established", state)
+	}
+	if cur := svrKS.current(); cur == old || !bytes.Equal(cur.rx, own.current().tx) {
+		t.Error("server not using the client's new keys")
+	}
+	if gens := svrKS.generations(); len(gens) != 2 || gens[1] != old {
+		t.Error("previous keys no longer accepted by the server")
+	}
+	if n := atomic.LoadInt64(leaked); n != 0 {
+		t.Errorf("server read %d packets in cleartext", n)
+	}
+}
+
+func TestKeyLifetimePackets(t *testing.T) {
+	const addr = "127.0.0.1:6000"
+	svr, cl := newTestPeers(t)
+	for _, cr := range []*Crypto{svr, cl} {
+		cr.SetKeyLifetime(KeyLifetime{Packets: 4})
+	}
+	kexCS(t, svr, cl, addr)
+	kexFin(t, svr, kexFinPkt(t, cl), addr)
+	for i := 1; i <= 4; i++ {
+		if got, want := cl.NeedsRekey(testSvrAddr), i > 2; got != want {
+			t.Errorf("NeedsRekey before packet %d = %t, want %t", i, got, want)
+		}
+		if got := transfer(t, cl, svr, testSvrAddr, addr, "hello"); got != "hello" {
+			t.Fatalf("packet %d decrypted as %q, want %q", i, got, "hello")
+		}
+	}
+	// both ends have used the keys for 4 packets
+	if ctx, _ := encryptTo(cl, []byte("hello")); ctx.Stat != core.CodeStopNoop || ctx.Msg != "session keys expired" {
+		t.Errorf("client encryption with expired keys not dropped: status %d (%s)", ctx.Stat, ctx.Msg)
+	}
+	ctx := &core.TransformContext{PipelineCtx: core.PipelineCtx{Pkt: testPC.NewPkt("", addr)}}
+	if svr.encryptTransport(ctx, []byte("hello")); ctx.Stat != core.CodeStopNoop || ctx.Msg != "session keys expired" {
+		t.Errorf("server encryption with expired keys not dropped: status %d (%s)", ctx.Stat, ctx.Msg)
+	}
+	if n := svr.Sweep(); n != 1 {
+		t.Errorf("Sweep after the keys expired removed %d sessions, want 1", n)
+	}
+}
+
+func TestForget(t *testing.T) {
+	const addr = "127.0.0.1:6000"
+	svr, cl := newTestPeers(t)
+	kexCS(t, svr, cl, addr)
+	kexFin(t, svr, kexFinPkt(t, cl), addr)
+	_, encrypted := encryptTo(cl, []byte("hello"))
+
+	cl.Forget(testSvrAddr)
+	if ctx, buff := encryptTo(cl, []byte("hello")); ctx.Stat != core.CodeContinue || string(buff) != "hello" {
+		t.Errorf("data for a forgotten server = %q (status %d), want it in plain text", buff, ctx.Stat)
+	}
+	svr.Forget(addr)
+	if ctx, buff := decryptFrom(svr, addr, encrypted); ctx.Stat != core.CodeContinue || !bytes.Equal(buff, encrypted) {
+		t.Errorf("data from a forgotten client decrypted (status %d)", ctx.Stat)
+	}
+	for _, cr := range []*Crypto{svr, cl} {
+		if n := len(cr.Snapshot()); n != 0 {
+			t.Errorf("%d sessions left after Forget, want 0", n)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// seqSize is the size, in bytes, of the sequence number header which precedes
+// transport-encrypted data. The header is bound to the ciphertext as AEAD
+// additional data, so that it cannot be altered.
+const seqSize = 8
+
+// replayWindowSize is the number of sequence numbers, below the highest one
+// received, that are tracked by a replayWindow. Packets with sequence numbers
+// older than that are considered stale and are dropped.
+const replayWindowSize = 64
+
+// Replay window verdicts.
+const (
+	seqAccepted uint8 = iota
+	seqReplayed
+	seqStale
+)
+
+// replayWindow is a sliding window over the sequence numbers received from a
+// peer (as in IPsec/DTLS). Sequence numbers start at 1 and packets may arrive
+// out of order, as long as they are within the window.
+type replayWindow struct {
+	mu      sync.Mutex // mu protects `highest` and `bitmap`
+	highest uint64     // highest sequence number accepted
+	bitmap  uint64     // bit i is set if sequence number highest-i was accepted
+}
+
+// accept checks `seq` against the window and, if it is accepted, records it.
+// It should only be called for packets which have been authenticated, so that
+// forged packets cannot advance the window.
+func (w *replayWindow) accept(seq uint64) uint8 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case seq == 0:
+		return seqStale
+	case seq > w.highest:
+		if shift := seq - w.highest; shift >= replayWindowSize {
+			w.bitmap = 1
+		} else {
+			w.bitmap = w.bitmap<<shift | 1
+		}
+		w.highest = seq
+		return seqAccepted
+	case w.highest-seq >= replayWindowSize:
+		return seqStale
+	default:
+		bit := uint64(1) << (w.highest - seq)
+		if w.bitmap&bit != 0 {
+			return seqReplayed
+		}
+		w.bitmap |= bit
+		return seqAccepted
+	}
+}
+
+// highestSeq returns the highest sequence number accepted by the window.
+func (w *replayWindow) highestSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.highest
+}
+
+// seqHeader encodes the sequence number header for `seq`.
+func seqHeader(seq uint64) []byte {
+	hdr := make([]byte, seqSize)
+	binary.BigEndian.PutUint64(hdr, seq)
+	return hdr
+}
+
+// Stats holds the counters of packets dropped by a Crypto's transport
+// decryption.
+type Stats struct {
+	// Replayed is the number of packets dropped for being duplicates of packets
+	// that have already been received.
+	Replayed uint64
+	// Stale is the number of packets dropped for being older than the replay
+	// window.
+	Stale uint64
+}
+
+// counters are the internal, atomically updated, counterparts of Stats.
+type counters struct {
+	replayed uint64
+	stale    uint64
+}
+
+// Stats returns a snapshot of the Crypto's counters.
+func (cr *Crypto) Stats() Stats {
+	return Stats{
+		Replayed: atomic.LoadUint64(&cr.counters.replayed),
+		Stale:    atomic.LoadUint64(&cr.counters.stale),
+	}
+}
@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/navaz-alani/concord/core"
+)
+
+func TestReplayWindow(t *testing.T) {
+	type step struct {
+		seq  uint64
+		want uint8
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"zero", []step{{0, seqStale}, {1, seqAccepted}, {0, seqStale}}},
+		{"in order", []step{{1, seqAccepted}, {2, seqAccepted}, {3, seqAccepted}}},
+		{"out of order", []step{{3, seqAccepted}, {1, seqAccepted}, {2, seqAccepted}, {4, seqAccepted}}},
+		{"replayed", []step{{1, seqAccepted}, {2, seqAccepted}, {1, seqReplayed}, {2, seqReplayed}}},
+		{"replayed out of order", []step{{5, seqAccepted}, {3, seqAccepted}, {3, seqReplayed}, {4, seqAccepted}}},
+		{"edge of the window", []step{
+			{replayWindowSize + 1, seqAccepted},
+			{2, seqAccepted},
+			{2, seqReplayed},
+			{1, seqStale},
+		}},
+		{"jump", []step{
+			{1, seqAccepted},
+			{2, seqAccepted},
+			{1000, seqAccepted},
+			// the window slid past the old sequence numbers
+			{2, seqStale},
+			{1000 - replayWindowSize, seqStale},
+			{1000 - replayWindowSize + 1, seqAccepted},
+			{999, seqAccepted},
+			{1000, seqReplayed},
+		}},
+		{"jump within the window", []step{
+			{1, seqAccepted},
+			{replayWindowSize, seqAccepted},
+			{1, seqReplayed},
+			{replayWindowSize + 1, seqAccepted},
+			{1, seqStale},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w replayWindow
+			for i, s := range tt.steps {
+				if got := w.accept(s.seq); got != s.want {
+					t.Errorf("step %d: accept(%d) = %d, want %d", i, s.seq, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecryptTransportReplay(t *testing.T) {
+	const addr = "127.0.0.1:6000"
+	svr, cl := newTestPeers(t)
+	kexCS(t, svr, cl, addr)
+	kexFin(t, svr, kexFinPkt(t, cl), addr)
+
+	_, captured := encryptTo(cl, []byte("hello"))
+	if ctx, data := decryptFrom(svr, addr, captured); ctx.Stat != core.CodeContinue || string(data) != "hello" {
+		t.Fatalf("decryption = %q (%s), want %q", data, ctx.Msg, "hello")
+	}
+	if ctx, _ := decryptFrom(svr, addr, captured); ctx.Stat != core.CodeStopNoop {
+		t.Errorf("replayed packet not dropped (status %d)", ctx.Stat)
+	}
+	if stats := svr.Stats(); stats.Replayed != 1 || stats.Stale != 0 {
+		t.Errorf("Stats = %+v, want 1 replayed packet", stats)
+	}
+
+	// a packet which is delivered after a window's worth of newer packets
+	_, old := encryptTo(cl, []byte("old"))
+	for i := 0; i < replayWindowSize; i++ {
+		_, buff := encryptTo(cl, []byte("hello"))
+		if ctx, _ := decryptFrom(svr, addr, buff); ctx.Stat != core.CodeContinue {
+			t.Fatalf("decryption of packet %d failed: %s", i, ctx.Msg)
+		}
+	}
+	if ctx, _ := decryptFrom(svr, addr, old); ctx.Stat != core.CodeStopNoop {
+		t.Errorf("stale packet not dropped (status %d)", ctx.Stat)
+	}
+	if stats := svr.Stats(); stats.Replayed != 1 || stats.Stale != 1 {
+		t.Errorf("Stats = %+v, want 1 replayed and 1 stale packet", stats)
+	}
+}
@@ -0,0 +1,93 @@
+package crypto
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/navaz-alani/concord/packet"
+)
+
+// sealedContext is the additional data with which sealed end-to-end envelopes
+// are encrypted. It distinguishes them from plain end-to-end encrypted data.
+const sealedContext = "concord/crypto.e2e-sealed"
+
+// routingKeys are the metadata keys which are never sealed, since servers need
+// them to process (or relay) packets. KeyNoCrypto is also left visible, since
+// it directs the transport encryption of the packet.
+var routingKeys = map[string]bool{
+	packet.KeyTarget:    true,
+	packet.KeyRef:       true,
+	packet.KeyRelayTo:   true,
+	packet.KeyRelayFrom: true,
+	KeyNoCrypto:         true,
+}
+
+// sealedEnvelope is the plain text of end-to-end encrypted data which has been
+// sealed along with metadata.
+type sealedEnvelope struct {
+	Meta map[string]string `json:"m"`
+	Data []byte            `json:"d"`
+}
+
+// EncryptE2ESealed performs end-to-end encryption, like EncryptE2E, but also
+// seals metadata into the encrypted data, so that it is hidden from the server
+// relaying the packet. The metadata keys `keys` are sealed if given, and every
+// metadata key except for the routing keys (KeyTarget, KeyRef, the server relay
+// keys and KeyNoCrypto) is sealed otherwise. Sealed keys are removed from the
+// packet's metadata and DecryptE2E restores them on receipt. Routing keys
+// cannot be sealed, since the server needs them to relay the packet.
+func (cr *Crypto) EncryptE2ESealed(to string, pkt packet.Packet, keys ...string) error {
+	requested := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if routingKeys[key] {
+			return fmt.Errorf("e2e encrypt error: routing key \"%s\" cannot be sealed", key)
+		}
+		requested[key] = true
+	}
+	meta := pkt.Meta()
+	envelope := sealedEnvelope{Meta: make(map[string]string), Data: pkt.Data()}
+	for _, key := range meta.Keys() {
+		if requested[key] || (len(keys) == 0 && !routingKeys[key]) {
+			envelope.Meta[key] = meta.Get(key)
+		}
+	}
+	encoded, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("e2e encrypt error: %s", err.Error())
+	}
+	encrypted, err := cr.encryptFor(to, encoded, []byte(sealedContext))
+	if err != nil {
+		return fmt.Errorf("e2e encrypt error: %s", err.Error())
+	}
+	for key := range envelope.Meta {
+		meta.Delete(key)
+	}
+	writer := pkt.Writer()
+	writer.Clear()
+	writer.Write(encrypted)
+	writer.Close()
+	return nil
+}
+
+// unseal restores the metadata and data of the sealed envelope `encoded` on
+// `pkt`. Envelopes holding routing keys are rejected, so that a sender cannot
+// override the keys set by the server (such as the relay source).
+func unseal(encoded []byte, pkt packet.Packet) error {
+	var envelope sealedEnvelope
+	if err := json.Unmarshal(encoded, &envelope); err != nil {
+		return fmt.Errorf("malformed sealed envelope")
+	}
+	for key := range envelope.Meta {
+		if routingKeys[key] {
+			return fmt.Errorf("sealed routing key \"%s\"", key)
+		}
+	}
+	for key, val := range envelope.Meta {
+		pkt.Meta().Add(key, val)
+	}
+	writer := pkt.Writer()
+	writer.Clear()
+	writer.Write(envelope.Data)
+	writer.Close()
+	return nil
+}
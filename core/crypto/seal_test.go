@@ -0,0 +1,166 @@
+package crypto
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/navaz-alani/concord/packet"
+)
+
+const testAliceAddr, testBobAddr = "127.0.0.1:7001", "127.0.0.1:7002"
+
+// peerKeyResp composes the response to a client-client key exchange for the
+// client `cr`, as relayed by a server.
+func peerKeyResp(cr *Crypto) packet.Packet {
+	encoded, _ := json.Marshal(PeerKey{PublicKey: cr.IdentityKey(), SignedKey: *cr.signed})
+	resp := testPC.NewPkt("", "")
+	resp.Meta().Add(KeyVersion, ProtocolVersion)
+	resp.Writer().Write(encoded)
+	resp.Writer().Close()
+	return resp
+}
+
+// newE2EPeers returns two clients, at testAliceAddr and testBobAddr, which
+// have exchanged end-to-end keys.
+func newE2EPeers(t *testing.T) (alice, bob *Crypto) {
+	alice, err := NewCrypto(nil)
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	bob, err = NewCrypto(nil)
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	if err := alice.ProcessKeyExResp(testBobAddr, peerKeyResp(bob)); err != nil {
+		t.Fatalf("ProcessKeyExResp: %v", err)
+	}
+	if err := bob.ProcessKeyExResp(testAliceAddr, peerKeyResp(alice)); err != nil {
+		t.Fatalf("ProcessKeyExResp: %v", err)
+	}
+	return alice, bob
+}
+
+// relay returns `pkt` as it is received by the client it is relayed to by a
+// server, from `from`.
+func relay(t *testing.T, pkt packet.Packet, from string) packet.Packet {
+	bin, err := pkt.Marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	fwd := testPC.NewPkt("", "")
+	if err := fwd.Unmarshal(bin); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	fwd.Meta().Add(packet.KeyRelayFrom, from)
+	return fwd
+}
+
+// metadata returns the metadata of `pkt`, as a map.
+func metadata(pkt packet.Packet) map[string]string {
+	meta := make(map[string]string)
+	for _, key := range pkt.Meta().Keys() {
+		meta[key] = pkt.Meta().Get(key)
+	}
+	return meta
+}
+
+func TestEncryptE2ESealed(t *testing.T) {
+	sent := map[string]string{
+		packet.KeyTarget:  "svr.relay",
+		packet.KeyRef:     "ref",
+		packet.KeyRelayTo: testBobAddr,
+		"app.kind":        "message",
+		"app.thread":      "42",
+	}
+	tests := []struct {
+		name  string
+		keys  []string
+		plain []string // metadata keys left in plain text
+	}{
+		{"all keys", nil, []string{packet.KeyTarget, packet.KeyRef, packet.KeyRelayTo}},
+		{"selected keys", []string{"app.kind"},
+			[]string{packet.KeyTarget, packet.KeyRef, packet.KeyRelayTo, "app.thread"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice, bob := newE2EPeers(t)
+			pkt := testPC.NewPkt("", "")
+			pkt.Meta().Clear()
+			for k, v := range sent {
+				pkt.Meta().Add(k, v)
+			}
+			pkt.Writer().Write([]byte("hello"))
+			pkt.Writer().Close()
+			if err := alice.EncryptE2ESealed(testBobAddr, pkt, tt.keys...); err != nil {
+				t.Fatalf("EncryptE2ESealed: %v", err)
+			}
+			want := make(map[string]string)
+			for _, key := range tt.plain {
+				want[key] = sent[key]
+			}
+			if got := metadata(pkt); !reflect.DeepEqual(got, want) {
+				t.Errorf("plain text metadata = %v, want %v", got, want)
+			}
+
+			recv := relay(t, pkt, testAliceAddr)
+			if err := bob.DecryptE2E(testAliceAddr, recv); err != nil {
+				t.Fatalf("DecryptE2E: %v", err)
+			}
+			want = map[string]string{packet.KeyRelayFrom: testAliceAddr}
+			for k, v := range sent {
+				want[k] = v
+			}
+			if got := metadata(recv); !reflect.DeepEqual(got, want) {
+				t.Errorf("unsealed metadata = %v, want %v", got, want)
+			}
+			if string(recv.Data()) != "hello" {
+				t.Errorf("unsealed data = %q, want %q", recv.Data(), "hello")
+			}
+		})
+	}
+}
+
+func TestEncryptE2ESealedRoutingKey(t *testing.T) {
+	alice, _ := newE2EPeers(t)
+	for key := range routingKeys {
+		pkt := testPC.NewPkt("", "")
+		pkt.Meta().Add(key, "value")
+		pkt.Writer().Write([]byte("hello"))
+		pkt.Writer().Close()
+		if err := alice.EncryptE2ESealed(testBobAddr, pkt, "app.kind", key); err == nil {
+			t.Errorf("sealing routing key %q succeeded", key)
+		}
+		if pkt.Meta().Get(key) != "value" || string(pkt.Data()) != "hello" {
+			t.Errorf("packet modified by a failed seal of %q", key)
+		}
+	}
+}
+
+func TestDecryptE2ESealedRoutingKey(t *testing.T) {
+	alice, bob := newE2EPeers(t)
+	for key := range routingKeys {
+		// a sender which seals a routing key, to override it on receipt
+		encoded, _ := json.Marshal(sealedEnvelope{
+			Meta: map[string]string{key: "forged", "app.kind": "message"},
+			Data: []byte("hello"),
+		})
+		encrypted, err := alice.encryptFor(testBobAddr, encoded, []byte(sealedContext))
+		if err != nil {
+			t.Fatalf("encryptFor: %v", err)
+		}
+		pkt := testPC.NewPkt("", "")
+		pkt.Writer().Write(encrypted)
+		pkt.Writer().Close()
+		recv := relay(t, pkt, testAliceAddr)
+		if err := bob.DecryptE2E(testAliceAddr, recv); err == nil {
+			t.Errorf("envelope sealing routing key %q accepted", key)
+		}
+		if v := recv.Meta().Get(key); v == "forged" {
+			t.Errorf("routing key %q overridden by a rejected envelope", key)
+		}
+		if recv.Meta().Get("app.kind") != "" {
+			t.Errorf("metadata of an envelope sealing routing key %q restored", key)
+		}
+	}
+}
@@ -1,38 +1,160 @@
 package crypto
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 
 	"github.com/navaz-alani/concord/core"
 	"github.com/navaz-alani/concord/packet"
 )
 
+// kexFinContext is the additional data of the proof, sent by clients to
+// complete server key exchanges, that they have derived the session keys.
+const kexFinContext = "concord/crypto.kex-fin"
+
 func (cr *Crypto) installOnServer(p core.Processor) error {
 	p.PacketProcessor().AddCallback(TargetKeyExchangeServer, cr.keyExchangeServer)
 	p.PacketProcessor().AddCallback(TargetKeyExchangeClient, cr.keyExchangeClient)
+	p.PacketProcessor().AddCallback(TargetKeyExchangeFin, cr.keyExchangeFin)
+	p.PacketProcessor().AddCallback(TargetRekey, cr.rekeyServer)
 	return nil
 }
 
+// kexRequest is the data of a server key exchange request. It holds the
+// client's identity key, the names of the cipher suites offered by the client
+// (in order of preference) and the client's key shares for their key
+// agreements, by KeyAgreement name. It also holds the client's end-to-end
+// agreement key, signed by its identity key, which the server distributes to
+// other clients.
+type kexRequest struct {
+	PublicKey
+	Suites    []string          `json:"suites"`
+	Shares    map[string][]byte `json:"shares"`
+	Agreement *SignedKey        `json:"agreement,omitempty"`
+}
+
+// keyExchangeServer performs the server side of a client-server key exchange.
+// The first suite offered by the client which the server supports is selected.
+// A fresh ephemeral key is generated for every exchange and the response
+// carries that key, signed with the server's identity key, along with the ID
+// of the new session. The new session is pending and any existing session
+// with the client is kept until the client confirms the new one.
 func (cr *Crypto) keyExchangeServer(ctx *core.TargetCtx, pw packet.Writer) {
-	// get public key from packet
-	var pk PublicKey
-	if err := json.Unmarshal(ctx.Pkt.Data(), &pk); err != nil {
+	if !checkVersion(ctx) {
+		return
+	}
+	// get client keys from packet
+	var req kexRequest
+	if err := json.Unmarshal(ctx.Pkt.Data(), &req); err != nil {
 		ctx.Stat = core.CodeStopError
 		ctx.Msg = "malformed packet"
 		return
+	} else if !req.valid() {
+		ctx.Stat = core.CodeStopError
+		ctx.Msg = "invalid public key"
+		return
+	} else if req.Agreement != nil {
+		if err := verifyAgreement(&req.PublicKey, req.Agreement); err != nil {
+			ctx.Stat = core.CodeStopError
+			ctx.Msg = err.Error()
+			return
+		}
+	}
+	suite, ok := cr.selectSuite(req.Suites)
+	if !ok {
+		ctx.Stat = core.CodeStopError
+		ctx.Msg = "no common cipher suite"
+		return
+	}
+	signed, keys, err := cr.exchangeKey(suite, req.Suites, req.Shares[suite.KeyAgreement.Name()])
+	if err != nil {
+		ctx.Stat = core.CodeStopError
+		ctx.Msg = err.Error()
+		return
 	}
-	// store client shared & public keys
-	cr.setKeyStore(ctx.From, &keyStore{
-		public: &pk,
-		shared: cr.computeSharedKey(&pk),
+	signedKey, _ := json.Marshal(signed)
+	// store client public key & derived session keys
+	id, err := cr.newPendingSession(ctx.From, &keyStore{
+		state:     sessionPending,
+		suite:     suite,
+		public:    &req.PublicKey,
+		agreement: req.Agreement,
+		cur:       keys,
 	})
-	// write svr public key to response packet
+	if err != nil {
+		ctx.Stat = core.CodeStopError
+		ctx.Msg = "session id gen fail"
+		return
+	}
+	// write signed svr ephemeral key & session id to response packet
 	pw.Meta().Add(KeyNoCrypto, "true")
-	pw.Write(cr.publicKey)
+	pw.Meta().Add(KeyVersion, ProtocolVersion)
+	pw.Meta().Add(KeySession, hex.EncodeToString([]byte(id)))
+	pw.Write(signedKey)
 	ctx.Stat = core.CodeStopCloseSend
 }
 
+// keyExchangeFin completes a server key exchange, once the client has proven
+// that it has derived the session keys. Until then, the session is pending and
+// the client's address remains bound to its previous session, if any. Once
+// confirmed, the session replaces the previous one. Note that the session is
+// also established by any other packet which the client sends in the session.
+func (cr *Crypto) keyExchangeFin(ctx *core.TargetCtx, pw packet.Writer) {
+	if !checkVersion(ctx) {
+		return
+	}
+	ks, ok := cr.sessionFor(ctx)
+	if !ok {
+		return
+	}
+	sk := ks.current()
+	if _, err := decrypt(sk.aead, sk.rx, ctx.Pkt.Data(), []byte(kexFinContext)); err != nil {
+		ctx.Stat = core.CodeStopError
+		ctx.Msg = "handshake not authenticated"
+		return
+	}
+	// only the first proof binds the client's address to the session, so that
+	// a replayed proof cannot migrate it
+	if ks.transition(sessionPending, sessionEstablished) {
+		cr.migrate(ks, ctx.From)
+	}
+	pw.Meta().Add(KeyNoCrypto, "true")
+	pw.Meta().Add(KeyVersion, ProtocolVersion)
+	ctx.Stat = core.CodeStopCloseSend
+}
+
+// exchangeKey performs the server's part of a key exchange using `suite`, with
+// the client key share `share`, in which the client offered the suites
+// `offered`. A fresh ephemeral key is generated and signed with the server's
+// identity key, and the session keys are derived from it.
+func (cr *Crypto) exchangeKey(suite *Suite, offered []string, share []byte) (*SignedKey, *sessionKeys, error) {
+	if len(share) == 0 {
+		return nil, nil, fmt.Errorf("missing key share")
+	}
+	ephemeral, ephemeralPub, err := suite.KeyAgreement.GenerateKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("key gen fail")
+	}
+	secret, err := suite.KeyAgreement.SharedSecret(ephemeral, share)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid key share")
+	}
+	signed, err := signKey(cr.privKey, suite.Name, offered, share, ephemeralPub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key sign fail")
+	}
+	tx, rx := deriveKeys(secret, transcript(suite.Name, share, ephemeralPub), false)
+	return signed, newSessionKeys(suite.AEAD, tx, rx, cr.now()), nil
+}
+
+// keyExchangeClient responds with the identity key and the signed end-to-end
+// agreement key of the client at the address requested. The server is not
+// trusted with these keys: the requester verifies them itself.
 func (cr *Crypto) keyExchangeClient(ctx *core.TargetCtx, pw packet.Writer) {
+	if !checkVersion(ctx) {
+		return
+	}
 	var otherClient struct {
 		IP string `json:"ip"`
 	}
@@ -41,12 +163,48 @@ func (cr *Crypto) keyExchangeClient(ctx *core.TargetCtx, pw packet.Writer) {
 		ctx.Msg = "malformed packet"
 		return
 	}
-	if keys, ok := cr.getKeyStore(otherClient.IP); !ok {
+	if keys, ok := cr.getSession(otherClient.IP); !ok || keys.public == nil {
 		ctx.Stat = core.CodeStopError
 		ctx.Msg = "client non-existent"
+	} else if keys.agreement == nil {
+		ctx.Stat = core.CodeStopError
+		ctx.Msg = "client has no end-to-end key"
 	} else {
-		otherClientPubKey, _ := json.Marshal(keys.public)
+		otherClientKey, _ := json.Marshal(PeerKey{
+			PublicKey: *keys.public,
+			SignedKey: *keys.agreement,
+		})
 		pw.Meta().Add(KeyNoCrypto, "true")
-		pw.Write(otherClientPubKey)
+		pw.Meta().Add(KeyVersion, ProtocolVersion)
+		pw.Write(otherClientKey)
+	}
+}
+
+// sessionFor obtains the session whose ID is held by the packet in `ctx`,
+// failing the callback queue if there is no such session.
+func (cr *Crypto) sessionFor(ctx *core.TargetCtx) (*keyStore, bool) {
+	id, err := parseSessionID(ctx.Pkt.Meta().Get(KeySession))
+	if err != nil {
+		ctx.Stat = core.CodeStopError
+		ctx.Msg = err.Error()
+		return nil, false
+	}
+	ks, ok := cr.getSessionByID(id)
+	if !ok {
+		ctx.Stat = core.CodeStopError
+		ctx.Msg = "keys not exchanged"
+	}
+	return ks, ok
+}
+
+// checkVersion verifies that the key exchange packet in `ctx` uses the Crypto
+// protocol version of the server, failing the callback queue otherwise.
+func checkVersion(ctx *core.TargetCtx) bool {
+	if v := ctx.Pkt.Meta().Get(KeyVersion); v != ProtocolVersion {
+		ctx.Stat = core.CodeStopError
+		ctx.Msg = "unsupported crypto protocol version \"" + v + "\" (server uses \"" +
+			ProtocolVersion + "\")"
+		return false
 	}
+	return true
 }
@@ -0,0 +1,173 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// sidSize is the size, in bytes, of session IDs. Transport-encrypted data is
+// prefixed with the ID of the session whose keys encrypted it, in cleartext,
+// so that the receiver can find the session regardless of the address from
+// which the data was sent.
+const sidSize = 8
+
+// KeySession is a metadata key, which holds the (hex encoded) ID of the session
+// established by a server key exchange, in the response to the key exchange.
+// Clients also send it in the requests which complete the key exchange and
+// rekey the session, so that the server finds the session regardless of the
+// address from which they were sent.
+const KeySession = "_sid"
+
+// newSessionID generates a random session ID which is not in use. cr.mu must be
+// held.
+func (cr *Crypto) newSessionID() (string, error) {
+	id := make([]byte, sidSize)
+	for {
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		} else if _, exists := cr.sessions[string(id)]; !exists {
+			return string(id), nil
+		}
+	}
+}
+
+// parseSessionID decodes the hex encoded session ID `encoded`.
+func parseSessionID(encoded string) (string, error) {
+	if id, err := hex.DecodeString(encoded); err != nil || len(id) != sidSize {
+		return "", fmt.Errorf("malformed session id")
+	} else {
+		return string(id), nil
+	}
+}
+
+// newSession stores `ks` as a new session with the peer at `addr`, replacing
+// any session with `addr`, and returns the session's ID. Expired sessions are
+// swept at most once per key lifetime.
+func (cr *Crypto) newSession(addr string, ks *keyStore) (string, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	id, err := cr.newSessionID()
+	if err != nil {
+		return "", err
+	}
+	cr.setSession(id, addr, ks)
+	return id, nil
+}
+
+// newPendingSession stores `ks` as a new session with the peer at `addr` and
+// returns the session's ID. Unlike newSession, any session with `addr` is kept
+// (and `addr` remains bound to it) until the new session is confirmed by the
+// peer, at which point the new session is bound to the peer's address by
+// migrate. This way, an unauthenticated key exchange cannot tear down an
+// established session.
+func (cr *Crypto) newPendingSession(addr string, ks *keyStore) (string, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	id, err := cr.newSessionID()
+	if err != nil {
+		return "", err
+	}
+	cr.sweepIfDue()
+	ks.id, ks.addr = id, addr
+	cr.sessions[id] = ks
+	return id, nil
+}
+
+// setSession stores `ks` as the session with ID `id` with the peer at `addr`,
+// replacing any session with `addr`. cr.mu must be held.
+func (cr *Crypto) setSession(id, addr string, ks *keyStore) {
+	cr.sweepIfDue()
+	cr.removeSession(addr)
+	ks.id, ks.addr = id, addr
+	cr.sessions[id] = ks
+	cr.addrs[addr] = id
+}
+
+// sweepIfDue sweeps expired sessions, if they have not been swept during the
+// last key lifetime (or handshake timeout, if shorter). cr.mu must be held.
+func (cr *Crypto) sweepIfDue() {
+	interval := cr.handshake
+	if cr.lifetime.Duration > 0 && (interval <= 0 || cr.lifetime.Duration < interval) {
+		interval = cr.lifetime.Duration
+	}
+	if now := cr.clock.Now(); interval > 0 && now.Sub(cr.lastSweep) > interval {
+		cr.sweep(now)
+	}
+}
+
+// removeSession removes the session with the peer at `addr`, if any. cr.mu
+// must be held.
+func (cr *Crypto) removeSession(addr string) {
+	if id, ok := cr.addrs[addr]; ok {
+		delete(cr.sessions, id)
+		delete(cr.addrs, addr)
+	}
+}
+
+// abandon removes the session `ks`, if it has not already been replaced.
+func (cr *Crypto) abandon(ks *keyStore) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.sessions[ks.id] == ks {
+		cr.removeSession(ks.addr)
+	}
+}
+
+// getSession obtains the session with the peer at `addr`.
+func (cr *Crypto) getSession(addr string) (*keyStore, bool) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	ks, ok := cr.sessions[cr.addrs[addr]]
+	return ks, ok
+}
+
+// getSessionByID obtains the session with the given ID.
+func (cr *Crypto) getSessionByID(id string) (*keyStore, bool) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	ks, ok := cr.sessions[id]
+	return ks, ok
+}
+
+// migrate records that the peer of the session `ks` is now at `addr`, binding
+// `addr` to the session (which supersedes any other session with `addr`). It
+// must only be called once data from `addr` has been authenticated with the
+// session's keys, so that sessions cannot be claimed by spoofing addresses.
+func (cr *Crypto) migrate(ks *keyStore, addr string) {
+	cr.mu.RLock()
+	current := ks.addr == addr && cr.addrs[addr] == ks.id
+	cr.mu.RUnlock()
+	if current {
+		return
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if _, ok := cr.sessions[ks.id]; !ok {
+		return // session removed in the meantime
+	}
+	if cr.addrs[ks.addr] == ks.id {
+		delete(cr.addrs, ks.addr)
+	}
+	// a session with the new address is superseded by the migrating one
+	if id, ok := cr.addrs[addr]; ok && id != ks.id {
+		delete(cr.sessions, id)
+	}
+	ks.addr = addr
+	cr.addrs[addr] = ks.id
+}
+
+// setPeer sets the end-to-end session with the peer at `addr`.
+func (cr *Crypto) setPeer(addr string, ks *keyStore) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.peers[addr] = ks
+}
+
+// getPeer obtains the end-to-end session with the peer at `addr`.
+func (cr *Crypto) getPeer(addr string) (*keyStore, bool) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	ks, ok := cr.peers[addr]
+	return ks, ok
+}
@@ -0,0 +1,227 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/core/clock/clocktest"
+	"github.com/navaz-alani/concord/packet"
+)
+
+const testSvrAddr = "127.0.0.1:5000"
+
+var testPC = packet.NewJSONPktCreator(10)
+
+// newTestPeers returns a server Crypto and a client Crypto which trusts it.
+func newTestPeers(t *testing.T) (svr, cl *Crypto) {
+	svr, err := NewCrypto(newTestIdentity(t))
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	cl, err = NewCrypto(nil)
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	trust := NewTrustStore()
+	trust.Pin(testSvrAddr, &svr.privKey.PublicKey)
+	cl.SetTrustStore(trust)
+	return svr, cl
+}
+
+// call executes the server callback `cb` on the request `req`, received from
+// `from`, returning the callback's context and response.
+func call(cb core.TargetCallback, from string, req packet.Packet) (*core.TargetCtx, packet.Packet) {
+	ctx := &core.TargetCtx{
+		PipelineCtx: core.PipelineCtx{Pkt: req},
+		TargetName:  req.Meta().Get(packet.KeyTarget),
+		From:        from,
+	}
+	resp := testPC.NewPkt("", from)
+	cb(ctx, resp.Writer())
+	return ctx, resp
+}
+
+// kexCS performs the first half of a server key exchange between `cl` and
+// `svr`, from `from`, and returns the ID of the (pending) session.
+func kexCS(t *testing.T, svr, cl *Crypto, from string) string {
+	req := testPC.NewPkt("", testSvrAddr)
+	if err := cl.ConfigureKeyExServerPkt(req.Writer()); err != nil {
+		t.Fatalf("ConfigureKeyExServerPkt: %v", err)
+	}
+	ctx, resp := call(svr.keyExchangeServer, from, req)
+	if ctx.Stat != core.CodeStopCloseSend {
+		t.Fatalf("kex-cs failed: %s", ctx.Msg)
+	}
+	if err := cl.ProcessKeyExServerResp(testSvrAddr, resp); err != nil {
+		t.Fatalf("ProcessKeyExServerResp: %v", err)
+	}
+	ks, _ := cl.getSession(testSvrAddr)
+	return ks.id
+}
+
+// kexFinPkt composes the request completing the client's server key exchange.
+func kexFinPkt(t *testing.T, cl *Crypto) packet.Packet {
+	ks, _ := cl.getSession(testSvrAddr)
+	sk := ks.current()
+	proof, err := encrypt(sk.aead, sk.tx, nil, []byte(kexFinContext))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	pkt := testPC.NewPkt("", testSvrAddr)
+	pkt.Meta().Add(packet.KeyTarget, TargetKeyExchangeFin)
+	pkt.Meta().Add(KeyVersion, ProtocolVersion)
+	pkt.Meta().Add(KeySession, hex.EncodeToString([]byte(ks.id)))
+	pkt.Writer().Write(proof)
+	pkt.Writer().Close()
+	return pkt
+}
+
+func kexFin(t *testing.T, svr *Crypto, fin packet.Packet, from string) {
+	if ctx, _ := call(svr.keyExchangeFin, from, fin); ctx.Stat != core.CodeStopCloseSend {
+		t.Fatalf("kex-fin from %s failed: %s", from, ctx.Msg)
+	}
+}
+
+// boundSession returns the ID of the session bound to `addr` on `svr`.
+func boundSession(svr *Crypto, addr string) string {
+	if ks, ok := svr.getSession(addr); ok {
+		return ks.id
+	}
+	return ""
+}
+
+func TestPendingSessionKeepsEstablished(t *testing.T) {
+	const addr = "127.0.0.1:6000"
+	svr, cl := newTestPeers(t)
+	id := kexCS(t, svr, cl, addr)
+	kexFin(t, svr, kexFinPkt(t, cl), addr)
+
+	// an unconfirmed key exchange from the same address (which may well be
+	// spoofed) does not replace the established session
+	other, err := NewCrypto(nil)
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	other.SetTrustStore(cl.getTrustStore())
+	pending := kexCS(t, svr, other, addr)
+	if got := boundSession(svr, addr); got != id {
+		t.Fatalf("session bound to %s = %x, want the established session %x", addr, got, id)
+	}
+	if ks, ok := svr.getSessionByID(id); !ok || ks.getState() != sessionEstablished {
+		t.Fatal("established session removed by an unconfirmed key exchange")
+	}
+
+	// once confirmed, the new session replaces the established one
+	kexFin(t, svr, kexFinPkt(t, other), addr)
+	if got := boundSession(svr, addr); got != pending {
+		t.Fatalf("session bound to %s = %x, want the confirmed session %x", addr, got, pending)
+	}
+	if _, ok := svr.getSessionByID(id); ok {
+		t.Error("superseded session not removed")
+	}
+}
+
+func TestKeyExchangeFinFromNewAddress(t *testing.T) {
+	const oldAddr, newAddr, replayAddr = "127.0.0.1:6000", "127.0.0.1:6001", "127.0.0.1:6002"
+	svr, cl := newTestPeers(t)
+	id := kexCS(t, svr, cl, oldAddr)
+	fin := kexFinPkt(t, cl)
+	// the client's address changed during the key exchange
+	kexFin(t, svr, fin, newAddr)
+	if got := boundSession(svr, newAddr); got != id {
+		t.Fatalf("session bound to %s = %x, want %x", newAddr, got, id)
+	}
+	if got := boundSession(svr, oldAddr); got != "" {
+		t.Errorf("session %x still bound to %s", got, oldAddr)
+	}
+	// a replayed proof does not migrate the session
+	kexFin(t, svr, fin, replayAddr)
+	if got := boundSession(svr, newAddr); got != id {
+		t.Errorf("session bound to %s = %x after a replayed proof, want %x", newAddr, got, id)
+	}
+	if got := boundSession(svr, replayAddr); got != "" {
+		t.Errorf("replayed proof bound session %x to %s", got, replayAddr)
+	}
+}
+
+func TestKeyExchangeFinUnknownSession(t *testing.T) {
+	const addr = "127.0.0.1:6000"
+	svr, cl := newTestPeers(t)
+	kexCS(t, svr, cl, addr)
+	for _, sid := range []string{"", "zz", hex.EncodeToString(make([]byte, sidSize))} {
+		fin := kexFinPkt(t, cl)
+		fin.Meta().Add(KeySession, sid)
+		if ctx, _ := call(svr.keyExchangeFin, addr, fin); ctx.Stat != core.CodeStopError {
+			t.Errorf("kex-fin with session id %q succeeded", sid)
+		}
+	}
+}
+
+func TestRekeyFromNewAddress(t *testing.T) {
+	const oldAddr, newAddr = "127.0.0.1:6000", "127.0.0.1:6001"
+	svr, cl := newTestPeers(t)
+	id := kexCS(t, svr, cl, oldAddr)
+	kexFin(t, svr, kexFinPkt(t, cl), oldAddr)
+
+	ks, _ := cl.getSession(testSvrAddr)
+	_, share, err := ks.suite.KeyAgreement.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	encoded, _ := json.Marshal(rekeyRequest{Key: share})
+	cur := ks.current()
+	sealed, err := encrypt(cur.aead, cur.tx, encoded, []byte(rekeyContext))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	req := testPC.NewPkt("", testSvrAddr)
+	req.Meta().Add(packet.KeyTarget, TargetRekey)
+	req.Meta().Add(KeyVersion, ProtocolVersion)
+	req.Meta().Add(KeySession, hex.EncodeToString([]byte(id)))
+	req.Writer().Write(sealed)
+	req.Writer().Close()
+	// the rekey request is found by its session id, rather than its sender
+	if ctx, _ := call(svr.rekeyServer, newAddr, req); ctx.Stat != core.CodeStopCloseSend {
+		t.Fatalf("rekey from %s failed: %s", newAddr, ctx.Msg)
+	}
+	if svrKS, _ := svr.getSessionByID(id); svrKS.getState() != sessionRekeying {
+		t.Error("session not rekeying after a rekey request")
+	}
+}
+
+func TestPendingSessionTimeout(t *testing.T) {
+	const addr, otherAddr = "127.0.0.1:6000", "127.0.0.1:6001"
+	svr, cl := newTestPeers(t)
+	clk := clocktest.NewManual(time.Unix(0, 0))
+	svr.SetClock(clk)
+	established := kexCS(t, svr, cl, addr)
+	kexFin(t, svr, kexFinPkt(t, cl), addr)
+	// a client which never completes its key exchange
+	pending := kexCS(t, svr, cl, otherAddr)
+
+	clk.Advance(DefaultHandshakeTimeout - time.Millisecond)
+	if n := svr.Sweep(); n != 0 {
+		t.Fatalf("Sweep before the handshake timeout removed %d sessions", n)
+	}
+	clk.Advance(time.Millisecond)
+	if n := svr.Sweep(); n != 1 {
+		t.Fatalf("Sweep after the handshake timeout removed %d sessions, want 1", n)
+	}
+	if _, ok := svr.getSessionByID(pending); ok {
+		t.Error("timed out pending session not removed")
+	}
+	if _, ok := svr.getSessionByID(established); !ok {
+		t.Error("established session removed by the handshake timeout")
+	}
+
+	// timed out sessions are also swept when keys are exchanged
+	pending = kexCS(t, svr, cl, otherAddr)
+	clk.Advance(2 * DefaultHandshakeTimeout)
+	kexCS(t, svr, cl, otherAddr)
+	if _, ok := svr.getSessionByID(pending); ok {
+		t.Error("timed out pending session not swept by a key exchange")
+	}
+}
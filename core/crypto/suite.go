@@ -0,0 +1,144 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// KeyAgreement is a Diffie-Hellman function, which can be used by a cipher
+// Suite to agree on session keys. Keys are exchanged in the function's
+// standard encoding.
+type KeyAgreement interface {
+	// Name returns the name of the function.
+	Name() string
+	// GenerateKey generates a private key and returns it, along with its public
+	// key.
+	GenerateKey() (priv, pub []byte, err error)
+	// SharedSecret computes the shared secret between the private key `priv`
+	// and the peer's public key `peer`. It fails if `peer` is not a valid key.
+	SharedSecret(priv, peer []byte) ([]byte, error)
+}
+
+type p256 struct{}
+
+func (p256) Name() string { return "p256" }
+
+func (p256) GenerateKey() (priv, pub []byte, err error) {
+	key, err := ecdsa.GenerateKey(Curve, rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return scalarBytes(key), elliptic.Marshal(Curve, key.X, key.Y), nil
+}
+
+func (p256) SharedSecret(priv, peer []byte) ([]byte, error) {
+	x, y := elliptic.Unmarshal(Curve, peer)
+	if x == nil {
+		return nil, fmt.Errorf("invalid p256 key")
+	}
+	sx, _ := Curve.ScalarMult(x, y, priv)
+	// the shared secret is encoded to the full size of the curve's field so that
+	// it does not vary in length with its value
+	secret := make([]byte, (Curve.Params().BitSize+7)/8)
+	return sx.FillBytes(secret), nil
+}
+
+// scalarBytes returns the encoding of the private scalar of `key`, as used by
+// the P256 KeyAgreement.
+func scalarBytes(key *ecdsa.PrivateKey) []byte {
+	return key.D.FillBytes(make([]byte, (Curve.Params().BitSize+7)/8))
+}
+
+type x25519 struct{}
+
+func (x25519) Name() string { return "x25519" }
+
+func (x25519) GenerateKey() (priv, pub []byte, err error) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, priv); err != nil {
+		return nil, nil, err
+	}
+	if pub, err = curve25519.X25519(priv, curve25519.Basepoint); err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+func (x25519) SharedSecret(priv, peer []byte) ([]byte, error) {
+	// X25519 rejects low order points, which would yield an all-zero secret
+	return curve25519.X25519(priv, peer)
+}
+
+// The KeyAgreement functions provided by Crypto.
+var (
+	// P256 is ECDH over the NIST P-256 curve, which is also the Curve of
+	// identity keys.
+	P256 KeyAgreement = p256{}
+	// X25519 is the X25519 function of RFC 7748, which is cheaper than P256 on
+	// low-power hardware.
+	X25519 KeyAgreement = x25519{}
+)
+
+// Suite is a cipher suite: the KeyAgreement used to establish the keys of a
+// session and the AEAD scheme used to encrypt data with them. Suites are
+// negotiated by name during server key exchanges.
+type Suite struct {
+	Name         string
+	KeyAgreement KeyAgreement
+	AEAD         AEAD
+}
+
+// The cipher suites provided by Crypto.
+var (
+	SuiteP256AES256GCM = &Suite{
+		Name:         "p256-aes256gcm",
+		KeyAgreement: P256,
+		AEAD:         AES256GCM,
+	}
+	SuiteX25519ChaCha20Poly1305 = &Suite{
+		Name:         "x25519-chacha20poly1305",
+		KeyAgreement: X25519,
+		AEAD:         ChaCha20Poly1305,
+	}
+)
+
+// DefaultSuites are the cipher suites supported by a Crypto, in order of
+// preference, unless they are changed with Crypto.SetSuites.
+var DefaultSuites = []*Suite{SuiteP256AES256GCM, SuiteX25519ChaCha20Poly1305}
+
+// SetSuites sets the cipher suites supported by the Crypto, in order of
+// preference. In server key exchanges, clients offer their suites in order of
+// preference and servers select the suite which they prefer most among those
+// offered, so that the server's preference wins. This way, for instance, a
+// server can prefer X25519 and ChaCha20-Poly1305, while clients which only
+// support P-256 and AES-GCM still use those, and low-power clients can insist
+// on X25519 and ChaCha20-Poly1305 by offering nothing else.
+func (cr *Crypto) SetSuites(suites ...*Suite) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.suites = suites
+}
+
+func (cr *Crypto) getSuites() []*Suite {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.suites
+}
+
+// selectSuite returns the suite, named in `offered`, which the Crypto prefers
+// most.
+func (cr *Crypto) selectSuite(offered []string) (*Suite, bool) {
+	for _, suite := range cr.getSuites() {
+		for _, name := range offered {
+			if suite.Name == name {
+				return suite, true
+			}
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/navaz-alani/concord/core"
+)
+
+func TestSuiteNegotiation(t *testing.T) {
+	const addr = "127.0.0.1:6000"
+	p256, x25519 := SuiteP256AES256GCM, SuiteX25519ChaCha20Poly1305
+	tests := []struct {
+		name           string
+		client, server []*Suite
+		want           *Suite // nil if the key exchange fails
+	}{
+		{"both prefer x25519", []*Suite{x25519, p256}, []*Suite{x25519, p256}, x25519},
+		{"server prefers p256", []*Suite{x25519, p256}, []*Suite{p256, x25519}, p256},
+		{"server prefers x25519", []*Suite{p256, x25519}, []*Suite{x25519, p256}, x25519},
+		{"client only offers x25519", []*Suite{x25519}, []*Suite{p256, x25519}, x25519},
+		{"no common suite", []*Suite{x25519}, []*Suite{p256}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svr, cl := newTestPeers(t)
+			cl.SetSuites(tt.client...)
+			svr.SetSuites(tt.server...)
+			req := testPC.NewPkt("", testSvrAddr)
+			if err := cl.ConfigureKeyExServerPkt(req.Writer()); err != nil {
+				t.Fatalf("ConfigureKeyExServerPkt: %v", err)
+			}
+			ctx, resp := call(svr.keyExchangeServer, addr, req)
+			if tt.want == nil {
+				if ctx.Stat != core.CodeStopError || ctx.Msg != "no common cipher suite" {
+					t.Fatalf("kex-cs = status %d (%s), want \"no common cipher suite\"", ctx.Stat, ctx.Msg)
+				}
+				return
+			} else if ctx.Stat != core.CodeStopCloseSend {
+				t.Fatalf("kex-cs failed: %s", ctx.Msg)
+			}
+			if err := cl.ProcessKeyExServerResp(testSvrAddr, resp); err != nil {
+				t.Fatalf("ProcessKeyExServerResp: %v", err)
+			}
+			kexFin(t, svr, kexFinPkt(t, cl), addr)
+
+			clKS, _ := cl.getSession(testSvrAddr)
+			svrKS, _ := svr.getSession(addr)
+			if clKS.suite != tt.want || svrKS.suite != tt.want {
+				t.Fatalf("negotiated %s (client) and %s (server), want %s",
+					clKS.suite.Name, svrKS.suite.Name, tt.want.Name)
+			}
+			if got := transfer(t, cl, svr, testSvrAddr, addr, "hello"); got != "hello" {
+				t.Errorf("server decrypted %q, want %q", got, "hello")
+			}
+			if got := transfer(t, svr, cl, addr, testSvrAddr, "hello"); got != "hello" {
+				t.Errorf("client decrypted %q, want %q", got, "hello")
+			}
+		})
+	}
+}
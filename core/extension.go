@@ -21,6 +21,10 @@ type PipelineCtx struct {
 	Pkt  packet.Packet
 	Stat int
 	Msg  string
+	// Retryable marks a packet which was rejected without being acted upon (for
+	// example, by a rate limiter), so that a retry of it is processed afresh
+	// instead of being treated as a duplicate.
+	Retryable bool
 }
 
 // TransformContext is information shared by all BufferTransform functions
@@ -58,6 +62,16 @@ type DataProcessor interface {
 // TargetCallback defines the signature of a callback for a target in the server.
 type TargetCallback func(ctx *TargetCtx, pw packet.Writer)
 
+// Middleware wraps the execution of the callback queue of every target in a
+// PacketProcessor. The TargetCallback `next` executes the target's callback
+// queue (wrapped in any middleware installed after this one) and the returned
+// TargetCallback is executed in its place. A Middleware can therefore inspect
+// the TargetCtx before and after the callback queue has executed, and it may
+// short-circuit the execution (for example, when a request fails to
+// authenticate) by setting a status code on the TargetCtx and not calling
+// `next`.
+type Middleware func(next TargetCallback) TargetCallback
+
 // TargetCtx is the server's callback queue execution context. To end the
 // callback queue execution for a particular packet, TargetCallbacks should set
 // Stat to -1 and the server will terminate the execution. In such a case, the
@@ -68,10 +82,21 @@ type TargetCallback func(ctx *TargetCtx, pw packet.Writer)
 // the callback queue.
 // Each of these status codes have names, provided in the constants section of
 // the `internal` package, which are more sensible and easy to remember.
+//
+// When the packet's target is matched by a target pattern, the segments
+// captured by the pattern are available in Params (see the Param method).
 type TargetCtx struct {
 	PipelineCtx
 	TargetName string
 	From       string
+	Params     map[string]string
+}
+
+// Param returns the target name segment(s) captured under `name` by the target
+// pattern which matched the packet's target. It returns the empty string if
+// there is no such capture.
+func (ctx *TargetCtx) Param(name string) string {
+	return ctx.Params[name]
 }
 
 // PacketProcessor is used to build callback queues for different targets.
@@ -79,8 +104,22 @@ type TargetCtx struct {
 // TargetCallback functions to alter the execution of the callback queue.
 type PacketProcessor interface {
 	// AddCallback adds the given calback function to the callback queue for the
-	// given target name.
+	// given target name. The target name may be a target pattern (such as
+	// "app.*"), in which case the callback queue is executed for all targets
+	// matching the pattern which have no callback queue of their own.
+	// AddCallback panics if the target pattern is malformed (for example, if "*"
+	// is not its last segment), since such a pattern could never match.
 	AddCallback(targetName string, cb TargetCallback)
+	// NotFound sets the callback to be executed for packets whose target does
+	// not match any target, instead of failing with a "target not found" error.
+	NotFound(cb TargetCallback)
+	// Use installs the given middleware around the callback queue of every
+	// target. Middleware is executed in the order that it is installed i.e. the
+	// first middleware installed is the outermost. Middleware also wraps the
+	// NotFound callback, but it is not executed for packets whose target does
+	// not match any target when no NotFound callback is set, since Process
+	// fails with a "target not found" error without executing anything.
+	Use(mw Middleware)
 	// Process executes the callback queue for the given packet's target
 	Process(ctx *TargetCtx, pw packet.Writer) error
 }
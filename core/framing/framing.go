@@ -0,0 +1,74 @@
+// Package framing implements length-prefix message framing for stream
+// transports (such as TCP), where the boundaries of the data written are not
+// preserved when the data is read. Each frame is encoded on the wire as a
+// 4-byte, big-endian length header, followed by that many bytes of payload.
+package framing
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// HeaderSize is the size, in bytes, of the length header preceding each frame.
+const HeaderSize = 4
+
+// ErrFrameTooLarge is returned when a frame exceeds the maximum frame size. A
+// stream on which this error is encountered cannot be resynchronized and
+// should be closed.
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+// WriteFrame writes `data` to `w` as a single frame. The header and payload
+// are written with one call to w.Write so that frames from a single writer are
+// never interleaved. It returns the number of payload bytes written.
+func WriteFrame(w io.Writer, data []byte) (int, error) {
+	if uint64(len(data)) > 1<<32-1 {
+		return 0, ErrFrameTooLarge
+	}
+	buf := make([]byte, HeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[HeaderSize:], data)
+	n, err := w.Write(buf)
+	if n -= HeaderSize; n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// Reader reads frames from an underlying stream.
+type Reader struct {
+	r       *bufio.Reader
+	maxSize int
+	hdr     [HeaderSize]byte
+}
+
+// NewReader returns a Reader which reads frames of at most `maxFrameSize`
+// bytes from `r`.
+func NewReader(r io.Reader, maxFrameSize int) *Reader {
+	return &Reader{
+		r:       bufio.NewReader(r),
+		maxSize: maxFrameSize,
+	}
+}
+
+// ReadFrame blocks until a complete frame has been read from the stream and
+// returns its payload. The returned slice is owned by the caller. If the
+// stream ends in the middle of a frame, io.ErrUnexpectedEOF is returned.
+func (fr *Reader) ReadFrame() ([]byte, error) {
+	if _, err := io.ReadFull(fr.r, fr.hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(fr.hdr[:])
+	if uint64(size) > uint64(fr.maxSize) {
+		return nil, ErrFrameTooLarge
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(fr.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,132 @@
+package framing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+var testFrames = [][]byte{
+	[]byte("hello"),
+	{},
+	bytes.Repeat([]byte{0xab}, 1000),
+	[]byte("x"),
+}
+
+// encode returns the frames `frames`, written one after the other.
+func encode(t *testing.T, frames [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if n, err := WriteFrame(&buf, f); err != nil || n != len(f) {
+			t.Fatalf("WriteFrame = %d, %v; want %d, nil", n, err, len(f))
+		}
+	}
+	return buf.Bytes()
+}
+
+// readAll reads frames from `fr` until the end of the stream.
+func readAll(t *testing.T, fr *Reader) [][]byte {
+	var frames [][]byte
+	for {
+		f, err := fr.ReadFrame()
+		if err == io.EOF {
+			return frames
+		} else if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		frames = append(frames, f)
+	}
+}
+
+func checkFrames(t *testing.T, got, want [][]byte) {
+	if len(got) != len(want) {
+		t.Fatalf("read %d frames, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("frame %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReadFrameFragmented(t *testing.T) {
+	stream := encode(t, testFrames)
+	fr := NewReader(iotest.OneByteReader(bytes.NewReader(stream)), 1<<16)
+	checkFrames(t, readAll(t, fr), testFrames)
+}
+
+func TestReadFrameBatched(t *testing.T) {
+	stream := encode(t, testFrames)
+	pr, pw := io.Pipe()
+	go func() {
+		// all of the frames in a single write
+		pw.Write(stream)
+		pw.Close()
+	}()
+	checkFrames(t, readAll(t, NewReader(pr, 1<<16)), testFrames)
+}
+
+func TestReadFrameZeroLength(t *testing.T) {
+	fr := NewReader(bytes.NewReader(encode(t, [][]byte{{}})), 16)
+	f, err := fr.ReadFrame()
+	if err != nil || f == nil || len(f) != 0 {
+		t.Fatalf("ReadFrame = %q, %v; want empty frame", f, err)
+	}
+	if _, err := fr.ReadFrame(); err != io.EOF {
+		t.Fatalf("ReadFrame at end of stream = %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	stream := encode(t, [][]byte{bytes.Repeat([]byte("y"), 17)})
+	if _, err := NewReader(bytes.NewReader(stream), 16).ReadFrame(); err != ErrFrameTooLarge {
+		t.Fatalf("ReadFrame = %v, want ErrFrameTooLarge", err)
+	}
+	// the header alone is enough to reject the frame
+	var hdr [HeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[:], 1<<32-1)
+	if _, err := NewReader(bytes.NewReader(hdr[:]), 16).ReadFrame(); err != ErrFrameTooLarge {
+		t.Fatalf("ReadFrame = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	stream := encode(t, [][]byte{[]byte("truncated")})
+	for n := 1; n < len(stream); n++ {
+		fr := NewReader(iotest.OneByteReader(bytes.NewReader(stream[:n])), 16)
+		if _, err := fr.ReadFrame(); err != io.ErrUnexpectedEOF {
+			t.Errorf("ReadFrame of %d bytes = %v, want io.ErrUnexpectedEOF", n, err)
+		}
+	}
+}
+
+// shortWriter accepts at most `n` bytes per write.
+type shortWriter struct {
+	n int
+}
+
+func (w shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		return w.n, io.ErrShortWrite
+	}
+	return len(p), nil
+}
+
+func TestWriteFrameShortWrite(t *testing.T) {
+	tests := []struct {
+		accepted, want int
+	}{
+		{0, 0},
+		{HeaderSize - 1, 0},
+		{HeaderSize + 2, 2},
+	}
+	for _, tt := range tests {
+		n, err := WriteFrame(shortWriter{tt.accepted}, []byte("payload"))
+		if n != tt.want || err != io.ErrShortWrite {
+			t.Errorf("WriteFrame with %d bytes accepted = %d, %v; want %d, io.ErrShortWrite",
+				tt.accepted, n, err, tt.want)
+		}
+	}
+}
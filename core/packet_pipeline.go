@@ -10,6 +10,9 @@ import (
 type PacketPipeline struct {
 	mu             sync.RWMutex
 	callbackQueues map[string][]TargetCallback
+	routes         []*route
+	notFound       TargetCallback
+	middleware     []Middleware
 }
 
 func NewPacketPipeline() *PacketPipeline {
@@ -20,26 +23,63 @@ func NewPacketPipeline() *PacketPipeline {
 }
 
 func (pp *PacketPipeline) AddCallback(targetName string, cb TargetCallback) {
+	pattern := isPattern(targetName)
+	if pattern {
+		if err := checkPattern(targetName); err != nil {
+			panic("core: " + err.Error())
+		}
+	}
 	pp.mu.Lock()
-	pp.callbackQueues[targetName] = append(pp.callbackQueues[targetName], cb)
+	if pattern {
+		pp.addRoute(targetName, cb)
+	} else {
+		pp.callbackQueues[targetName] = append(pp.callbackQueues[targetName], cb)
+	}
+	pp.mu.Unlock()
+}
+
+func (pp *PacketPipeline) NotFound(cb TargetCallback) {
+	pp.mu.Lock()
+	pp.notFound = cb
+	pp.mu.Unlock()
+}
+
+func (pp *PacketPipeline) Use(mw Middleware) {
+	pp.mu.Lock()
+	pp.middleware = append(pp.middleware, mw)
 	pp.mu.Unlock()
 }
 
 func (pp *PacketPipeline) Process(ctx *TargetCtx, pw packet.Writer) error {
 	pp.mu.RLock()
-	pipelines, ok := pp.callbackQueues[ctx.TargetName]
+	pipelines, params, ok := pp.route(ctx.TargetName)
+	middleware := pp.middleware
 	pp.mu.RUnlock()
 	if !ok {
 		return fmt.Errorf("target not found")
 	}
-	for _, cb := range pipelines {
-		cb(ctx, pw)
-		switch ctx.Stat {
-		case CodeStopError: // stop cbq exec and return error
-			return fmt.Errorf(ctx.Msg)
-		case CodeStopNoop, CodeStopCloseSend: // stop cbq exec, no error
-			return nil
-		}
+	ctx.Params = params
+	exec := execQueue(pipelines)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		exec = middleware[i](exec)
+	}
+	exec(ctx, pw)
+	if ctx.Stat == CodeStopError { // cbq exec stopped with error
+		return fmt.Errorf(ctx.Msg)
 	}
 	return nil
 }
+
+// execQueue returns a TargetCallback which executes the given callback queue,
+// stopping when a callback sets a status code which ends execution.
+func execQueue(cbq []TargetCallback) TargetCallback {
+	return func(ctx *TargetCtx, pw packet.Writer) {
+		for _, cb := range cbq {
+			cb(ctx, pw)
+			switch ctx.Stat {
+			case CodeStopError, CodeStopNoop, CodeStopCloseSend: // stop cbq exec
+				return
+			}
+		}
+	}
+}
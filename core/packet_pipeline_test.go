@@ -0,0 +1,140 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/navaz-alani/concord/packet"
+)
+
+// traceMiddleware returns a Middleware which records its name in `trace`
+// before and after executing the rest of the pipeline.
+func traceMiddleware(name string, trace *[]string) Middleware {
+	return func(next TargetCallback) TargetCallback {
+		return func(ctx *TargetCtx, pw packet.Writer) {
+			*trace = append(*trace, name+".before")
+			next(ctx, pw)
+			*trace = append(*trace, name+".after")
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	pp := NewPacketPipeline()
+	var trace []string
+	pp.Use(traceMiddleware("a", &trace))
+	pp.Use(traceMiddleware("b", &trace))
+	pp.Use(traceMiddleware("c", &trace))
+	pp.AddCallback("app.echo", func(ctx *TargetCtx, pw packet.Writer) {
+		trace = append(trace, "cb")
+	})
+	if err := pp.Process(&TargetCtx{TargetName: "app.echo"}, nil); err != nil {
+		t.Fatalf("process error: %s", err)
+	}
+	want := []string{
+		"a.before", "b.before", "c.before",
+		"cb",
+		"c.after", "b.after", "a.after",
+	}
+	if !reflect.DeepEqual(trace, want) {
+		t.Errorf("execution order = %v, want %v", trace, want)
+	}
+}
+
+func TestMiddlewareCtx(t *testing.T) {
+	pp := NewPacketPipeline()
+	var before, after TargetCtx
+	pp.Use(func(next TargetCallback) TargetCallback {
+		return func(ctx *TargetCtx, pw packet.Writer) {
+			before = *ctx
+			next(ctx, pw)
+			after = *ctx
+		}
+	})
+	pp.AddCallback("app.:room", func(ctx *TargetCtx, pw packet.Writer) {
+		ctx.Stat = CodeStopCloseSend
+		ctx.Msg = "closed " + ctx.Param("room")
+	})
+	ctx := &TargetCtx{TargetName: "app.lobby", From: "peer"}
+	if err := pp.Process(ctx, nil); err != nil {
+		t.Fatalf("process error: %s", err)
+	}
+	if before.From != "peer" || before.Param("room") != "lobby" ||
+		before.Stat != CodeContinue || before.Msg != "" {
+		t.Errorf("ctx before queue = %+v, want routed ctx with no status", before)
+	}
+	if after.Stat != CodeStopCloseSend || after.Msg != "closed lobby" {
+		t.Errorf("ctx after queue = (%d, %q), want (%d, %q)",
+			after.Stat, after.Msg, CodeStopCloseSend, "closed lobby")
+	}
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	tests := []struct {
+		name    string
+		stat    int
+		wantErr bool
+	}{
+		{"noop", CodeStopNoop, false},
+		{"error", CodeStopError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pp := NewPacketPipeline()
+			var inner, ran bool
+			pp.Use(func(next TargetCallback) TargetCallback {
+				return func(ctx *TargetCtx, pw packet.Writer) {
+					ctx.Stat = tt.stat
+					ctx.Msg = "unauthenticated"
+				}
+			})
+			pp.Use(func(next TargetCallback) TargetCallback {
+				return func(ctx *TargetCtx, pw packet.Writer) {
+					inner = true
+					next(ctx, pw)
+				}
+			})
+			pp.AddCallback("app.echo", func(ctx *TargetCtx, pw packet.Writer) {
+				ran = true
+			})
+			err := pp.Process(&TargetCtx{TargetName: "app.echo"}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("process error = %v, want error %t", err, tt.wantErr)
+			} else if err != nil && err.Error() != "unauthenticated" {
+				t.Errorf("process error = %q, want %q", err, "unauthenticated")
+			}
+			if inner || ran {
+				t.Errorf("inner middleware ran: %t, callback queue ran: %t; want neither",
+					inner, ran)
+			}
+		})
+	}
+}
+
+func TestMiddlewareNotFound(t *testing.T) {
+	pp := NewPacketPipeline()
+	var trace []string
+	pp.Use(traceMiddleware("mw", &trace))
+	pp.AddCallback("app.echo", func(ctx *TargetCtx, pw packet.Writer) {})
+
+	// without a NotFound callback, Process fails before executing middleware
+	if err := pp.Process(&TargetCtx{TargetName: "app.missing"}, nil); err == nil ||
+		err.Error() != "target not found" {
+		t.Errorf("process error = %v, want target not found", err)
+	}
+	if len(trace) != 0 {
+		t.Errorf("middleware executed for unknown target: %v", trace)
+	}
+
+	// with a NotFound callback, middleware wraps it like any callback queue
+	pp.NotFound(func(ctx *TargetCtx, pw packet.Writer) {
+		trace = append(trace, "notFound")
+	})
+	if err := pp.Process(&TargetCtx{TargetName: "app.missing"}, nil); err != nil {
+		t.Fatalf("process error: %s", err)
+	}
+	want := []string{"mw.before", "notFound", "mw.after"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Errorf("execution order = %v, want %v", trace, want)
+	}
+}
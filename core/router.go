@@ -0,0 +1,143 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Target pattern syntax. Target names are dot-separated sequences of segments
+// (for example "app.chat.send"). A target pattern is a target name in which
+// some segments are wildcards:
+//
+//   - a segment of the form ":name" matches exactly one segment of a target
+//     name, which is captured under "name".
+//   - the segment "*", which may only be the last segment of a pattern, matches
+//     one or more trailing segments of a target name, which are captured
+//     (dot-separated) under "*".
+//
+// For example, the pattern "app.*" matches "app.echo" and "app.chat.send" and
+// the pattern "app.:room.send" matches "app.lobby.send", capturing "lobby"
+// under "room".
+const (
+	segmentSep      = "."
+	segmentParam    = ":"
+	segmentWildcard = "*"
+)
+
+// isPattern reports whether the given target name is a target pattern.
+func isPattern(targetName string) bool {
+	for _, seg := range strings.Split(targetName, segmentSep) {
+		if seg == segmentWildcard || strings.HasPrefix(seg, segmentParam) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPattern returns an error if the given target pattern is malformed i.e.
+// if it has a "*" segment other than its last segment, or a ":" segment
+// without a name.
+func checkPattern(pattern string) error {
+	segments := strings.Split(pattern, segmentSep)
+	for i, seg := range segments {
+		if seg == segmentWildcard && i != len(segments)-1 {
+			return fmt.Errorf("invalid target pattern %q: %q must be the last segment",
+				pattern, segmentWildcard)
+		} else if seg == segmentParam {
+			return fmt.Errorf("invalid target pattern %q: unnamed %q segment",
+				pattern, segmentParam)
+		}
+	}
+	return nil
+}
+
+// route is the callback queue for a target pattern.
+type route struct {
+	pattern  string
+	segments []string
+	literals int // number of non-wildcard segments in the pattern
+	cbq      []TargetCallback
+}
+
+func newRoute(pattern string) *route {
+	r := &route{
+		pattern:  pattern,
+		segments: strings.Split(pattern, segmentSep),
+	}
+	for _, seg := range r.segments {
+		if seg != segmentWildcard && !strings.HasPrefix(seg, segmentParam) {
+			r.literals++
+		}
+	}
+	return r
+}
+
+// match reports whether the given target name matches the route's pattern and
+// returns the segments captured by the pattern's wildcards.
+func (r *route) match(targetName string) (map[string]string, bool) {
+	segments := strings.Split(targetName, segmentSep)
+	var params map[string]string
+	capture := func(name, val string) {
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = val
+	}
+	for i, seg := range r.segments {
+		switch {
+		case seg == segmentWildcard && i == len(r.segments)-1:
+			if i >= len(segments) {
+				return nil, false
+			}
+			capture(segmentWildcard, strings.Join(segments[i:], segmentSep))
+			return params, true
+		case i >= len(segments):
+			return nil, false
+		case strings.HasPrefix(seg, segmentParam):
+			capture(seg[len(segmentParam):], segments[i])
+		case seg != segments[i]:
+			return nil, false
+		}
+	}
+	return params, len(segments) == len(r.segments)
+}
+
+// addRoute appends `cb` to the callback queue of the route for `pattern`,
+// creating the route if it does not exist. Routes are kept ordered by
+// precedence: routes with more literal segments come first and, amongst
+// routes with as many literal segments, the earlier registered one comes
+// first. pp.mu must be held for write.
+func (pp *PacketPipeline) addRoute(pattern string, cb TargetCallback) {
+	for _, r := range pp.routes {
+		if r.pattern == pattern {
+			r.cbq = append(r.cbq, cb)
+			return
+		}
+	}
+	r := newRoute(pattern)
+	r.cbq = append(r.cbq, cb)
+	pp.routes = append(pp.routes, r)
+	sort.SliceStable(pp.routes, func(i, j int) bool {
+		return pp.routes[i].literals > pp.routes[j].literals
+	})
+}
+
+// route returns the callback queue for the given target name, along with the
+// segments captured by the matching pattern (if any). Exact target names take
+// precedence over target patterns. If no target matches, the NotFound
+// callback is returned, if one is set. pp.mu must be held for read.
+func (pp *PacketPipeline) route(targetName string) ([]TargetCallback, map[string]string, bool) {
+	if cbq, ok := pp.callbackQueues[targetName]; ok {
+		return cbq, nil, true
+	}
+	for _, r := range pp.routes {
+		if params, ok := r.match(targetName); ok {
+			return r.cbq, params, true
+		}
+	}
+	if pp.notFound != nil {
+		return []TargetCallback{pp.notFound}, nil, true
+	}
+	return nil, nil, false
+}
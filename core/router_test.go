@@ -0,0 +1,75 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/navaz-alani/concord/packet"
+)
+
+func TestRouteMatch(t *testing.T) {
+	tests := []struct {
+		pattern, target string
+		params          map[string]string
+		ok              bool
+	}{
+		{"app.*", "app.echo", map[string]string{"*": "echo"}, true},
+		{"app.*", "app.chat.send", map[string]string{"*": "chat.send"}, true},
+		{"app.*", "app", nil, false},
+		{"app.:room.send", "app.lobby.send", map[string]string{"room": "lobby"}, true},
+		{"app.:room.send", "app.lobby.recv", nil, false},
+		{"app.:room.send", "app.lobby.send.now", nil, false},
+		{"app.:room", "app", nil, false},
+		{"app.:room.*", "app.lobby.send.now", map[string]string{"room": "lobby", "*": "send.now"}, true},
+	}
+	for _, tt := range tests {
+		params, ok := newRoute(tt.pattern).match(tt.target)
+		if ok != tt.ok || (ok && !reflect.DeepEqual(params, tt.params)) {
+			t.Errorf("%q.match(%q) = %v, %t; want %v, %t",
+				tt.pattern, tt.target, params, ok, tt.params, tt.ok)
+		}
+	}
+}
+
+func TestRoutePrecedence(t *testing.T) {
+	pp := NewPacketPipeline()
+	var hit string
+	handle := func(name string) TargetCallback {
+		return func(ctx *TargetCtx, pw packet.Writer) { hit = name }
+	}
+	pp.AddCallback("app.*", handle("app.*"))
+	pp.AddCallback("app.:room.send", handle("app.:room.send"))
+	pp.AddCallback("app.lobby.send", handle("app.lobby.send"))
+	tests := []struct{ target, want string }{
+		{"app.lobby.send", "app.lobby.send"},
+		{"app.hall.send", "app.:room.send"},
+		{"app.hall.recv", "app.*"},
+	}
+	for _, tt := range tests {
+		hit = ""
+		pp.mu.RLock()
+		cbq, _, ok := pp.route(tt.target)
+		pp.mu.RUnlock()
+		if !ok {
+			t.Errorf("no route for %q", tt.target)
+			continue
+		}
+		execQueue(cbq)(&TargetCtx{TargetName: tt.target}, nil)
+		if hit != tt.want {
+			t.Errorf("%q routed to %q, want %q", tt.target, hit, tt.want)
+		}
+	}
+}
+
+func TestAddCallbackInvalidPattern(t *testing.T) {
+	for _, pattern := range []string{"app.*.send", "*.send", "app.:.send"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("AddCallback(%q) did not panic", pattern)
+				}
+			}()
+			NewPacketPipeline().AddCallback(pattern, func(*TargetCtx, packet.Writer) {})
+		}()
+	}
+}
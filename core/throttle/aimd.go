@@ -0,0 +1,121 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+
+	"github.com/navaz-alani/concord/core/clock"
+)
+
+// Controller adjusts the outbound rate of a Throttle in response to congestion
+// signals. Its owner reports successful round-trips (or deliveries) with
+// OnSuccess and losses (such as timeouts and retransmissions) with OnLoss.
+// Controllers are safe for concurrent use.
+type Controller interface {
+	OnSuccess()
+	OnLoss()
+}
+
+// DefaultCooldown is the default minimum time between decreases of an AIMD
+// Controller's rate. It is of the order of a round-trip time, which is how long
+// a congestion event takes to show up as losses.
+const DefaultCooldown = 100 * time.Millisecond
+
+// AIMDConfig configures an AIMD Controller. Zero values are replaced with
+// defaults.
+type AIMDConfig struct {
+	// Min and Max bound the outbound packet rate. Min defaults to 1 packet per
+	// second and Max to the throughput of the Throttle when the AIMD is
+	// created.
+	Min, Max Rate
+	// Increase is added to the outbound packet rate on every success. It defaults to a
+	// hundredth of Max (at least 1 packet per second).
+	Increase Rate
+	// Decrease is the factor 0 < Decrease < 1 by which the outbound packet rate
+	// is multiplied on a loss. It defaults to 0.5.
+	Decrease float64
+	// Cooldown is the minimum time between decreases, so that a number of
+	// losses caused by the same congestion event only cut the rate once. It
+	// should be about a round-trip time and defaults to DefaultCooldown. A
+	// negative Cooldown cuts the rate on every loss.
+	Cooldown time.Duration
+	// Clock measures the cooldown. It defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// AIMD is a Controller which adjusts a Throttle's outbound packet rate using
+// additive increase and multiplicative decrease, as in TCP congestion control:
+// the rate grows linearly while the peer keeps up and is cut sharply on loss,
+// so that it converges on the rate which the path can sustain. The inbound
+// Limit, and the outbound byte rate, are left as they are.
+type AIMD struct {
+	mu      sync.Mutex // mu protects `lastCut` and the rate updates
+	th      Throttle
+	cfg     AIMDConfig
+	lastCut time.Time
+}
+
+// NewAIMD creates an AIMD Controller for `th`, configured by `cfg`.
+func NewAIMD(th Throttle, cfg AIMDConfig) *AIMD {
+	if cfg.Min < 1 {
+		cfg.Min = 1
+	}
+	if cfg.Max == 0 {
+		cfg.Max = th.Throughput()
+	}
+	if cfg.Max < cfg.Min {
+		cfg.Max = cfg.Min
+	}
+	if cfg.Increase == 0 {
+		if cfg.Increase = cfg.Max / 100; cfg.Increase < 1 {
+			cfg.Increase = 1
+		}
+	}
+	if cfg.Decrease <= 0 || cfg.Decrease >= 1 {
+		cfg.Decrease = 0.5
+	}
+	if cfg.Cooldown == 0 {
+		cfg.Cooldown = DefaultCooldown
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+	return &AIMD{
+		mu:  sync.Mutex{},
+		th:  th,
+		cfg: cfg,
+	}
+}
+
+// OnSuccess increases the outbound packet rate by the configured increment, up
+// to the configured maximum.
+func (c *AIMD) OnSuccess() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	in, out := c.th.Limits()
+	if out.Packets >= c.cfg.Max {
+		return
+	}
+	if out.Packets += c.cfg.Increase; out.Packets > c.cfg.Max {
+		out.Packets = c.cfg.Max
+	}
+	c.th.SetLimits(in, out)
+}
+
+// OnLoss multiplies the outbound packet rate by the configured decrease
+// factor, down to the configured minimum, unless it has already been decreased
+// within the cooldown.
+func (c *AIMD) OnLoss() {
+	now := c.cfg.Clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastCut) < c.cfg.Cooldown {
+		return
+	}
+	c.lastCut = now
+	in, out := c.th.Limits()
+	if out.Packets = Rate(float64(out.Packets) * c.cfg.Decrease); out.Packets < c.cfg.Min {
+		out.Packets = c.cfg.Min
+	}
+	c.th.SetLimits(in, out)
+}
@@ -0,0 +1,89 @@
+package throttle
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/core/clock/clocktest"
+)
+
+// limitsThrottle is a Throttle which only keeps track of its limits.
+type limitsThrottle struct {
+	in, out Limit
+}
+
+func (th *limitsThrottle) Throughput() Rate                    { return th.out.Packets }
+func (th *limitsThrottle) SetThroughput(rate Rate)             { th.in.Packets, th.out.Packets = rate, rate }
+func (th *limitsThrottle) ScaleThroughput(f float64)           {}
+func (th *limitsThrottle) Limits() (in, out Limit)             { return th.in, th.out }
+func (th *limitsThrottle) SetLimits(in, out Limit)             { th.in, th.out = in, out }
+func (th *limitsThrottle) ReadFrom() ([]byte, net.Addr, error) { return nil, nil, nil }
+func (th *limitsThrottle) WriteTo(data []byte, addr net.Addr) (int, error) {
+	return len(data), nil
+}
+func (th *limitsThrottle) Shutdown() {}
+
+func TestAIMDCooldown(t *testing.T) {
+	tests := []struct {
+		name     string
+		cooldown time.Duration
+		losses   []time.Duration // times of the losses, from the start
+		want     Rate
+	}{
+		{"single loss", 0, []time.Duration{0}, 500},
+		{"losses within default cooldown", 0, []time.Duration{0, time.Millisecond, DefaultCooldown / 2}, 500},
+		{"losses a default cooldown apart", 0, []time.Duration{0, DefaultCooldown}, 250},
+		{"losses within cooldown", time.Second, []time.Duration{0, DefaultCooldown}, 500},
+		{"no cooldown", -1, []time.Duration{0, 0, 0}, 125},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk := clocktest.NewManual(time.Unix(0, 0))
+			th := &limitsThrottle{Limit{Packets: 1000}, Limit{Packets: 1000}}
+			ctrl := NewAIMD(th, AIMDConfig{Cooldown: tt.cooldown, Clock: clk})
+			elapsed := time.Duration(0)
+			for _, at := range tt.losses {
+				clk.Advance(at - elapsed)
+				elapsed = at
+				ctrl.OnLoss()
+			}
+			if in, out := th.Limits(); out.Packets != tt.want || in.Packets != 1000 {
+				t.Errorf("limits = %d in, %d out; want 1000 in, %d out", in.Packets, out.Packets, tt.want)
+			}
+		})
+	}
+}
+
+func TestAIMDIncrease(t *testing.T) {
+	tests := []struct {
+		name      string
+		start     Rate
+		max       Rate
+		increase  Rate
+		successes int
+		want      Rate
+	}{
+		{"step by increase", 100, 1000, 10, 3, 130},
+		{"capped at max", 995, 1000, 10, 3, 1000},
+		{"default increase", 500, 1000, 0, 2, 520},
+		{"default increase at least 1", 10, 50, 0, 3, 13},
+		{"max defaults to throughput", 200, 0, 10, 1, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := &limitsThrottle{Limit{Packets: 1000}, Limit{Packets: tt.start, Bytes: 5000}}
+			ctrl := NewAIMD(th, AIMDConfig{Max: tt.max, Increase: tt.increase})
+			for i := 0; i < tt.successes; i++ {
+				ctrl.OnSuccess()
+			}
+			in, out := th.Limits()
+			if out.Packets != tt.want {
+				t.Errorf("outbound rate = %d, want %d", out.Packets, tt.want)
+			}
+			if in.Packets != 1000 || out.Bytes != 5000 {
+				t.Errorf("limits = %d in, %d bytes out; want 1000 in, 5000 bytes out", in.Packets, out.Bytes)
+			}
+		})
+	}
+}
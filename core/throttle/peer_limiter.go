@@ -0,0 +1,178 @@
+package throttle
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/core/clock"
+	"github.com/navaz-alani/concord/packet"
+)
+
+// KeyRetryAfter is a metadata key, which holds the number of milliseconds
+// after which a client whose request was rejected by a PeerLimiter may retry.
+const KeyRetryAfter = "_retry_after"
+
+// MsgRateLimited is the message of the pipeline status (and, with
+// PolicyReject, of the error response) of packets which a PeerLimiter has
+// rejected. Such packets are also marked as Retryable in their pipeline
+// context.
+const MsgRateLimited = "rate limit exceeded"
+
+// OverLimitPolicy determines how a PeerLimiter responds to packets from peers
+// which have exceeded their rate.
+type OverLimitPolicy uint8
+
+const (
+	// PolicyDrop drops over-limit packets silently (with a CodeStopNoop status).
+	PolicyDrop OverLimitPolicy = iota
+	// PolicyReject responds to over-limit packets with an error, which holds a
+	// retry-after hint. It only applies to PeerLimiter.Middleware.
+	PolicyReject
+)
+
+// DefaultIdleTimeout is the time after which a PeerLimiter forgets a peer from
+// which no packets have been received, unless it is changed with
+// PeerLimiter.SetIdleTimeout.
+const DefaultIdleTimeout = time.Minute
+
+// PeerLimiter limits the rate of packets received from each peer (by source
+// address) separately, using a token bucket per peer. Unlike a Throttle, which
+// limits a connection as a whole, it prevents a single noisy peer from using
+// up the server's entire budget.
+//
+// A PeerLimiter is installed on a server either as a data pipeline stage (see
+// Transform), which limits packets before they are decoded (or decrypted), or
+// as packet pipeline middleware (see Middleware). Buckets of idle peers are
+// evicted, at most once per idle timeout.
+type PeerLimiter struct {
+	mu        sync.Mutex // mu protects `peers`, `idle`, `clock` & `lastSweep`
+	rate      Rate
+	burst     int
+	policy    OverLimitPolicy
+	idle      time.Duration
+	clock     clock.Clock
+	peers     map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewPeerLimiter creates a PeerLimiter which allows each peer `rate` packets
+// per second, in bursts of up to `burst` packets. Over-limit packets are
+// handled according to `policy`.
+func NewPeerLimiter(rate Rate, burst int, policy OverLimitPolicy) *PeerLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &PeerLimiter{
+		mu:        sync.Mutex{},
+		rate:      rate,
+		burst:     burst,
+		policy:    policy,
+		idle:      DefaultIdleTimeout,
+		clock:     clock.Real,
+		peers:     make(map[string]*bucket),
+		lastSweep: clock.Real.Now(),
+	}
+}
+
+// SetIdleTimeout sets the time after which an idle peer is forgotten. A peer
+// which is forgotten before its bucket has been refilled gets a full bucket,
+// so the timeout should be at least burst/rate seconds.
+func (pl *PeerLimiter) SetIdleTimeout(d time.Duration) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.idle = d
+}
+
+// SetClock sets the Clock with which buckets are refilled and idle peers are
+// detected (clock.Real by default).
+func (pl *PeerLimiter) SetClock(clk clock.Clock) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.clock = clk
+	pl.lastSweep = clk.Now()
+}
+
+// Peers returns the number of peers being tracked.
+func (pl *PeerLimiter) Peers() int {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return len(pl.peers)
+}
+
+// Allow reports whether a packet from `addr` is within the peer's rate,
+// taking a token from its bucket if so. Otherwise, it returns how long the
+// peer should wait before retrying.
+func (pl *PeerLimiter) Allow(addr string) (bool, time.Duration) {
+	pl.mu.Lock()
+	now := pl.clock.Now()
+	if now.Sub(pl.lastSweep) > pl.idle {
+		pl.sweep(now)
+	}
+	b, ok := pl.peers[addr]
+	if !ok {
+		b = newBucket(now, float64(pl.rate), float64(pl.burst))
+		pl.peers[addr] = b
+	}
+	pl.mu.Unlock()
+	return b.allow(now)
+}
+
+// sweep evicts the buckets of idle peers. pl.mu must be held.
+func (pl *PeerLimiter) sweep(now time.Time) {
+	for addr, b := range pl.peers {
+		if b.idle(now, pl.idle) {
+			delete(pl.peers, addr)
+		}
+	}
+	pl.lastSweep = now
+}
+
+// retryAfter formats the retry-after hint `d`, in milliseconds (rounded up).
+func retryAfter(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Millisecond-1)/time.Millisecond), 10)
+}
+
+// Transform is a BufferTransform which limits the packets received from each
+// peer, for installation on a server's "_in_" data pipeline. Over-limit packets
+// are always dropped in the data stage, whatever the PeerLimiter's policy:
+// since they have not been decoded, an error response could not be matched to
+// the request (by its ref) anyway.
+func (pl *PeerLimiter) Transform(ctx *core.TransformContext, buff []byte) []byte {
+	if ctx.From == "" { // not an incoming packet
+		return buff
+	}
+	if ok, _ := pl.Allow(ctx.From); !ok {
+		ctx.Stat = core.CodeStopNoop
+		ctx.Msg = MsgRateLimited
+		ctx.Retryable = true
+	}
+	return buff
+}
+
+// Middleware is packet pipeline middleware which limits the packets received
+// from each peer. With PolicyReject, over-limit packets get an error response,
+// which holds the retry-after hint (in milliseconds) under KeyRetryAfter.
+// Either way, over-limit packets are marked as Retryable.
+func (pl *PeerLimiter) Middleware(next core.TargetCallback) core.TargetCallback {
+	return func(ctx *core.TargetCtx, pw packet.Writer) {
+		ok, wait := pl.Allow(ctx.From)
+		if ok {
+			next(ctx, pw)
+			return
+		}
+		if pl.policy == PolicyReject {
+			// an error response, which (unlike a CodeStopError status) can hold
+			// metadata
+			pw.Meta().Add(packet.KeySvrStatus, "-1")
+			pw.Meta().Add(packet.KeySvrMsg, MsgRateLimited)
+			pw.Meta().Add(KeyRetryAfter, retryAfter(wait))
+			ctx.Stat = core.CodeStopCloseSend
+		} else {
+			ctx.Stat = core.CodeStopNoop
+			ctx.Msg = MsgRateLimited
+		}
+		ctx.Retryable = true
+	}
+}
@@ -0,0 +1,172 @@
+package throttle
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/core/clock/clocktest"
+	"github.com/navaz-alani/concord/packet"
+)
+
+func TestPeerLimiterRefill(t *testing.T) {
+	const a, b = "127.0.0.1:6000", "127.0.0.1:6001"
+	clk := clocktest.NewManual(time.Unix(0, 0))
+	pl := NewPeerLimiter(10, 2, PolicyDrop)
+	pl.SetClock(clk)
+	tests := []struct {
+		advance time.Duration
+		addr    string
+		allowed bool
+		wait    time.Duration
+	}{
+		// a burst, after which packets are spaced out at the rate
+		{0, a, true, 0},
+		{0, a, true, 0},
+		{0, a, false, 100 * time.Millisecond},
+		// peers are limited separately
+		{0, b, true, 0},
+		{99 * time.Millisecond, a, false, time.Millisecond},
+		{time.Millisecond, a, true, 0},
+		{0, a, false, 100 * time.Millisecond},
+		// buckets are refilled up to the burst size
+		{time.Hour, a, true, 0},
+		{0, a, true, 0},
+		{0, a, false, 100 * time.Millisecond},
+	}
+	elapsed := time.Duration(0)
+	for i, tt := range tests {
+		clk.Advance(tt.advance)
+		elapsed += tt.advance
+		allowed, wait := pl.Allow(tt.addr)
+		if allowed != tt.allowed || wait != tt.wait {
+			t.Errorf("%d: Allow(%s) after %v = %t, %v; want %t, %v",
+				i, tt.addr, elapsed, allowed, wait, tt.allowed, tt.wait)
+		}
+	}
+}
+
+func TestPeerLimiterEviction(t *testing.T) {
+	const a, b, c = "127.0.0.1:6000", "127.0.0.1:6001", "127.0.0.1:6002"
+	const idle = time.Minute
+	clk := clocktest.NewManual(time.Unix(0, 0))
+	pl := NewPeerLimiter(1, 1, PolicyDrop)
+	pl.SetClock(clk)
+	pl.SetIdleTimeout(idle)
+	pl.Allow(a)
+	pl.Allow(b)
+	clk.Advance(idle / 2)
+	pl.Allow(b)
+	// peers are only evicted once an idle timeout has passed since the last
+	// sweep
+	clk.Advance(idle / 2)
+	pl.Allow(c)
+	if n := pl.Peers(); n != 3 {
+		t.Fatalf("%d peers tracked before the first sweep, want 3", n)
+	}
+	clk.Advance(time.Nanosecond)
+	pl.Allow(c)
+	if n := pl.Peers(); n != 2 {
+		t.Fatalf("%d peers tracked after the idle peer was swept, want 2", n)
+	}
+	// the evicted peer is tracked afresh when it returns
+	if ok, _ := pl.Allow(a); !ok {
+		t.Error("evicted peer not allowed a packet")
+	}
+	if n := pl.Peers(); n != 3 {
+		t.Errorf("%d peers tracked after the evicted peer returned, want 3", n)
+	}
+}
+
+func TestPeerLimiterTransform(t *testing.T) {
+	const a = "127.0.0.1:6000"
+	clk := clocktest.NewManual(time.Unix(0, 0))
+	// over-limit packets are dropped in the data stage, whatever the policy
+	pl := NewPeerLimiter(1, 1, PolicyReject)
+	pl.SetClock(clk)
+	tests := []struct {
+		from      string
+		stat      int
+		retryable bool
+	}{
+		{a, core.CodeContinue, false},
+		{a, core.CodeStopNoop, true},
+		{"", core.CodeContinue, false}, // outgoing packets are not limited
+	}
+	for i, tt := range tests {
+		buff := []byte("data")
+		ctx := &core.TransformContext{PipelineName: "_in_", From: tt.from}
+		if out := pl.Transform(ctx, buff); !bytes.Equal(out, buff) {
+			t.Errorf("%d: Transform changed the buffer to %q", i, out)
+		}
+		msg := ""
+		if tt.retryable {
+			msg = MsgRateLimited
+		}
+		if ctx.Stat != tt.stat || ctx.Msg != msg || ctx.Retryable != tt.retryable {
+			t.Errorf("%d: Transform from %q set (%d, %q, %t), want (%d, %q, %t)", i, tt.from,
+				ctx.Stat, ctx.Msg, ctx.Retryable, tt.stat, msg, tt.retryable)
+		}
+	}
+}
+
+func TestPeerLimiterMiddleware(t *testing.T) {
+	const a = "127.0.0.1:6000"
+	pc := packet.NewJSONPktCreator(10)
+	tests := []struct {
+		policy OverLimitPolicy
+		stat   int
+		msg    string
+	}{
+		{PolicyDrop, core.CodeStopNoop, MsgRateLimited},
+		{PolicyReject, core.CodeStopCloseSend, ""},
+	}
+	for _, tt := range tests {
+		clk := clocktest.NewManual(time.Unix(0, 0))
+		pl := NewPeerLimiter(3, 1, tt.policy) // a token every 333.33ms
+		pl.SetClock(clk)
+		executed := 0
+		exec := pl.Middleware(func(ctx *core.TargetCtx, pw packet.Writer) {
+			executed++
+		})
+		// the retry-after hint is in milliseconds, rounded up
+		for i, want := range []struct {
+			advance    time.Duration
+			retryAfter string
+		}{
+			{0, ""},
+			{0, "334"},
+			{100 * time.Millisecond, "234"},
+		} {
+			clk.Advance(want.advance)
+			resp := pc.NewPkt("", "")
+			ctx := &core.TargetCtx{TargetName: "app.echo", From: a}
+			exec(ctx, resp.Writer())
+			if want.retryAfter == "" {
+				if executed != 1 || ctx.Stat != core.CodeContinue || ctx.Retryable {
+					t.Errorf("policy %d, %d: packet within the limit not executed", tt.policy, i)
+				}
+				continue
+			}
+			if executed != 1 {
+				t.Errorf("policy %d, %d: over-limit packet executed", tt.policy, i)
+			}
+			if ctx.Stat != tt.stat || ctx.Msg != tt.msg || !ctx.Retryable {
+				t.Errorf("policy %d, %d: ctx = (%d, %q, %t), want (%d, %q, true)", tt.policy, i,
+					ctx.Stat, ctx.Msg, ctx.Retryable, tt.stat, tt.msg)
+			}
+			meta := resp.Meta()
+			if tt.policy == PolicyDrop {
+				if meta.Get(KeyRetryAfter) != "" || meta.Get(packet.KeySvrStatus) != "" {
+					t.Errorf("policy %d, %d: dropped packet has a response", tt.policy, i)
+				}
+			} else if meta.Get(packet.KeySvrStatus) != "-1" || meta.Get(packet.KeySvrMsg) != MsgRateLimited ||
+				meta.Get(KeyRetryAfter) != want.retryAfter {
+				t.Errorf("policy %d, %d: response (%q, %q, retry after %q), want (%q, %q, retry after %q)",
+					tt.policy, i, meta.Get(packet.KeySvrStatus), meta.Get(packet.KeySvrMsg),
+					meta.Get(KeyRetryAfter), "-1", MsgRateLimited, want.retryAfter)
+			}
+		}
+	}
+}
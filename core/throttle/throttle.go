@@ -1,6 +1,10 @@
 package throttle
 
-import "net"
+import (
+	"errors"
+	"net"
+	"time"
+)
 
 // Rate is the Throttle throughput parameter - measured in data packets per
 // second (dpps).
@@ -14,18 +18,63 @@ const (
 	Rate100K = 100_000
 )
 
+// Limit is the rate limit of one direction (reads or writes) of a Throttle.
+// Packets is the number of packets per second, which is at least 1. Bytes is
+// the number of bytes per second, with 0 meaning that the number of bytes is
+// not limited. An operation waits until both limits allow it.
+type Limit struct {
+	Packets Rate
+	Bytes   uint64
+}
+
+// normal returns the Limit with its packet rate at a minimum of 1 packet per
+// second.
+func (l Limit) normal() Limit {
+	l.Packets = scale(l.Packets, 1)
+	return l
+}
+
+// duration returns the time which an operation on `n` bytes takes at the rates
+// of the Limit (the "time per operation").
+func (l Limit) duration(n int) time.Duration {
+	tpo := time.Duration(sec / int64(l.Packets))
+	if l.Bytes > 0 {
+		if btpo := time.Duration(uint64(n) * uint64(sec) / l.Bytes); btpo > tpo {
+			tpo = btpo
+		}
+	}
+	return tpo
+}
+
+// ErrClosed is returned by Throttle operations after the Throttle has been shut
+// down.
+var ErrClosed = errors.New("throttle closed")
+
 // Throttle controls read/write operation over a connection in order to prevent
-// congestion. There is a `throughput` parameter, which is a `Rate` (data
-// packets per second). The Throttle owner can modify this parameter by either
-// setting an exact value or scaling the current value by a particular factor
-// 0 < `f` <= 1, using the {set,scale}Throughput methods respectively.
+// congestion. Reads (inbound) and writes (outbound) are limited independently,
+// each by a Limit on packets per second and, optionally, bytes per second (see
+// {Set,}Limits). Both directions start out with the same packet rate, the
+// initial throughput.
+//
+// The `throughput` parameter is a `Rate` (data packets per second). Throughput
+// returns the outbound packet rate. The Throttle owner can modify the packet
+// rates of both directions by either setting an exact value or scaling the
+// current values by a particular factor `f` > 0 (0 < `f` < 1 slows the
+// Throttle down), using the {Set,Scale}Throughput methods respectively. The
+// packet rates never drop below 1 packet per second. A Controller (such as
+// AIMD) can be used to adjust the outbound rate automatically.
 //
 // Note: Throttle does not own the underlying connection that it is managing.
 // The creator of that connection is responsible for closing the connection.
 type Throttle interface {
 	Throughput() Rate
 	SetThroughput(rate Rate)
-	ScaleThroughput(f uint8)
+	ScaleThroughput(f float64)
+
+	// Limits returns the inbound (read) and outbound (write) limits.
+	Limits() (in, out Limit)
+	// SetLimits sets the inbound (read) and outbound (write) limits.
+	SetLimits(in, out Limit)
 
 	// ReadFrom reads a packet from the underlying connection and returns the data
 	// read, the sender address and any error encountered.
@@ -37,3 +86,31 @@ type Throttle interface {
 	// Shutdown sends a kill signal and purges the Throttle's resources.
 	Shutdown()
 }
+
+// scale returns `rate` scaled by the factor `f`, at a minimum of 1 packet per
+// second.
+func scale(rate Rate, f float64) Rate {
+	if scaled := Rate(float64(rate) * f); scaled >= 1 {
+		return scaled
+	}
+	return 1
+}
+
+// Factory creates a Throttle for the connection `conn`, with the throughput
+// `initialRate`, which reads data into buffers of size `readBuffSize`. Servers
+// and clients are given a Factory to select their Throttle implementation.
+type Factory func(initialRate Rate, conn *net.UDPConn, readBuffSize int) Throttle
+
+// SleepFactory creates UDPThrottles, which sleep after every operation so that
+// each one takes at least 1/throughput seconds.
+func SleepFactory(initialRate Rate, conn *net.UDPConn, readBuffSize int) Throttle {
+	return NewUDPThrottle(initialRate, conn, readBuffSize)
+}
+
+// TokenBucketFactory returns a Factory which creates TokenBucketThrottles with
+// the given burst size.
+func TokenBucketFactory(burst int) Factory {
+	return func(initialRate Rate, conn *net.UDPConn, readBuffSize int) Throttle {
+		return NewTokenBucketThrottle(initialRate, burst, conn, readBuffSize)
+	}
+}
@@ -0,0 +1,161 @@
+package throttle
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/core/clock/clocktest"
+)
+
+// benchRate is the throughput of the benchmarked Throttles, and benchBurst the
+// burst size of TokenBucketThrottles (and the number of packets sent in a
+// burst by the burst benchmarks).
+const (
+	benchRate  Rate = Rate100K
+	benchBurst      = 16
+)
+
+// newTestConns returns a loopback connection, for a Throttle to use, and a
+// loopback connection for its peer. The connections are closed when the test
+// ends.
+func newTestConns(tb testing.TB) (conn, peer *net.UDPConn) {
+	loopback := &net.UDPAddr{IP: []byte{127, 0, 0, 1}}
+	conn, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		tb.Fatalf("listen: %v", err)
+	}
+	peer, err = net.ListenUDP("udp", loopback)
+	if err != nil {
+		tb.Fatalf("listen: %v", err)
+	}
+	tb.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return conn, peer
+}
+
+// delayTolerance is how long before its expected delay an operation is checked
+// to still be waiting, by checkDelays.
+const delayTolerance = time.Microsecond
+
+// checkDelays runs `op` once for every delay in `want`, checking that the i'th
+// run is delayed by want[i] on `clk`: a delayed run must be waiting on the
+// clock's only timer, which does not fire until the delay has elapsed, and
+// must be done once it has. Runs which are not delayed must be done without
+// the clock being advanced.
+func checkDelays(t *testing.T, clk *clocktest.Manual, op func() error, want []time.Duration) {
+	t.Helper()
+	for i, delay := range want {
+		done := make(chan error, 1)
+		go func() { done <- op() }()
+		if delay > 0 {
+			clk.BlockUntil(1)
+			if n := clk.Timers(); n != 1 {
+				t.Fatalf("operation %d: %d timers pending, want 1", i+1, n)
+			}
+			clk.Advance(delay - delayTolerance)
+			if clk.Timers() != 1 {
+				t.Fatalf("operation %d done within %v, want a delay of %v", i+1, delay-delayTolerance, delay)
+			}
+			clk.Advance(delayTolerance)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("operation %d: %v", i+1, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("operation %d not done after a delay of %v", i+1, delay)
+		}
+	}
+}
+
+// newBenchThrottle creates a Throttle with `newThrottle`, for a connection from
+// newTestConns, returning it along with the address to write to (which is
+// never read).
+func newBenchThrottle(b *testing.B, newThrottle Factory) (Throttle, net.Addr) {
+	conn, peer := newTestConns(b)
+	th := newThrottle(benchRate, conn, 1024)
+	b.Cleanup(th.Shutdown)
+	return th, peer.LocalAddr()
+}
+
+// benchmarkWrite measures the throughput of sequential writes.
+func benchmarkWrite(b *testing.B, newThrottle Factory) {
+	th, to := newBenchThrottle(b, newThrottle)
+	data := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if _, err := th.WriteTo(data, to); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "pkts/s")
+}
+
+// benchmarkWriteParallel measures the throughput of concurrent writes.
+func benchmarkWriteParallel(b *testing.B, newThrottle Factory) {
+	th, to := newBenchThrottle(b, newThrottle)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		data := make([]byte, 64)
+		for pb.Next() {
+			if _, err := th.WriteTo(data, to); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "pkts/s")
+}
+
+// benchmarkBurstLatency measures the latency of bursts of benchBurst writes,
+// sent at an average rate below the Throttle's throughput: every burst is
+// followed by (untimed) idle time, long enough to send the burst at
+// benchRate.
+func benchmarkBurstLatency(b *testing.B, newThrottle Factory) {
+	th, to := newBenchThrottle(b, newThrottle)
+	data := make([]byte, 64)
+	idle := time.Duration(benchBurst) * time.Second / time.Duration(benchRate)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchBurst; j++ {
+			if _, err := th.WriteTo(data, to); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		time.Sleep(idle)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkUDPThrottleWrite(b *testing.B) {
+	benchmarkWrite(b, SleepFactory)
+}
+
+func BenchmarkTokenBucketThrottleWrite(b *testing.B) {
+	benchmarkWrite(b, TokenBucketFactory(benchBurst))
+}
+
+func BenchmarkUDPThrottleWriteParallel(b *testing.B) {
+	benchmarkWriteParallel(b, SleepFactory)
+}
+
+func BenchmarkTokenBucketThrottleWriteParallel(b *testing.B) {
+	benchmarkWriteParallel(b, TokenBucketFactory(benchBurst))
+}
+
+func BenchmarkUDPThrottleBurstLatency(b *testing.B) {
+	benchmarkBurstLatency(b, SleepFactory)
+}
+
+func BenchmarkTokenBucketThrottleBurstLatency(b *testing.B) {
+	benchmarkBurstLatency(b, TokenBucketFactory(benchBurst))
+}
@@ -0,0 +1,325 @@
+package throttle
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/navaz-alani/concord/core/clock"
+)
+
+// bucket is a token bucket, which holds up to `burst` tokens and is refilled
+// at `rate` tokens per second. Tokens are reserved ahead of time, so the
+// bucket may go into debt (negative tokens), which later reservations wait
+// out.
+type bucket struct {
+	mu     sync.Mutex // mu protects all of the bucket's fields
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time // time of the last refill
+}
+
+func newBucket(now time.Time, rate, burst float64) *bucket {
+	b := &bucket{
+		mu:   sync.Mutex{},
+		last: now,
+	}
+	b.rate, b.burst = clamp(rate), clamp(burst)
+	b.tokens = b.burst
+	return b
+}
+
+// clamp returns `v` at a minimum of 1, since a bucket which is never refilled
+// (or can never hold a whole token) would block forever.
+func clamp(v float64) float64 {
+	if v < 1 {
+		return 1
+	}
+	return v
+}
+
+// refill adds the tokens accumulated since the last refill. b.mu must be held.
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// reserve takes `n` tokens from the bucket and returns how long the caller
+// must wait before using them.
+func (b *bucket) reserve(now time.Time, n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow takes a token from the bucket if one is available. Otherwise, it
+// returns how long it will take for a token to become available.
+func (b *bucket) allow(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// idle reports whether the bucket has not been used for at least `d` at `now`.
+func (b *bucket) idle(now time.Time, d time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.last) >= d
+}
+
+// set changes the refill rate and the capacity of the bucket, from `now` on.
+func (b *bucket) set(now time.Time, rate, burst float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.rate, b.burst = clamp(rate), clamp(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// limiter limits one direction (reads or writes) of a TokenBucketThrottle,
+// with a bucket of packets and, if the Limit has a byte rate, a bucket of
+// bytes. The byte bucket holds as many bytes as can be sent in the time that
+// it takes to refill the packet bucket.
+type limiter struct {
+	limit   Limit
+	burst   int
+	packets *bucket
+	bytes   *bucket // nil if the number of bytes is not limited
+}
+
+func newLimiter(now time.Time, limit Limit, burst int) *limiter {
+	l := &limiter{
+		burst:   burst,
+		packets: newBucket(now, 0, float64(burst)),
+	}
+	l.set(now, limit)
+	return l
+}
+
+// set changes the Limit of the limiter, from `now` on.
+func (l *limiter) set(now time.Time, limit Limit) {
+	l.limit = limit.normal()
+	l.packets.set(now, float64(l.limit.Packets), float64(l.burst))
+	if l.limit.Bytes == 0 {
+		l.bytes = nil
+		return
+	}
+	rate := float64(l.limit.Bytes)
+	burst := rate * float64(l.burst) / float64(l.limit.Packets)
+	if l.bytes == nil {
+		l.bytes = newBucket(now, rate, burst)
+	} else {
+		l.bytes.set(now, rate, burst)
+	}
+}
+
+// TokenBucketThrottle is a Throttle which limits reads and writes (separately)
+// with token buckets. Each operation takes a token and tokens are refilled at
+// the packet rate of the direction's Limit, up to a `burst` number of tokens. Unlike UDPThrottle,
+// which makes every operation take at least 1/throughput seconds, operations
+// only wait once the burst has been used up, so bursty workloads whose
+// average rate is below the throughput are not delayed. Writes are not
+// serialised either: concurrent writes proceed concurrently, as long as there
+// are tokens.
+//
+// Limits on the number of bytes are enforced after the fact: an operation
+// which uses up more than the available bytes goes through, but delays
+// subsequent operations until the byte bucket has been refilled.
+type TokenBucketThrottle struct {
+	mu        sync.RWMutex // mu protects the limiters' limits and byte buckets
+	reads     *limiter
+	writes    *limiter
+	rbuffSize int
+	conn      *net.UDPConn
+	clock     clock.Clock
+	recv      chan *readPkt
+	done      chan struct{} // closed on Shutdown
+	closeOnce sync.Once
+}
+
+// NewTokenBucketThrottle creates a TokenBucketThrottle for `conn`, which
+// allows bursts of up to `burst` reads and `burst` writes. A burst of 1
+// spaces operations out evenly, like UDPThrottle (without charging the
+// duration of the operation itself).
+func NewTokenBucketThrottle(initialRate Rate, burst int, conn *net.UDPConn,
+	readBuffSize int) *TokenBucketThrottle {
+	return NewTokenBucketThrottleWithClock(initialRate, burst, conn, readBuffSize, clock.Real)
+}
+
+// NewTokenBucketThrottleWithClock creates a TokenBucketThrottle which refills
+// its buckets and waits for tokens with `clk`.
+func NewTokenBucketThrottleWithClock(initialRate Rate, burst int, conn *net.UDPConn,
+	readBuffSize int, clk clock.Clock) *TokenBucketThrottle {
+	if burst < 1 {
+		burst = 1
+	}
+	now := clk.Now()
+	th := &TokenBucketThrottle{
+		mu:        sync.RWMutex{},
+		reads:     newLimiter(now, Limit{Packets: initialRate}, burst),
+		writes:    newLimiter(now, Limit{Packets: initialRate}, burst),
+		rbuffSize: readBuffSize,
+		conn:      conn,
+		clock:     clk,
+		recv:      make(chan *readPkt, 100),
+		done:      make(chan struct{}),
+	}
+	go th.read()
+	return th
+}
+
+// Shutdown stops the Throttle's routines. Pending and subsequent ReadFrom and
+// WriteTo calls return ErrClosed. Note that the read routine may be blocked in
+// a read on the connection until the connection is closed by its owner.
+func (th *TokenBucketThrottle) Shutdown() {
+	th.closeOnce.Do(func() { close(th.done) })
+}
+
+func (th *TokenBucketThrottle) Throughput() Rate {
+	th.mu.RLock()
+	defer th.mu.RUnlock()
+	return th.writes.limit.Packets
+}
+
+func (th *TokenBucketThrottle) SetThroughput(rate Rate) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	now := th.clock.Now()
+	for _, l := range []*limiter{th.reads, th.writes} {
+		limit := l.limit
+		limit.Packets = rate
+		l.set(now, limit)
+	}
+}
+
+func (th *TokenBucketThrottle) ScaleThroughput(f float64) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	now := th.clock.Now()
+	for _, l := range []*limiter{th.reads, th.writes} {
+		limit := l.limit
+		limit.Packets = scale(limit.Packets, f)
+		l.set(now, limit)
+	}
+}
+
+func (th *TokenBucketThrottle) Limits() (in, out Limit) {
+	th.mu.RLock()
+	defer th.mu.RUnlock()
+	return th.reads.limit, th.writes.limit
+}
+
+func (th *TokenBucketThrottle) SetLimits(in, out Limit) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	now := th.clock.Now()
+	th.reads.set(now, in)
+	th.writes.set(now, out)
+}
+
+// wait waits until a packet of `n` bytes can be passed by `l`, or the Throttle
+// is shut down. The size of the packet is not always known beforehand (as with
+// reads), in which case `n` is zero and its bytes are charged with charge once
+// it is known.
+func (th *TokenBucketThrottle) wait(l *limiter, n int) error {
+	select {
+	case <-th.done:
+		return ErrClosed
+	default:
+	}
+	now := th.clock.Now()
+	th.mu.RLock()
+	delay := l.packets.reserve(now, 1)
+	if l.bytes != nil && n > 0 {
+		if bdelay := l.bytes.reserve(now, float64(n)); bdelay > delay {
+			delay = bdelay
+		}
+	}
+	th.mu.RUnlock()
+	return th.sleep(delay)
+}
+
+// charge takes `n` bytes from the byte bucket of `l` (if it has one) and waits
+// until they can be used, or the Throttle is shut down.
+func (th *TokenBucketThrottle) charge(l *limiter, n int) error {
+	th.mu.RLock()
+	var delay time.Duration
+	if l.bytes != nil && n > 0 {
+		delay = l.bytes.reserve(th.clock.Now(), float64(n))
+	}
+	th.mu.RUnlock()
+	return th.sleep(delay)
+}
+
+// sleep waits for `delay`, or until the Throttle is shut down.
+func (th *TokenBucketThrottle) sleep(delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	timer := th.clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-th.done:
+		return ErrClosed
+	case <-timer.C():
+		return nil
+	}
+}
+
+func (th *TokenBucketThrottle) ReadFrom() ([]byte, net.Addr, error) {
+	select {
+	case <-th.done:
+		return nil, nil, ErrClosed
+	case pkt := <-th.recv:
+		return pkt.data, pkt.sender, pkt.err
+	}
+}
+
+func (th *TokenBucketThrottle) WriteTo(data []byte, addr net.Addr) (int, error) {
+	if err := th.wait(th.writes, len(data)); err != nil {
+		return 0, err
+	}
+	return th.conn.WriteTo(data, addr)
+}
+
+func (th *TokenBucketThrottle) read() {
+	rbuff := make([]byte, th.rbuffSize)
+	for {
+		if err := th.wait(th.reads, 0); err != nil {
+			return
+		}
+		n, senderAddr, err := th.conn.ReadFromUDP(rbuff)
+		if err := th.charge(th.reads, n); err != nil {
+			return
+		}
+		data := make([]byte, n)
+		copy(data, rbuff)
+		select {
+		case <-th.done:
+			return
+		case th.recv <- &readPkt{
+			data:   data,
+			sender: senderAddr,
+			err:    err,
+		}:
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package throttle
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/core/clock/clocktest"
+)
+
+// newTestTokenBucketThrottle creates a TokenBucketThrottle with the limits
+// `in` and `out` and the burst size `burst`, which uses a Manual clock, for a
+// connection from newTestConns. It returns the Throttle and its clock, along
+// with the connection of its peer.
+func newTestTokenBucketThrottle(t *testing.T, burst int,
+	in, out Limit) (*TokenBucketThrottle, *clocktest.Manual, *net.UDPConn) {
+	conn, peer := newTestConns(t)
+	clk := clocktest.NewManual(time.Unix(0, 0))
+	th := NewTokenBucketThrottleWithClock(Rate1k, burst, conn, 1024, clk)
+	th.SetLimits(in, out)
+	t.Cleanup(th.Shutdown)
+	return th, clk, peer
+}
+
+func TestTokenBucketThrottleLimits(t *testing.T) {
+	// Reads wait for a token before reading from the connection, so the wait
+	// for a read's token starts when the previous packet is read. Bytes are
+	// charged once their number is known: before a write, or after a read.
+	tests := []struct {
+		name          string
+		burst         int
+		in, out       Limit
+		reads, writes []time.Duration // delays of successive operations
+	}{
+		{
+			"packet rates", 1,
+			Limit{Packets: 10}, Limit{Packets: 100},
+			[]time.Duration{0, 100 * time.Millisecond, 100 * time.Millisecond},
+			[]time.Duration{0, 10 * time.Millisecond, 10 * time.Millisecond},
+		},
+		{
+			"packet rates with bursts", 2,
+			Limit{Packets: 10}, Limit{Packets: 100},
+			[]time.Duration{0, 0, 100 * time.Millisecond, 100 * time.Millisecond},
+			[]time.Duration{0, 0, 10 * time.Millisecond, 10 * time.Millisecond},
+		},
+		{
+			// the byte buckets hold 2 and 20 bytes
+			"byte rates", 2,
+			Limit{Packets: 1000, Bytes: 1000}, Limit{Packets: 1000, Bytes: 10_000},
+			[]time.Duration{98 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond},
+			[]time.Duration{8 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond},
+		},
+		{
+			// the outbound byte bucket holds 10 bytes
+			"packet and byte rates", 2,
+			Limit{Packets: 10, Bytes: 1_000_000}, Limit{Packets: 1000, Bytes: 5000},
+			[]time.Duration{0, 0, 100 * time.Millisecond, 100 * time.Millisecond},
+			[]time.Duration{18 * time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond},
+		},
+	}
+	data := make([]byte, 100)
+	for _, tt := range tests {
+		t.Run(tt.name+"/reads", func(t *testing.T) {
+			th, clk, peer := newTestTokenBucketThrottle(t, tt.burst, tt.in, tt.out)
+			to := th.conn.LocalAddr()
+			checkDelays(t, clk, func() error {
+				if _, err := peer.WriteTo(data, to); err != nil {
+					return err
+				}
+				_, _, err := th.ReadFrom()
+				return err
+			}, tt.reads)
+		})
+		t.Run(tt.name+"/writes", func(t *testing.T) {
+			th, clk, peer := newTestTokenBucketThrottle(t, tt.burst, tt.in, tt.out)
+			checkDelays(t, clk, func() error {
+				_, err := th.WriteTo(data, peer.LocalAddr())
+				return err
+			}, tt.writes)
+		})
+	}
+}
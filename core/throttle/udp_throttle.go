@@ -1,10 +1,11 @@
 package throttle
 
 import (
-	"fmt"
 	"net"
 	"sync"
 	"time"
+
+	"github.com/navaz-alani/concord/core/clock"
 )
 
 const sec int64 = 1_000_000_000 // 10^9 - nanoseconds in a second
@@ -26,76 +27,114 @@ type writeStatus struct {
 	err     error
 }
 
+// UDPThrottle is a Throttle which sleeps after every operation, so that each
+// read takes at least as long as the inbound Limit allows and each write takes
+// at least as long as the outbound Limit allows.
 type UDPThrottle struct {
-	mu        sync.RWMutex // mu protects `rate` and `tpo` from concurrent operations
-	rate      Rate         // throttle throughput
-	tpo       int64        // tpo is "time per operation" - computed from the `rate`
+	mu        sync.RWMutex // mu protects `in` and `out` from concurrent operations
+	in        Limit        // read limit
+	out       Limit        // write limit
 	rbuffSize int
 	conn      *net.UDPConn
+	clock     clock.Clock
 	// internal _buffered_ channels for packet processing
-	recv           chan *readPkt
-	send           chan *writePkt
-	done           chan bool
-	activeRoutines int
+	recv      chan *readPkt
+	send      chan *writePkt
+	done      chan struct{} // closed on Shutdown
+	closeOnce sync.Once
 }
 
 func NewUDPThrottle(initialRate Rate, conn *net.UDPConn, readBuffSize int) *UDPThrottle {
+	return NewUDPThrottleWithClock(initialRate, conn, readBuffSize, clock.Real)
+}
+
+// NewUDPThrottleWithClock creates a UDPThrottle which measures and sleeps out
+// the duration of operations with `clk`.
+func NewUDPThrottleWithClock(initialRate Rate, conn *net.UDPConn, readBuffSize int,
+	clk clock.Clock) *UDPThrottle {
+	limit := Limit{Packets: initialRate}.normal()
 	th := &UDPThrottle{
 		mu:        sync.RWMutex{},
-		rate:      initialRate,
-		tpo:       sec / int64(initialRate),
+		in:        limit,
+		out:       limit,
 		rbuffSize: readBuffSize,
 		conn:      conn,
+		clock:     clk,
 		recv:      make(chan *readPkt, 100),
 		send:      make(chan *writePkt, 100),
+		done:      make(chan struct{}),
 	}
 	go th.read()
 	go th.write()
-	th.activeRoutines += 2
 	return th
 }
 
+// Shutdown stops the Throttle's routines. Pending and subsequent ReadFrom and
+// WriteTo calls return ErrClosed. Note that the read routine may be blocked in
+// a read on the connection until the connection is closed by its owner.
 func (th *UDPThrottle) Shutdown() {
-	// stop all routines
-	for i := 0; i < th.activeRoutines; i++ {
-		th.done <- true
-	}
+	th.closeOnce.Do(func() { close(th.done) })
 }
 
 func (th *UDPThrottle) Throughput() Rate {
 	th.mu.RLock()
 	defer th.mu.RUnlock()
-	return th.rate
+	return th.out.Packets
 }
 
 func (th *UDPThrottle) SetThroughput(rate Rate) {
 	th.mu.Lock()
 	defer th.mu.Unlock()
-	th.rate = rate
-	th.tpo = sec / int64(rate)
+	th.in.Packets = scale(rate, 1)
+	th.out.Packets = th.in.Packets
+}
+
+func (th *UDPThrottle) ScaleThroughput(f float64) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.in.Packets = scale(th.in.Packets, f)
+	th.out.Packets = scale(th.out.Packets, f)
 }
 
-func (th *UDPThrottle) ScaleThroughput(f uint8) {
+func (th *UDPThrottle) Limits() (in, out Limit) {
+	th.mu.RLock()
+	defer th.mu.RUnlock()
+	return th.in, th.out
+}
+
+func (th *UDPThrottle) SetLimits(in, out Limit) {
 	th.mu.Lock()
 	defer th.mu.Unlock()
-	th.rate = Rate(int64(th.rate) * int64(f))
-	th.tpo = sec / int64(th.rate)
+	th.in = in.normal()
+	th.out = out.normal()
 }
 
 func (th *UDPThrottle) ReadFrom() ([]byte, net.Addr, error) {
-	pkt := <-th.recv
-	return pkt.data, pkt.sender, pkt.err
+	select {
+	case <-th.done:
+		return nil, nil, ErrClosed
+	case pkt := <-th.recv:
+		return pkt.data, pkt.sender, pkt.err
+	}
 }
 
 func (th *UDPThrottle) WriteTo(data []byte, addr net.Addr) (int, error) {
-	respCh := make(chan *writeStatus)
-	th.send <- &writePkt{
+	respCh := make(chan *writeStatus, 1)
+	select {
+	case <-th.done:
+		return 0, ErrClosed
+	case th.send <- &writePkt{
 		data:   data,
 		to:     addr,
 		respCh: respCh,
+	}:
+	}
+	select {
+	case <-th.done:
+		return 0, ErrClosed
+	case status := <-respCh:
+		return status.written, status.err
 	}
-	status := <-respCh
-	return status.written, status.err
 }
 
 func (th *UDPThrottle) read() {
@@ -107,16 +146,20 @@ func (th *UDPThrottle) read() {
 			return
 		default:
 			{
-				start = time.Now()
+				start = th.clock.Now()
 				n, senderAddr, err := th.conn.ReadFromUDP(rbuff)
 				data := make([]byte, n)
 				copy(data, rbuff)
-				th.recv <- &readPkt{
+				select {
+				case <-th.done:
+					return
+				case th.recv <- &readPkt{
 					data:   data,
 					sender: senderAddr,
 					err:    err,
+				}:
 				}
-				th.throttleOperation(time.Now().Sub(start))
+				th.throttleOperation(&th.in, n, th.clock.Now().Sub(start))
 			}
 		}
 	}
@@ -130,26 +173,26 @@ func (th *UDPThrottle) write() {
 			return
 		case pkt := <-th.send:
 			{
-				start = time.Now()
+				start = th.clock.Now()
 				n, err := th.conn.WriteTo(pkt.data, pkt.to)
 				pkt.respCh <- &writeStatus{
 					written: n,
 					err:     err,
 				}
-				th.throttleOperation(time.Now().Sub(start))
+				th.throttleOperation(&th.out, n, th.clock.Now().Sub(start))
 			}
 		}
 	}
 }
 
-// throttleOperation ensures that a read/write operation takes at least as long
-// as what is spcefied by the `rate` parameter of the Throttle.
-func (th *UDPThrottle) throttleOperation(dur time.Duration) {
+// throttleOperation ensures that a read/write operation on `n` bytes, which
+// took `dur`, takes at least as long as what is specified by `limit`, which is
+// one of the Throttle's limits.
+func (th *UDPThrottle) throttleOperation(limit *Limit, n int, dur time.Duration) {
 	th.mu.RLock()
-	tpo := th.tpo
+	tpo := limit.duration(n)
 	th.mu.RUnlock()
-	if remainingTime := tpo - dur.Nanoseconds(); remainingTime > 0 {
-		sleepDur, _ := time.ParseDuration(fmt.Sprintf("%dns", remainingTime))
-		time.Sleep(sleepDur)
+	if remainingTime := tpo - dur; remainingTime > 0 {
+		th.clock.Sleep(remainingTime)
 	}
 }
@@ -0,0 +1,72 @@
+package throttle
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/core/clock/clocktest"
+)
+
+// newTestUDPThrottle creates a UDPThrottle with the limits `in` and `out`,
+// which uses a Manual clock, for a connection from newTestConns. It returns
+// the Throttle and its clock, along with the connection of its peer.
+func newTestUDPThrottle(t *testing.T, in, out Limit) (*UDPThrottle, *clocktest.Manual, *net.UDPConn) {
+	conn, peer := newTestConns(t)
+	clk := clocktest.NewManual(time.Unix(0, 0))
+	th := NewUDPThrottleWithClock(Rate1k, conn, 1024, clk)
+	th.SetLimits(in, out)
+	t.Cleanup(func() {
+		th.Shutdown()
+		clk.Advance(time.Hour) // wake routines sleeping out an operation
+	})
+	return th, clk, peer
+}
+
+func TestUDPThrottleLimits(t *testing.T) {
+	tests := []struct {
+		name          string
+		in, out       Limit
+		reads, writes []time.Duration // delays of successive operations
+	}{
+		{
+			"packet rates",
+			Limit{Packets: 10}, Limit{Packets: 100},
+			[]time.Duration{0, 100 * time.Millisecond, 100 * time.Millisecond},
+			[]time.Duration{0, 10 * time.Millisecond, 10 * time.Millisecond},
+		},
+		{
+			"byte rates",
+			Limit{Packets: 1000, Bytes: 1000}, Limit{Packets: 1000, Bytes: 10_000},
+			[]time.Duration{0, 100 * time.Millisecond, 100 * time.Millisecond},
+			[]time.Duration{0, 10 * time.Millisecond, 10 * time.Millisecond},
+		},
+		{
+			"packet and byte rates",
+			Limit{Packets: 10, Bytes: 1_000_000}, Limit{Packets: 1000, Bytes: 5000},
+			[]time.Duration{0, 100 * time.Millisecond, 100 * time.Millisecond},
+			[]time.Duration{0, 20 * time.Millisecond, 20 * time.Millisecond},
+		},
+	}
+	data := make([]byte, 100)
+	for _, tt := range tests {
+		t.Run(tt.name+"/reads", func(t *testing.T) {
+			th, clk, peer := newTestUDPThrottle(t, tt.in, tt.out)
+			to := th.conn.LocalAddr()
+			checkDelays(t, clk, func() error {
+				if _, err := peer.WriteTo(data, to); err != nil {
+					return err
+				}
+				_, _, err := th.ReadFrom()
+				return err
+			}, tt.reads)
+		})
+		t.Run(tt.name+"/writes", func(t *testing.T) {
+			th, clk, peer := newTestUDPThrottle(t, tt.in, tt.out)
+			checkDelays(t, clk, func() error {
+				_, err := th.WriteTo(data, peer.LocalAddr())
+				return err
+			}, tt.writes)
+		})
+	}
+}
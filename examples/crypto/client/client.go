@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
 	"log"
 	"net"
 
@@ -12,6 +15,9 @@ import (
 )
 
 var (
+	serverKey = flag.String("server-key", "crypto-server.pub",
+		"file containing the server's identity key")
+
 	rate throttle.Rate = throttle.Rate10k
 	pc                 = packet.NewJSONPktCreator(int(rate) / 2)
 
@@ -29,12 +35,32 @@ var (
 	}
 )
 
-func createSecureClient(listenAddr *net.UDPAddr) (cl client.Client, cr *crypto.Crypto) {
+// loadTrustStore returns a TrustStore in which the server's identity key, read
+// from the `serverKey` file, is pinned.
+func loadTrustStore() *crypto.TrustStore {
+	encoded, err := ioutil.ReadFile(*serverKey)
+	if err != nil {
+		log.Fatalf("server key read err: %s", err.Error())
+	}
+	var pk crypto.PublicKey
+	if err := json.Unmarshal(encoded, &pk); err != nil {
+		log.Fatalf("server key decode err: %s", err.Error())
+	}
+	identityKey, err := crypto.ParseIdentityKey(pk)
+	if err != nil {
+		log.Fatalf("server key err: %s", err.Error())
+	}
+	trust := crypto.NewTrustStore()
+	trust.Pin(svrAddr.String(), identityKey)
+	return trust
+}
+
+func createSecureClient(listenAddr *net.UDPAddr, trust *crypto.TrustStore) (cl client.Client, cr *crypto.Crypto) {
 	var err error
 	if cl, err = client.NewUDPClient(svrAddr, listenAddr, 4096, pc, rate); err != nil {
 		log.Fatalf("client init err: %s", err.Error())
 	}
-	if cr, err = crypto.ConfigureClient(cl, svrAddr.String(), pc.NewPkt("", svrAddr.String())); err != nil {
+	if cr, err = crypto.ConfigureClient(cl, svrAddr.String(), trust, pc.NewPkt("", svrAddr.String())); err != nil {
 		log.Fatalf("crypto err: %s", err.Error())
 	}
 	return cl, cr
@@ -51,9 +77,11 @@ func makeRelayPkt(to string, msg string) packet.Packet {
 }
 
 func main() {
+	flag.Parse()
+	trust := loadTrustStore()
 	// instantiate secure clients
-	clientA, crA := createSecureClient(clientA_Addr)
-	clientB, crB := createSecureClient(clientB_Addr)
+	clientA, crA := createSecureClient(clientA_Addr, trust)
+	clientB, crB := createSecureClient(clientB_Addr, trust)
 
 	// perform key-exchange between clients
 	if err := crA.ClientKEx(clientA, clientB_Addr.String(), pc.NewPkt("", svrAddr.String())); err != nil {
@@ -61,6 +89,14 @@ func main() {
 	} else if err = crB.ClientKEx(clientA, clientA_Addr.String(), pc.NewPkt("", svrAddr.String())); err != nil {
 		log.Fatalf("clientB kex fail: %s\n", err.Error())
 	}
+	// verify the clients' identity keys (which would be done out of band)
+	if snA, err := crA.SafetyNumber(clientB_Addr.String()); err != nil {
+		log.Fatalf("clientA safety number err: %s\n", err.Error())
+	} else if snB, _ := crB.SafetyNumber(clientA_Addr.String()); snA != snB {
+		log.Fatalf("safety numbers differ: %s != %s\n", snA, snB)
+	} else {
+		log.Printf("safety number: %s\n", snA)
+	}
 
 	// initiate clientB misc packet listener
 	go func() {
@@ -1,9 +1,9 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/rand"
 	"encoding/json"
+	"flag"
+	"io/ioutil"
 	"log"
 	"net"
 	"time"
@@ -15,7 +15,15 @@ import (
 	"github.com/navaz-alani/concord/server"
 )
 
+var (
+	identityFile = flag.String("identity", "crypto-server.key",
+		"file holding the server's (private) identity key, created if it does not exist")
+	identityOut = flag.String("identity-out", "crypto-server.pub",
+		"file to which the server's identity key is written")
+)
+
 func main() {
+	flag.Parse()
 	// instantiate server
 	addr := &net.UDPAddr{
 		IP:   []byte{0, 0, 0, 0},
@@ -28,10 +36,11 @@ func main() {
 		log.Fatalln("Failed to initialize server: ", err.Error())
 	}
 
-	// generate private key
-	privKey, err := ecdsa.GenerateKey(crypto.Curve, rand.Reader)
+	// load private key, so that clients which have pinned the server's identity
+	// key can still connect after a restart
+	privKey, err := crypto.LoadOrCreateIdentityKey(*identityFile)
 	if err != nil {
-		log.Fatalln("Failed to generate public key: " + err.Error())
+		log.Fatalln("Failed to load identity key: " + err.Error())
 	}
 	// initialize Crypto extension
 	cr, err := crypto.NewCrypto(privKey)
@@ -40,6 +49,12 @@ func main() {
 	}
 	// install extension on server pipelines
 	cr.Extend("server", svr)
+	// publish the server's identity key, which clients use to verify key
+	// exchanges with the server
+	identityKey, _ := json.Marshal(cr.IdentityKey())
+	if err := ioutil.WriteFile(*identityOut, identityKey, 0644); err != nil {
+		log.Fatalln("Failed to write identity key: " + err.Error())
+	}
 
 	var requestsServed int
 
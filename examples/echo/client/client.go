@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
 
@@ -33,8 +34,10 @@ func main() {
 	reqComposer.Close()                                  // commit changes to req packet
 
 	// send packet and wait for response
-	respCh := make(chan packet.Packet) // create chanel on which to receive response
-	client.Send(req, respCh)           // send packet
-	resp := <-respCh                   // wait till response arrives
+	resp, err := client.Request(context.Background(), req)
+	if err != nil {
+		log.Fatalln("Request failed: ", err.Error())
+	}
+	defer pc.PutBack(resp)
 	log.Println("Got response: ", string(resp.Data()))
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	throttle "github.com/navaz-alani/concord/core/throttle"
+)
+
+var (
+	rate    = flag.Uint64("rate", throttle.Rate1k, "throttle throughput (packets per second)")
+	burst   = flag.Int("burst", 100, "token bucket burst size")
+	bursts  = flag.Int("bursts", 20, "number of bursts in the latency benchmark")
+	burstSz = flag.Int("burst-size", 50, "number of packets in each burst of the latency benchmark")
+	packets = flag.Int("packets", 2000, "number of packets in the throughput benchmark")
+	writers = flag.Int("writers", 4, "number of concurrent writers in the throughput benchmark")
+	bytes   = flag.Uint64("bytes", 0, "outbound byte limit (bytes per second, 0 for none)")
+)
+
+// sink returns the address of a UDP socket which discards everything it reads.
+func sink() *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: []byte{127, 0, 0, 1}})
+	if err != nil {
+		log.Fatalf("sink err: %s", err.Error())
+	}
+	go func() {
+		buff := make([]byte, 2048)
+		for {
+			if _, _, err := conn.ReadFrom(buff); err != nil {
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// newThrottle creates a Throttle over a new UDP socket, using `factory`.
+func newThrottle(factory throttle.Factory) throttle.Throttle {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: []byte{127, 0, 0, 1}})
+	if err != nil {
+		log.Fatalf("conn err: %s", err.Error())
+	}
+	th := factory(throttle.Rate(*rate), conn, 2048)
+	if *bytes > 0 {
+		in, out := th.Limits()
+		out.Bytes = *bytes
+		th.SetLimits(in, out)
+	}
+	return th
+}
+
+// latency sends bursts of packets, with each burst spread out over enough time
+// that the average rate is half of the throughput, and returns the latencies
+// of the writes.
+func latency(th throttle.Throttle, to *net.UDPAddr) []time.Duration {
+	var latencies []time.Duration
+	data := make([]byte, 512)
+	interval := 2 * time.Duration(*burstSz) * time.Second / time.Duration(*rate)
+	for i := 0; i < *bursts; i++ {
+		start := time.Now()
+		for j := 0; j < *burstSz; j++ {
+			opStart := time.Now()
+			if _, err := th.WriteTo(data, to); err != nil {
+				log.Fatalf("write err: %s", err.Error())
+			}
+			latencies = append(latencies, time.Since(opStart))
+		}
+		time.Sleep(interval - time.Since(start))
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies
+}
+
+// throughput sends packets from concurrent writers as fast as the Throttle
+// allows, and returns the number of packets sent per second.
+func throughput(th throttle.Throttle, to *net.UDPAddr) float64 {
+	var wg sync.WaitGroup
+	data := make([]byte, 512)
+	start := time.Now()
+	for w := 0; w < *writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < *packets / *writers; i++ {
+				if _, err := th.WriteTo(data, to); err != nil {
+					log.Fatalf("write err: %s", err.Error())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return float64(*packets / *writers * *writers) / time.Since(start).Seconds()
+}
+
+// Compares the latency and throughput of the sleep-per-operation UDPThrottle
+// and the TokenBucketThrottle, on loopback.
+func main() {
+	flag.Parse()
+	to := sink()
+	designs := []struct {
+		name    string
+		factory throttle.Factory
+	}{
+		{"sleep", throttle.SleepFactory},
+		{fmt.Sprintf("token-bucket(%d)", *burst), throttle.TokenBucketFactory(*burst)},
+	}
+	fmt.Printf("rate %d pps, bursts of %d packets at half the rate, %d concurrent writers\n",
+		*rate, *burstSz, *writers)
+	fmt.Printf("%-20s %12s %12s %12s %14s\n", "throttle", "p50", "p99", "max", "throughput")
+	for _, design := range designs {
+		th := newThrottle(design.factory)
+		lat := latency(th, to)
+		pps := throughput(th, to)
+		th.Shutdown()
+		fmt.Printf("%-20s %12s %12s %12s %10.0f pps\n", design.name,
+			lat[len(lat)/2], lat[len(lat)*99/100], lat[len(lat)-1], pps)
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/navaz-alani/concord
 
-go 1.14
+go 1.15
+
+require golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
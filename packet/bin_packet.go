@@ -0,0 +1,152 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// BinPkt is a compact binary Packet implementation. On the wire, it is encoded
+// as a sequence of uvarint-length-prefixed fields:
+//
+//	<num-meta> { <len><key> <len><val> }* <len><data>
+//
+// where <num-meta> is the number of metadata entries (as a uvarint). Unlike
+// JSONPkt, the packet data is written as is, without any base64 encoding.
+type BinPkt struct {
+	mu   sync.RWMutex
+	data []byte // committed packet data - updated on Close
+	buff bytes.Buffer
+	meta *KVMeta
+	dest string
+}
+
+func (p *BinPkt) SetDest(dest string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dest = dest
+}
+
+func (p *BinPkt) Dest() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.dest
+}
+
+func (p *BinPkt) Writer() Writer { return p }
+
+func (p *BinPkt) Meta() Metadata {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.meta
+}
+
+func (p *BinPkt) Data() []byte {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.buff.Bytes()
+}
+
+func (p *BinPkt) Marshal() (bin []byte, err error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	p.meta.mu.RLock()
+	size := binary.MaxVarintLen64 * (2*len(p.meta.meta) + 2)
+	for k, v := range p.meta.meta {
+		size += len(k) + len(v)
+	}
+	bin = make([]byte, 0, size+len(p.data))
+	bin = appendUvarint(bin, uint64(len(p.meta.meta)))
+	for k, v := range p.meta.meta {
+		bin = appendField(bin, []byte(k))
+		bin = appendField(bin, []byte(v))
+	}
+	p.meta.mu.RUnlock()
+	return appendField(bin, p.data), nil
+}
+
+// Unmarshal decodes the binary data into the packet `p`.
+func (p *BinPkt) Unmarshal(bin []byte) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	numMeta, n := binary.Uvarint(bin)
+	if n <= 0 {
+		return fmt.Errorf("malformed metadata length")
+	}
+	bin = bin[n:]
+	// each metadata entry takes up at least two bytes
+	if numMeta > uint64(len(bin)/2) {
+		return fmt.Errorf("malformed metadata length")
+	}
+	meta := make(map[string]string, numMeta)
+	var key, val []byte
+	for i := uint64(0); i < numMeta; i++ {
+		if key, bin, err = readField(bin); err != nil {
+			return fmt.Errorf("malformed metadata key: " + err.Error())
+		}
+		if val, bin, err = readField(bin); err != nil {
+			return fmt.Errorf("malformed metadata value: " + err.Error())
+		}
+		meta[string(key)] = string(val)
+	}
+	data, bin, err := readField(bin)
+	if err != nil {
+		return fmt.Errorf("malformed data: " + err.Error())
+	} else if len(bin) != 0 {
+		return fmt.Errorf("trailing bytes after data")
+	}
+	// unpack metadata & data into packet
+	p.meta.setMeta(meta)
+	p.data = append(p.data[:0], data...)
+	p.buff.Reset()
+	p.buff.Write(data)
+	return nil
+}
+
+func (p *BinPkt) Clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buff.Reset()
+}
+
+func (p *BinPkt) Write(data []byte) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.buff.Write(data)
+}
+
+// Close commits the data written to the buffer to the underlying packet.
+func (p *BinPkt) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.data = append(p.data[:0], p.buff.Bytes()...)
+	return nil
+}
+
+// appendUvarint appends the uvarint encoding of `x` to `bin`.
+func appendUvarint(bin []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(bin, buf[:n]...)
+}
+
+// appendField appends the uvarint-length-prefixed `field` to `bin`.
+func appendField(bin, field []byte) []byte {
+	return append(appendUvarint(bin, uint64(len(field))), field...)
+}
+
+// readField reads a uvarint-length-prefixed field from `bin` and returns the
+// field and the remaining bytes.
+func readField(bin []byte) (field, rest []byte, err error) {
+	size, n := binary.Uvarint(bin)
+	if n <= 0 {
+		return nil, bin, fmt.Errorf("bad length prefix")
+	} else if size > uint64(len(bin)-n) {
+		return nil, bin, fmt.Errorf("field length exceeds packet size")
+	}
+	bin = bin[n:]
+	return bin[:size], bin[size:], nil
+}
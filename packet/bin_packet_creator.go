@@ -0,0 +1,53 @@
+package packet
+
+import "sync"
+
+// BinPktCreator implements a PacketCreator for the BinPkt type.
+type BinPktCreator struct {
+	pool *sync.Pool
+}
+
+// NewBinPktCreator initializes and returns a BinPktCreator with an underlying
+// packet pool size of `numPkts`.
+func NewBinPktCreator(numPkts int) PacketCreator {
+	pc := &BinPktCreator{
+		pool: &sync.Pool{
+			New: func() interface{} {
+				return &BinPkt{
+					mu:   sync.RWMutex{},
+					meta: NewKVMeta(),
+				}
+			},
+		},
+	}
+	pc.Warmup(numPkts)
+	return pc
+}
+
+func (pc *BinPktCreator) Warmup(numPackets int) {
+	for i := 0; i < numPackets; i++ {
+		pc.pool.Put(pc.pool.New())
+	}
+}
+
+func (pc *BinPktCreator) PutBack(pkt Packet) {
+	pc.pool.Put(pkt)
+}
+
+func (pc *BinPktCreator) NewPkt(ref, dest string) Packet {
+	pkt := pc.pool.Get().(*BinPkt)
+	pkt.meta.Clear()
+	pkt.buff.Reset()
+	pkt.data = pkt.data[:0]
+	pkt.dest = dest
+	pkt.Meta().Add(KeyRef, ref)
+	return pkt
+}
+
+func (pc *BinPktCreator) NewErrPkt(ref, dest, msg string) Packet {
+	pkt := pc.NewPkt(ref, dest)
+	// set reponse's error metadata
+	pkt.Meta().Add(KeySvrStatus, "-1")
+	pkt.Meta().Add(KeySvrMsg, msg)
+	return pkt
+}
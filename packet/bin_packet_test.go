@@ -0,0 +1,139 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// newTestPkt composes a packet with the given metadata and data, using `pc`.
+func newTestPkt(pc PacketCreator, meta map[string]string, data []byte) Packet {
+	pkt := pc.NewPkt("", "")
+	pkt.Meta().Clear()
+	for k, v := range meta {
+		pkt.Meta().Add(k, v)
+	}
+	pw := pkt.Writer()
+	pw.Write(data)
+	pw.Close()
+	return pkt
+}
+
+func TestBinPktRoundTrip(t *testing.T) {
+	pc := NewBinPktCreator(0)
+	tests := []struct {
+		name string
+		meta map[string]string
+		data []byte
+	}{
+		{"empty", nil, nil},
+		{"empty data", map[string]string{KeyRef: "abc", KeyTarget: "app.echo"}, nil},
+		{"empty metadata", nil, []byte("hello")},
+		{"empty values", map[string]string{"": "", "k": ""}, []byte{0}},
+		{"binary data", map[string]string{KeyTarget: "app.bin"}, []byte{0, 1, 2, 0xff, 0x80}},
+		{"large data", map[string]string{KeyRef: "r"}, bytes.Repeat([]byte("x"), 1<<16)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin, err := newTestPkt(pc, tt.meta, tt.data).Marshal()
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			pkt := pc.NewPkt("", "")
+			if err := pkt.Unmarshal(bin); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if !bytes.Equal(pkt.Data(), tt.data) {
+				t.Errorf("data = %q, want %q", pkt.Data(), tt.data)
+			}
+			if keys := pkt.Meta().Keys(); len(keys) != len(tt.meta) {
+				t.Errorf("metadata keys = %q, want %d keys", keys, len(tt.meta))
+			}
+			for k, v := range tt.meta {
+				if got := pkt.Meta().Get(k); got != v {
+					t.Errorf("metadata %q = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestBinPktUnmarshalMalformed(t *testing.T) {
+	pc := NewBinPktCreator(0)
+	valid, err := newTestPkt(pc, map[string]string{KeyRef: "abc"}, []byte("hello")).Marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	hugeNumMeta := appendUvarint(nil, 1<<62)
+	hugeNumMeta = appendField(hugeNumMeta, []byte("k"))
+	hugeNumMeta = appendField(hugeNumMeta, []byte("v"))
+	hugeField := appendUvarint(nil, 0)
+	hugeField = appendUvarint(hugeField, 1<<40)
+	tests := []struct {
+		name string
+		bin  []byte
+	}{
+		{"empty input", nil},
+		{"bad varint", bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64+1)},
+		{"huge numMeta", hugeNumMeta},
+		{"huge field length", hugeField},
+		{"missing data", appendUvarint(nil, 0)},
+		{"trailing bytes", append(append([]byte{}, valid...), 0)},
+	}
+	for i := 1; i < len(valid); i++ {
+		tests = append(tests, struct {
+			name string
+			bin  []byte
+		}{"truncated", valid[:i]})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := pc.NewPkt("", "").Unmarshal(tt.bin); err == nil {
+				t.Errorf("Unmarshal(%x) succeeded, want error", tt.bin)
+			}
+		})
+	}
+}
+
+// benchPkt returns a typical request packet, composed with `pc`, and its
+// encoding.
+func benchPkt(b *testing.B, pc PacketCreator) (Packet, []byte) {
+	pkt := newTestPkt(pc, map[string]string{
+		KeyRef:    "a1b2c",
+		KeyTarget: "app.chat.send",
+		"_sid":    "0123456789abcdef",
+	}, bytes.Repeat([]byte("concord "), 64))
+	bin, err := pkt.Marshal()
+	if err != nil {
+		b.Fatalf("marshal: %v", err)
+	}
+	return pkt, bin
+}
+
+func benchmarkMarshal(b *testing.B, pc PacketCreator) {
+	pkt, _ := benchPkt(b, pc)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pkt.Marshal(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkUnmarshal(b *testing.B, pc PacketCreator) {
+	pkt, bin := benchPkt(b, pc)
+	b.SetBytes(int64(len(bin)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := pkt.Unmarshal(bin); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBinPktMarshal(b *testing.B)    { benchmarkMarshal(b, NewBinPktCreator(1)) }
+func BenchmarkJSONPktMarshal(b *testing.B)   { benchmarkMarshal(b, NewJSONPktCreator(1)) }
+func BenchmarkBinPktUnmarshal(b *testing.B)  { benchmarkUnmarshal(b, NewBinPktCreator(1)) }
+func BenchmarkJSONPktUnmarshal(b *testing.B) { benchmarkUnmarshal(b, NewJSONPktCreator(1)) }
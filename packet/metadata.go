@@ -1,6 +1,9 @@
 package packet
 
-import "sync"
+import (
+	"sort"
+	"sync"
+)
 
 // KVMeta is a concurrency-safe Metadata implementation.
 type KVMeta struct {
@@ -27,6 +30,24 @@ func (m *KVMeta) Get(key string) (val string) {
 	return m.meta[key]
 }
 
+// Keys returns the keys defined in the metadata, in sorted order.
+func (m *KVMeta) Keys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.meta))
+	for k := range m.meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *KVMeta) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.meta, key)
+}
+
 func (m *KVMeta) setMeta(meta map[string]string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -8,12 +8,20 @@ const (
 	KeySvrMsg           = "_msg"
 	KeyRef              = "_ref"
 	KeyTarget           = "_tgt"
+	// KeyRelayFrom and KeyRelayTo are the relay source and destination of
+	// packets relayed by servers (see server.TargetRelay).
+	KeyRelayFrom = "_relay_src"
+	KeyRelayTo   = "_relay_dst"
 )
 
 // Metadata defines a key-value metadata store for Packets.
 type Metadata interface {
 	Add(key, val string)
 	Get(key string) (val string)
+	// Keys returns the keys defined in the metadata, in sorted order.
+	Keys() []string
+	// Delete removes the given key from the metadata.
+	Delete(key string)
 	Clear()
 }
 
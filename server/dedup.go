@@ -0,0 +1,98 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/navaz-alani/concord/packet"
+)
+
+// dedupKey identifies a request by its sender and ref.
+type dedupKey struct {
+	from string
+	ref  string
+}
+
+// dedupEntry is the record of a request which has been received by the server.
+// `resp` is the encoded response to the request and is nil while the request
+// is still being processed, or if the request did not produce a response to
+// its sender (for example, if it was relayed).
+type dedupEntry struct {
+	resp    []byte
+	expires time.Time
+}
+
+// dedupCache suppresses duplicate requests, such as those retransmitted by
+// clients which did not receive a response in time. Requests are keyed on
+// their (sender, ref) pair and remembered for `ttl`. The response to a request
+// is cached so that it can be replayed to the sender of a duplicate, instead of
+// executing the target's callback queue again.
+type dedupCache struct {
+	mu        sync.Mutex // mu protects `entries` and `lastSweep`
+	ttl       time.Duration
+	entries   map[dedupKey]*dedupEntry
+	lastSweep time.Time
+}
+
+func newDedupCache(ttl time.Duration) *dedupCache {
+	return &dedupCache{
+		mu:        sync.Mutex{},
+		ttl:       ttl,
+		entries:   make(map[dedupKey]*dedupEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// begin records the receipt of the request with the given sender and ref. If
+// the request is a duplicate, `dup` is true and `resp` is the encoded response
+// to the original request (nil if there is nothing to replay).
+func (dc *dedupCache) begin(from, ref string) (resp []byte, dup bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	now := time.Now()
+	if now.Sub(dc.lastSweep) > dc.ttl {
+		dc.sweep(now)
+	}
+	key := dedupKey{from: from, ref: ref}
+	if entry, ok := dc.entries[key]; ok && now.Before(entry.expires) {
+		return entry.resp, true
+	}
+	dc.entries[key] = &dedupEntry{expires: now.Add(dc.ttl)}
+	return nil, false
+}
+
+// complete records `resp` as the response to the request with the given sender
+// and ref. A nil `resp` indicates that the request produced no response to be
+// replayed.
+func (dc *dedupCache) complete(from, ref string, resp packet.Packet) {
+	var bin []byte
+	if resp != nil {
+		var err error
+		if bin, err = resp.Marshal(); err != nil {
+			bin = nil
+		}
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if entry, ok := dc.entries[dedupKey{from: from, ref: ref}]; ok {
+		entry.resp = bin
+	}
+}
+
+// forget removes the record of the request with the given sender and ref, so
+// that the request is processed again if it is retried.
+func (dc *dedupCache) forget(from, ref string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	delete(dc.entries, dedupKey{from: from, ref: ref})
+}
+
+// sweep purges expired entries from the cache. dc.mu must be held.
+func (dc *dedupCache) sweep(now time.Time) {
+	for key, entry := range dc.entries {
+		if !now.Before(entry.expires) {
+			delete(dc.entries, key)
+		}
+	}
+	dc.lastSweep = now
+}
@@ -1,16 +1,26 @@
 package server
 
-import "github.com/navaz-alani/concord/core"
+import (
+	"errors"
+
+	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/packet"
+)
 
 // Default server packet relay target name and metadata keys
 const (
 	// Server target for relaying packets
 	TargetRelay string = "svr.relay"
-	// Metadata keys
-	KeyRelayFrom = "_relay_src"
-	KeyRelayTo   = "_relay_dst"
+	// Metadata keys (defined in the packet package, so that extensions can
+	// refer to them without depending on servers)
+	KeyRelayFrom = packet.KeyRelayFrom
+	KeyRelayTo   = packet.KeyRelayTo
 )
 
+// ErrServerClosed is returned by a Server's Serve method after a call to its
+// Shutdown method.
+var ErrServerClosed = errors.New("server closed")
+
 // A definition of the interface satisfied by the server. Every packet that the
 // server receives invokes a "target" in the server. A "target" is a set of
 // actions that can be performed (through the execution of callbacks) when a
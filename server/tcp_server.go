@@ -7,16 +7,27 @@ import (
 	"time"
 
 	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/core/framing"
 	"github.com/navaz-alani/concord/packet"
 )
 
+// TCPServer is an implementation of the Server type which uses TCP for the
+// underlying Packet transfer. Every accepted connection has its own read,
+// send and write routines and, like the UDPServer, each incoming packet is
+// processed in its own go-routine. Packets are framed on the stream using the
+// `framing` package.
+//
+// Connections are identified by the address of the remote peer, which is
+// used as the `From` field of the pipeline contexts and as the destination of
+// responses. Relayed packets are sent over the connection of the peer to which
+// they are addressed, if such a connection exists.
 type TCPServer struct {
 	addr        *net.TCPAddr
 	listener    *net.TCPListener
-	mu          *sync.RWMutex
+	mu          *sync.RWMutex // mu protects the `connections` map
 	pipelines   pipelines
 	rbuffSize   int
-	connections map[*connection]bool
+	connections map[string]*connection
 	pc          packet.PacketCreator
 }
 
@@ -28,13 +39,16 @@ func NewTCPServer(laddr *net.TCPAddr, rbuffSize int, pc packet.PacketCreator) (*
 	svr := &TCPServer{
 		addr:     laddr,
 		listener: listener,
+		mu:       &sync.RWMutex{},
 		pipelines: pipelines{
 			data:   core.NewDataPipeline(),
 			packet: core.NewPacketPipeline(),
 		},
-		rbuffSize: rbuffSize,
-		pc:        pc,
+		rbuffSize:   rbuffSize,
+		connections: make(map[string]*connection),
+		pc:          pc,
 	}
+	svr.pipelines.packet.AddCallback(TargetRelay, svr.relayCallback)
 	return svr, nil
 }
 
@@ -46,77 +60,119 @@ func (svr *TCPServer) PacketProcessor() core.PacketProcessor {
 	return svr.pipelines.packet
 }
 
+// Serve accepts connections on the server's listener and serves each of them
+// in its own go-routine. It blocks until accepting fails with a non-temporary
+// error, which is then returned.
 func (svr *TCPServer) Serve() error {
+	svr.pipelines.data.Lock()
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
-		if tcpConn, err := svr.listener.AcceptTCP(); err != nil {
-			if err != nil {
-				// tcp error accept err handling - taken from net.Server.Serve
-				if ne, ok := err.(net.Error); ok && ne.Temporary() {
-					if tempDelay == 0 {
-						tempDelay = 5 * time.Millisecond
-					} else {
-						tempDelay *= 2
-					}
-					if max := 1 * time.Second; tempDelay > max {
-						tempDelay = max
-					}
-					time.Sleep(tempDelay)
-					continue
+		tcpConn, err := svr.listener.AcceptTCP()
+		if err != nil {
+			// tcp error accept err handling - taken from net.Server.Serve
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
 				}
-				return err
-			}
-			// create new connection and start read/write routines
-			conn := &connection{
-				TCPServer:   svr,
-				TCPConn:     tcpConn,
-				done:        make(chan struct{}),
-				sendStream:  make(chan packet.Packet),
-				writeStream: make(chan *writePacket),
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
 			}
-			go conn.serve()
+			return err
 		}
+		tempDelay = 0
+		// create new connection and start read/write routines
+		conn := &connection{
+			TCPServer:   svr,
+			TCPConn:     tcpConn,
+			peer:        tcpConn.RemoteAddr().String(),
+			done:        make(chan struct{}),
+			sendStream:  make(chan packet.Packet),
+			writeStream: make(chan *writePacket),
+		}
+		go conn.serve()
+	}
+}
+
+// relayCallback implements packet forwarding between connections.
+func (svr *TCPServer) relayCallback(ctx *core.TargetCtx, pw packet.Writer) {
+	ref := ctx.Pkt.Meta().Get(packet.KeyRef)
+	relayAddr := ctx.Pkt.Meta().Get(KeyRelayTo)
+
+	// create a new packet to be forwarded and send it
+	fwdPkt := svr.pc.NewPkt(ref, relayAddr)
+	fwdPkt.Meta().Add(KeyRelayFrom, ctx.From)
+	fwdPkt.Writer().Write(ctx.Pkt.Data())
+	fwdPkt.Writer().Close()
+	svr.send(fwdPkt)
+	//can stop processing of packet here, no more actions needed
+	ctx.Stat = core.CodeStopNoop
+	ctx.Msg = "packet forwarded"
+}
+
+// send queues `pkt` for sending over the connection to the packet's
+// destination. If there is no such connection, the packet is dropped.
+func (svr *TCPServer) send(pkt packet.Packet) {
+	svr.mu.RLock()
+	c, ok := svr.connections[pkt.Dest()]
+	svr.mu.RUnlock()
+	if !ok {
+		svr.pc.PutBack(pkt)
+		return
 	}
+	c.enqueue(pkt)
 }
 
 func (svr *TCPServer) registerConnection(c *connection) {
 	svr.mu.Lock()
 	defer svr.mu.Unlock()
-	svr.connections[c] = true
+	svr.connections[c.peer] = c
 }
 
 func (svr *TCPServer) unregisterConnection(c *connection) {
 	svr.mu.Lock()
 	defer svr.mu.Unlock()
-	delete(svr.connections, c)
+	if svr.connections[c.peer] == c {
+		delete(svr.connections, c.peer)
+	}
 }
 
 type connection struct {
 	*TCPServer
 	*net.TCPConn
-	mu          *sync.RWMutex
+	peer        string // remote address of the connection
 	done        chan struct{}
 	sendStream  chan packet.Packet
 	writeStream chan *writePacket
 }
 
-func (c *connection) send() chan<- packet.Packet {
-	return c.sendStream
-}
-
-func (c *connection) write() chan<- *writePacket {
-	return c.writeStream
+// enqueue hands `pkt` to the connection's send routine. If the connection has
+// been closed, the packet is dropped.
+func (c *connection) enqueue(pkt packet.Packet) {
+	select {
+	case <-c.done:
+		c.pc.PutBack(pkt)
+	case c.sendStream <- pkt:
+	}
 }
 
 func (c *connection) serve() {
 	c.TCPServer.registerConnection(c)
 	defer c.TCPServer.unregisterConnection(c)
+	go c.sendPkt()
 	go c.writeConn()
 	go c.readConn()
 	// this routine can only receive from the done channel
 	<-(<-chan struct{})(c.done)
+	c.TCPConn.Close()
 }
 
+// sendPkt processes the packets sent over the connection one at a time, so
+// that they are written in the order that they were sent.
 func (c *connection) sendPkt() {
 	// this routine can only receive from the done channel
 	done := (<-chan struct{})(c.done)
@@ -125,7 +181,7 @@ func (c *connection) sendPkt() {
 		case <-done:
 			return
 		case pkt := <-c.sendStream:
-			go c.processOutgoing(pkt)
+			c.processOutgoing(pkt)
 		}
 	}
 }
@@ -138,58 +194,80 @@ func (c *connection) writeConn() {
 		case <-done:
 			return
 		case wpkt := <-c.writeStream:
-			if _, err := c.TCPConn.Write(wpkt.data); err != nil {
-				// TODO: handle error
+			if _, err := framing.WriteFrame(c.TCPConn, wpkt.data); err != nil {
+				// the stream is unusable after a failed write - closing the
+				// connection causes readConn to terminate the connection routines.
+				c.TCPConn.Close()
+				return
 			}
 		}
 	}
 }
 
+// readConn reads length-prefixed frames off the connection, each of which
+// holds exactly one (possibly transformed) packet. A framing error leaves the
+// stream out of sync, so any read error closes the connection.
 func (c *connection) readConn() {
 	// this routine owns the done channel
+	fr := framing.NewReader(c.TCPConn, c.rbuffSize)
 	for {
-		rbuff := make([]byte, c.rbuffSize)
-		if _, err := c.TCPConn.Read(rbuff); err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				// wait
-				continue
-			}
+		data, err := fr.ReadFrame()
+		if err != nil {
 			close(c.done)
 			return
 		}
-		go c.processIncoming(rbuff)
+		go c.processIncoming(data)
 	}
 }
 
+// processOutgoing writes `pkt` to the connection. If the outgoing data
+// pipeline fails to process it, an error packet is written in its place. Since
+// processOutgoing is called by the send routine, the error packet cannot be
+// sent through it and it is dropped if the pipeline fails to process it too.
 func (c *connection) processOutgoing(pkt packet.Packet) {
 	defer c.pc.PutBack(pkt)
-	if bin, err := pkt.Marshal(); err == nil {
-		// pre-processing data buffer
-		transformCtx := &core.TransformContext{
-			PipelineCtx: core.PipelineCtx{
-				Pkt: pkt,
-			},
-			PipelineName: "_out_",
-		}
-		if bin, err := c.pipelines.data.Process(transformCtx, bin); err != nil {
-			c.send() <- c.pc.NewErrPkt(pkt.Meta().Get(packet.KeyRef),
-				pkt.Dest(), "response data pipeline error: "+err.Error())
-		} else if transformCtx.Stat != core.CodeStopNoop {
-			c.write() <- &writePacket{
-				data: bin,
-			}
+	if err := c.writeOutgoing(pkt); err != nil {
+		errPkt := c.pc.NewErrPkt(pkt.Meta().Get(packet.KeyRef),
+			pkt.Dest(), "response data pipeline error: "+err.Error())
+		c.writeOutgoing(errPkt)
+		c.pc.PutBack(errPkt)
+	}
+}
+
+// writeOutgoing runs `pkt` through the outgoing data pipeline and hands the
+// result to the write routine. It returns the error of the data pipeline, if
+// it fails; packets which cannot be encoded are dropped.
+func (c *connection) writeOutgoing(pkt packet.Packet) error {
+	bin, err := pkt.Marshal()
+	if err != nil {
+		return nil
+	}
+	// pre-processing data buffer
+	transformCtx := &core.TransformContext{
+		PipelineCtx: core.PipelineCtx{
+			Pkt: pkt,
+		},
+		PipelineName: "_out_",
+	}
+	if bin, err = c.pipelines.data.Process(transformCtx, bin); err != nil {
+		return err
+	} else if transformCtx.Stat != core.CodeStopNoop {
+		select {
+		case <-c.done:
+		case c.writeStream <- &writePacket{data: bin}:
 		}
 	}
+	return nil
 }
 
 func (c *connection) processIncoming(data []byte) {
 	var err error
 	transformCtx := &core.TransformContext{
 		PipelineName: "_in_",
-		From:         c.addr.String(),
+		From:         c.peer,
 	}
 	if data, err = c.pipelines.data.Process(transformCtx, data); err != nil {
-		c.send() <- c.pc.NewErrPkt("", c.addr.String(), "data pipeline error: "+err.Error())
+		c.send(c.pc.NewErrPkt("", c.peer, "data pipeline error: "+err.Error()))
 		return
 	} else if transformCtx.Stat == core.CodeStopNoop {
 		return
@@ -198,27 +276,48 @@ func (c *connection) processIncoming(data []byte) {
 	pkt := c.pc.NewPkt("", "")
 	defer c.pc.PutBack(pkt)
 	if err := pkt.Unmarshal(data); err != nil { // decode packet
-		c.send() <- c.pc.NewErrPkt("", c.addr.String(), "malformed packet")
+		c.send(c.pc.NewErrPkt("", c.peer, "malformed packet"))
 		return
 	}
 	// execute packet target callback queue
 	ref := pkt.Meta().Get(packet.KeyRef)
-	resp := c.TCPServer.pc.NewPkt(ref, c.addr.String())
+	resp := c.pc.NewPkt(ref, c.peer)
 	ctx := &core.TargetCtx{
 		PipelineCtx: core.PipelineCtx{
 			Pkt: pkt,
 		},
 		TargetName: pkt.Meta().Get(packet.KeyTarget),
-		From:       c.addr.String(),
+		From:       c.peer,
 	}
 	// execute callback queue
 	if err := c.pipelines.packet.Process(ctx, resp.Writer()); err != nil {
-		c.TCPServer.pc.PutBack(resp)
-		c.send() <- c.pc.NewErrPkt(ref, c.addr.String(), "packet pipeline error: "+err.Error())
-	} else if ctx.Stat == core.CodeStopNoop {
-		c.TCPServer.pc.PutBack(resp)
-	} else {
-		resp.Writer().Close()
-		c.send() <- resp
+		c.pc.PutBack(resp)
+		c.send(c.pc.NewErrPkt(ref, c.peer, "packet pipeline error: "+err.Error()))
+		return
+	}
+	switch ctx.Stat {
+	case core.CodeStopNoop:
+		{
+			c.pc.PutBack(resp)
+		}
+	case core.CodeRelay:
+		{
+			if relayAddr := resp.Meta().Get(KeyRelayTo); relayAddr != "" {
+				// change destination of `resp` and send it over the connection of
+				// the relay address
+				resp.SetDest(relayAddr)
+				resp.Meta().Add(KeyRelayFrom, ctx.From)
+				resp.Writer().Close()
+				c.send(resp)
+			} else {
+				// ignore malformed relay request by application
+				c.pc.PutBack(resp)
+			}
+		}
+	default:
+		{
+			resp.Writer().Close()
+			c.send(resp)
+		}
 	}
 }
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/client"
+	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/core/crypto"
+	"github.com/navaz-alani/concord/packet"
+)
+
+const testTimeout = 5 * time.Second
+
+// newTestTCPServer starts a TCPServer on a loopback port, with an "app.echo"
+// target which echoes requests, an "app.whoami" target which responds with
+// the requestor's address and an "app.relay" target which relays requests to
+// the address in their "to" metadata (using CodeRelay). If `setup` is not nil,
+// the server is configured with it before it is served.
+func newTestTCPServer(t *testing.T, pc packet.PacketCreator, setup func(svr *TCPServer)) *TCPServer {
+	svr, err := NewTCPServer(&net.TCPAddr{IP: []byte{127, 0, 0, 1}}, 4096, pc)
+	if err != nil {
+		t.Fatalf("NewTCPServer: %v", err)
+	}
+	svr.PacketProcessor().AddCallback("app.echo", func(ctx *core.TargetCtx, pw packet.Writer) {
+		pw.Write(ctx.Pkt.Data())
+		ctx.Stat = core.CodeStopCloseSend
+	})
+	svr.PacketProcessor().AddCallback("app.whoami", func(ctx *core.TargetCtx, pw packet.Writer) {
+		pw.Write([]byte(ctx.From))
+		ctx.Stat = core.CodeStopCloseSend
+	})
+	svr.PacketProcessor().AddCallback("app.relay", func(ctx *core.TargetCtx, pw packet.Writer) {
+		pw.Meta().Add(KeyRelayTo, ctx.Pkt.Meta().Get("to"))
+		pw.Write(ctx.Pkt.Data())
+		ctx.Stat = core.CodeRelay
+	})
+	if setup != nil {
+		setup(svr)
+	}
+	served := make(chan error, 1)
+	go func() { served <- svr.Serve() }()
+	t.Cleanup(func() {
+		svr.listener.Close()
+		if err := <-served; err == nil {
+			t.Errorf("Serve returned nil after the listener was closed")
+		}
+	})
+	return svr
+}
+
+func newTestTCPClient(t *testing.T, svr *TCPServer, pc packet.PacketCreator) client.Client {
+	cl, err := client.NewTCPClient(svr.listener.Addr().(*net.TCPAddr), 4096, pc)
+	if err != nil {
+		t.Fatalf("NewTCPClient: %v", err)
+	}
+	cl.SetTimeout(testTimeout)
+	return cl
+}
+
+// numConnections returns the number of connections registered with `svr`.
+func numConnections(svr *TCPServer) int {
+	svr.mu.RLock()
+	defer svr.mu.RUnlock()
+	return len(svr.connections)
+}
+
+// waitFor polls `cond` until it holds, failing the test after testTimeout.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTCPServerEcho(t *testing.T) {
+	pc := packet.NewBinPktCreator(10)
+	svr := newTestTCPServer(t, pc, nil)
+	const numClients, numRequests = 5, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, numClients*numRequests)
+	for i := 0; i < numClients; i++ {
+		cl := newTestTCPClient(t, svr, pc)
+		defer cl.Cleanup()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < numRequests; j++ {
+				msg := fmt.Sprintf("client %d request %d", i, j)
+				pkt := pc.NewPkt("", "")
+				pkt.Meta().Add(packet.KeyTarget, "app.echo")
+				pkt.Writer().Write([]byte(msg))
+				pkt.Writer().Close()
+				resp, err := cl.Request(context.Background(), pkt)
+				if err != nil {
+					errs <- err
+				} else if string(resp.Data()) != msg {
+					errs <- fmt.Errorf("echo = %q, want %q", resp.Data(), msg)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := numConnections(svr); n != numClients {
+		t.Errorf("server has %d connections, want %d", n, numClients)
+	}
+}
+
+func TestTCPServerRelay(t *testing.T) {
+	pc := packet.NewBinPktCreator(10)
+	svr := newTestTCPServer(t, pc, nil)
+	sender, receiver := newTestTCPClient(t, svr, pc), newTestTCPClient(t, svr, pc)
+	defer sender.Cleanup()
+	defer receiver.Cleanup()
+	whoami := func(cl client.Client) string {
+		pkt := pc.NewPkt("", "")
+		pkt.Meta().Add(packet.KeyTarget, "app.whoami")
+		resp, err := cl.Request(context.Background(), pkt)
+		if err != nil {
+			t.Fatalf("whoami: %v", err)
+		}
+		return string(resp.Data())
+	}
+	senderAddr, receiverAddr := whoami(sender), whoami(receiver)
+
+	pkt := pc.NewPkt("", "")
+	pkt.Meta().Add(packet.KeyTarget, "app.relay")
+	pkt.Meta().Add("to", receiverAddr)
+	pkt.Writer().Write([]byte("relayed"))
+	pkt.Writer().Close()
+	if err := sender.Send(pkt, nil); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	select {
+	case fwd := <-receiver.Misc():
+		if string(fwd.Data()) != "relayed" {
+			t.Errorf("relayed data = %q, want %q", fwd.Data(), "relayed")
+		}
+		if from := fwd.Meta().Get(KeyRelayFrom); from != senderAddr {
+			t.Errorf("relayed from %q, want %q", from, senderAddr)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("relayed packet not received")
+	}
+}
+
+func TestTCPServerDisconnect(t *testing.T) {
+	pc := packet.NewBinPktCreator(10)
+	svr := newTestTCPServer(t, pc, nil)
+	staying, leaving := newTestTCPClient(t, svr, pc), newTestTCPClient(t, svr, pc)
+	defer staying.Cleanup()
+	waitFor(t, "connections to be registered", func() bool { return numConnections(svr) == 2 })
+	leaving.Cleanup()
+	waitFor(t, "the connection to be unregistered", func() bool { return numConnections(svr) == 1 })
+
+	// the remaining connection is unaffected
+	pkt := pc.NewPkt("", "")
+	pkt.Meta().Add(packet.KeyTarget, "app.echo")
+	pkt.Writer().Write([]byte("still here"))
+	pkt.Writer().Close()
+	if resp, err := staying.Request(context.Background(), pkt); err != nil {
+		t.Fatalf("Request: %v", err)
+	} else if string(resp.Data()) != "still here" {
+		t.Errorf("echo = %q, want %q", resp.Data(), "still here")
+	}
+}
+
+func TestTCPServerUnknownTarget(t *testing.T) {
+	pc := packet.NewBinPktCreator(10)
+	svr := newTestTCPServer(t, pc, nil)
+	cl := newTestTCPClient(t, svr, pc)
+	defer cl.Cleanup()
+	pkt := pc.NewPkt("", "")
+	pkt.Meta().Add(packet.KeyTarget, "app.missing")
+	_, err := cl.Request(context.Background(), pkt)
+	svrErr, ok := err.(*client.ServerError)
+	if !ok {
+		t.Fatalf("Request error = %v, want a *client.ServerError", err)
+	}
+	if !strings.Contains(svrErr.Msg, "target not found") {
+		t.Errorf("error message = %q, want it to mention \"target not found\"", svrErr.Msg)
+	}
+}
+
+func TestTCPServerCrypto(t *testing.T) {
+	pc := packet.NewJSONPktCreator(10)
+	identity, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	svrCrypto, err := crypto.NewCrypto(identity)
+	if err != nil {
+		t.Fatalf("NewCrypto: %v", err)
+	}
+	secret := []byte("concord-tcp-secret")
+	var leaked int64
+	svr := newTestTCPServer(t, pc, func(svr *TCPServer) {
+		// installed before Crypto, so that it sees packets as they were sent
+		svr.DataProcessor().AddTransform("_in_", func(ctx *core.TransformContext, buff []byte) []byte {
+			if bytes.Contains(buff, secret) {
+				atomic.AddInt64(&leaked, 1)
+			}
+			return buff
+		})
+		if err := svrCrypto.Extend("server", svr); err != nil {
+			t.Fatalf("Extend: %v", err)
+		}
+	})
+	cl := newTestTCPClient(t, svr, pc)
+	defer cl.Cleanup()
+	svrAddr := svr.listener.Addr().String()
+	trust := crypto.NewTrustStore()
+	trust.Pin(svrAddr, &identity.PublicKey)
+	if _, err := crypto.ConfigureClient(cl, svrAddr, trust, pc.NewPkt("", svrAddr)); err != nil {
+		t.Fatalf("ConfigureClient: %v", err)
+	}
+	// packets to the server's address are encrypted by the client
+	pkt := pc.NewPkt("", svrAddr)
+	pkt.Meta().Add(packet.KeyTarget, "app.echo")
+	pkt.Writer().Write(secret)
+	pkt.Writer().Close()
+	resp, err := cl.Request(context.Background(), pkt)
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	} else if !bytes.Equal(resp.Data(), secret) {
+		t.Errorf("echo = %q, want %q", resp.Data(), secret)
+	}
+	if n := atomic.LoadInt64(&leaked); n != 0 {
+		t.Errorf("server read %d packets in cleartext", n)
+	}
+}
+
+func TestTCPServerOutgoingPipelineError(t *testing.T) {
+	pc := packet.NewBinPktCreator(10)
+	svr := newTestTCPServer(t, pc, func(svr *TCPServer) {
+		// responses fail the pipeline, but the error packets sent in their
+		// place do not
+		svr.DataProcessor().AddTransform("_out_", func(ctx *core.TransformContext, buff []byte) []byte {
+			if ctx.Pkt.Meta().Get(packet.KeySvrStatus) == "" {
+				ctx.Stat = core.CodeStopError
+				ctx.Msg = "rejected"
+			}
+			return buff
+		})
+	})
+	cl := newTestTCPClient(t, svr, pc)
+	defer cl.Cleanup()
+	// the connection keeps being served after a pipeline failure
+	for i := 0; i < 2; i++ {
+		pkt := pc.NewPkt("", "")
+		pkt.Meta().Add(packet.KeyTarget, "app.echo")
+		_, err := cl.Request(context.Background(), pkt)
+		svrErr, ok := err.(*client.ServerError)
+		if !ok {
+			t.Fatalf("Request error = %v, want a *client.ServerError", err)
+		}
+		if want := "response data pipeline error: pipeline terminated: rejected"; svrErr.Msg != want {
+			t.Errorf("error message = %q, want %q", svrErr.Msg, want)
+		}
+	}
+}
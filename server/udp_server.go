@@ -1,9 +1,11 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/navaz-alani/concord/core"
 	throttle "github.com/navaz-alani/concord/core/throttle"
@@ -32,12 +34,28 @@ type UDPServer struct {
 	pc          packet.PacketCreator
 	sendStream  chan packet.Packet
 	writeStream chan writePacket
-	shutdown    chan string
+	shutdown    chan struct{} // closed once the server has been stopped
 	rBuffSize   int
+	dedup       *dedupCache
+	ctrl        throttle.Controller
+	// shutdown management
+	mu       sync.Mutex // mu protects `closing`
+	closing  bool
+	inFlight sync.WaitGroup // packets being processed, sent or written
+	stopOnce sync.Once
 }
 
+// NewUDPServer creates a UDPServer listening on `addr`, whose reads and writes
+// are throttled by a UDPThrottle (see throttle.SleepFactory).
 func NewUDPServer(addr *net.UDPAddr, rBuffSize int, pc packet.PacketCreator,
 	throttleRate throttle.Rate) (*UDPServer, error) {
+	return NewUDPServerWithThrottle(addr, rBuffSize, pc, throttleRate, throttle.SleepFactory)
+}
+
+// NewUDPServerWithThrottle creates a UDPServer listening on `addr`, whose reads
+// and writes are throttled by a Throttle created with `newThrottle`.
+func NewUDPServerWithThrottle(addr *net.UDPAddr, rBuffSize int, pc packet.PacketCreator,
+	throttleRate throttle.Rate, newThrottle throttle.Factory) (*UDPServer, error) {
 	// initialize connection
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
@@ -46,7 +64,7 @@ func NewUDPServer(addr *net.UDPAddr, rBuffSize int, pc packet.PacketCreator,
 	svr := &UDPServer{
 		addr: addr,
 		conn: conn,
-		th:   throttle.NewUDPThrottle(throttleRate, conn, rBuffSize),
+		th:   newThrottle(throttleRate, conn, rBuffSize),
 		pipelines: &pipelines{
 			data:   core.NewDataPipeline(),
 			packet: core.NewPacketPipeline(),
@@ -54,13 +72,50 @@ func NewUDPServer(addr *net.UDPAddr, rBuffSize int, pc packet.PacketCreator,
 		pc:          pc,
 		sendStream:  make(chan packet.Packet),
 		writeStream: make(chan writePacket),
-		shutdown:    make(chan string),
+		shutdown:    make(chan struct{}),
 		rBuffSize:   rBuffSize,
 	}
 	svr.pipelines.packet.AddCallback(TargetRelay, svr.relayCallback)
 	return svr, nil
 }
 
+// SetDuplicateSuppression enables the suppression of duplicate requests, which
+// are identified by their (sender, ref) pair and remembered for `ttl`. The
+// callback queue of a request's target is then executed at most once, with
+// the response to the original request being replayed to the sender of any
+// duplicate. This is the server side counterpart of the client's RetryPolicy.
+// Requests marked as Retryable, such as those rejected by a
+// throttle.PeerLimiter (whatever its policy), are not remembered, since their
+// callback queue was not executed: a retry with the same ref is processed
+// afresh. A non-positive `ttl` disables duplicate
+// suppression (the default). It must be called before Serve.
+func (svr *UDPServer) SetDuplicateSuppression(ttl time.Duration) {
+	if ttl <= 0 {
+		svr.dedup = nil
+	} else {
+		svr.dedup = newDedupCache(ttl)
+	}
+}
+
+// SetController sets the congestion Controller which adjusts the throughput of
+// the server's Throttle (see Throttle). It is told about every new request, as
+// a success, since the client's next request shows that the path to it is
+// clear, and every duplicate request (a client retransmission, which suggests
+// that a response was lost) and write error, as a loss. Since new requests can
+// only be told from duplicates with duplicate suppression enabled (see
+// SetDuplicateSuppression), the Controller is only told about successes then.
+// A nil Controller, the default, leaves the throughput fixed. It must be
+// called before Serve.
+func (svr *UDPServer) SetController(ctrl throttle.Controller) {
+	svr.ctrl = ctrl
+}
+
+// Throttle returns the Throttle which limits the server's reads and writes,
+// for example to create a Controller for it.
+func (svr *UDPServer) Throttle() throttle.Throttle {
+	return svr.th
+}
+
 func (svr *UDPServer) DataProcessor() core.DataProcessor {
 	return svr.pipelines.data
 }
@@ -71,12 +126,9 @@ func (svr *UDPServer) PacketProcessor() core.PacketProcessor {
 
 // Serve initiates the server's underlying read/write routines over the
 // unerlying connection. It blocks until there is an error in reading over the
-// connection, which is then returned.
+// connection, which is then returned. After Shutdown, Serve returns
+// ErrServerClosed.
 func (svr *UDPServer) Serve() error {
-	defer func() {
-		close(svr.writeStream) // close writePkts routine
-		close(svr.sendStream)  // close sendPkts routine
-	}()
 	svr.pipelines.data.Lock()
 	// fire off routines
 	go svr.sendPkts()  // pre-process packets before writing
@@ -91,12 +143,68 @@ func (svr *UDPServer) Serve() error {
 	}
 	wg.Wait()
 
+	svr.mu.Lock()
+	closing := svr.closing
+	svr.mu.Unlock()
+	if closing {
+		return ErrServerClosed
+	}
+	svr.stop()
 	return fmt.Errorf("server error - read fail")
 }
 
+// Shutdown gracefully shuts the server down. The server first stops accepting
+// packets (those read are discarded) and then waits for the packets which are
+// being processed to be processed, and for their responses to be written to
+// the connection. Finally, the server's throttle and connection are closed.
+//
+// If `ctx` is done before all in-flight packets have been drained, the server
+// is stopped anyway and the context's error is returned. Once Shutdown has
+// been called, Serve returns ErrServerClosed. The server cannot be reused.
+func (svr *UDPServer) Shutdown(ctx context.Context) error {
+	svr.mu.Lock()
+	svr.closing = true
+	svr.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		svr.inFlight.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	svr.stop()
+	return err
+}
+
+// stop stops the server's send and write routines and closes the throttle and
+// the underlying connection (which unblocks the read routines).
+func (svr *UDPServer) stop() {
+	svr.stopOnce.Do(func() {
+		close(svr.shutdown)
+		svr.th.Shutdown()
+		svr.conn.Close()
+	})
+}
+
+// accept registers an incoming packet for processing. It returns false if the
+// server is shutting down, in which case the packet should be discarded.
+func (svr *UDPServer) accept() bool {
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+	if svr.closing {
+		return false
+	}
+	svr.inFlight.Add(1)
+	return true
+}
+
 // relayCallback implements packet forwarding
 func (svr *UDPServer) relayCallback(ctx *core.TargetCtx, pw packet.Writer) {
-	sendStream := svr.send() // send-only access to svr.sendStream
 	ref := ctx.Pkt.Meta().Get(packet.KeyRef)
 	relayAddr := ctx.Pkt.Meta().Get(KeyRelayTo)
 	// fmt.Println("relaying from " + ctx.From + " to " + relayAddr)
@@ -106,18 +214,39 @@ func (svr *UDPServer) relayCallback(ctx *core.TargetCtx, pw packet.Writer) {
 	fwdPkt.Meta().Add(KeyRelayFrom, ctx.From)
 	fwdPkt.Writer().Write(ctx.Pkt.Data())
 	fwdPkt.Writer().Close()
-	sendStream <- fwdPkt
+	svr.send(fwdPkt)
 	//can stop processing of packet here, no more actions needed
 	ctx.Stat = core.CodeStopNoop
 	ctx.Msg = "packet forwarded"
 }
 
-func (svr *UDPServer) dist() chan<- writePacket   { return svr.writeStream }
-func (svr *UDPServer) send() chan<- packet.Packet { return svr.sendStream }
+// send queues `pkt` for processing by the sendPkts routine. The packet is
+// counted as in-flight until it has been written to the connection (or
+// dropped). Only routines which are themselves in-flight may call send.
+func (svr *UDPServer) send(pkt packet.Packet) {
+	svr.inFlight.Add(1)
+	select {
+	case svr.sendStream <- pkt:
+	case <-svr.shutdown:
+		svr.pc.PutBack(pkt)
+		svr.inFlight.Done()
+	}
+}
+
+// dist queues `pkt` for writing by the writePkts routine. Like send, it may
+// only be called by in-flight routines.
+func (svr *UDPServer) dist(pkt writePacket) {
+	svr.inFlight.Add(1)
+	select {
+	case svr.writeStream <- pkt:
+	case <-svr.shutdown:
+		svr.inFlight.Done()
+	}
+}
 
 // processIncoming runs the given data through the server's data pipelines.
 func (svr *UDPServer) processIncoming(data []byte, senderAddr net.Addr) {
-	sendStream := svr.send() // send-only access to svr.sendStream
+	defer svr.inFlight.Done()
 	// pre-processing data buffer
 	var err error
 	transformCtx := &core.TransformContext{
@@ -125,7 +254,7 @@ func (svr *UDPServer) processIncoming(data []byte, senderAddr net.Addr) {
 		From:         senderAddr.String(),
 	}
 	if data, err = svr.pipelines.data.Process(transformCtx, data); err != nil {
-		sendStream <- svr.pc.NewErrPkt("", senderAddr.String(), "data pipeline error: "+err.Error())
+		svr.send(svr.pc.NewErrPkt("", senderAddr.String(), "data pipeline error: "+err.Error()))
 		return
 	} else if transformCtx.Stat == core.CodeStopNoop {
 		return
@@ -134,11 +263,30 @@ func (svr *UDPServer) processIncoming(data []byte, senderAddr net.Addr) {
 	pkt := svr.pc.NewPkt("", "")                // intermediate packet for decoding of recvd bin data
 	defer svr.pc.PutBack(pkt)                   // intermediate packet returned to pool
 	if err := pkt.Unmarshal(data); err != nil { // decode packet
-		sendStream <- svr.pc.NewErrPkt("", senderAddr.String(), "malformed packet")
+		svr.send(svr.pc.NewErrPkt("", senderAddr.String(), "malformed packet"))
 		return
 	}
-	// execute packet target callback queue
 	ref := pkt.Meta().Get(packet.KeyRef)
+	if svr.dedup != nil && ref != "" {
+		if cached, dup := svr.dedup.begin(senderAddr.String(), ref); dup {
+			if svr.ctrl != nil {
+				svr.ctrl.OnLoss()
+			}
+			// replay the response to the original request, if there is one
+			if cached != nil {
+				replay := svr.pc.NewPkt("", senderAddr.String())
+				if err := replay.Unmarshal(cached); err != nil {
+					svr.pc.PutBack(replay)
+					return
+				}
+				svr.send(replay)
+			}
+			return
+		} else if svr.ctrl != nil {
+			svr.ctrl.OnSuccess()
+		}
+	}
+	// execute packet target callback queue
 	resp := svr.pc.NewPkt(ref, senderAddr.String())
 	ctx := &core.TargetCtx{
 		PipelineCtx: core.PipelineCtx{
@@ -150,22 +298,30 @@ func (svr *UDPServer) processIncoming(data []byte, senderAddr net.Addr) {
 	// execute callback queue
 	if err := svr.pipelines.packet.Process(ctx, resp.Writer()); err != nil {
 		svr.pc.PutBack(resp)
-		sendStream <- svr.pc.NewErrPkt(ref, senderAddr.String(), "packet pipeline error: "+err.Error())
+		errPkt := svr.pc.NewErrPkt(ref, senderAddr.String(), "packet pipeline error: "+err.Error())
+		svr.remember(ctx.From, ref, errPkt)
+		svr.send(errPkt)
 		return
 	}
 	switch ctx.Stat {
 	case core.CodeStopNoop:
 		{
+			if ctx.Retryable {
+				svr.forget(ctx.From, ref)
+			} else {
+				svr.remember(ctx.From, ref, nil)
+			}
 			svr.pc.PutBack(resp)
 		}
 	case core.CodeRelay:
 		{
+			svr.remember(ctx.From, ref, nil)
 			if relayAddr := resp.Meta().Get(KeyRelayTo); relayAddr != "" {
 				// change destination of `resp` and send it
 				resp.SetDest(relayAddr)
 				resp.Meta().Add(KeyRelayFrom, ctx.From)
 				resp.Writer().Close()
-				sendStream <- resp
+				svr.send(resp)
 			} else {
 				// ignore malformed relay request by application
 				svr.pc.PutBack(resp)
@@ -174,15 +330,37 @@ func (svr *UDPServer) processIncoming(data []byte, senderAddr net.Addr) {
 	default:
 		{
 			resp.Writer().Close()
-			sendStream <- resp
+			if ctx.Retryable {
+				svr.forget(ctx.From, ref)
+			} else {
+				svr.remember(ctx.From, ref, resp)
+			}
+			svr.send(resp)
 		}
 	}
 }
 
+// remember records `resp` as the response to the request with the given sender
+// and ref, if duplicate suppression is enabled.
+func (svr *UDPServer) remember(from, ref string, resp packet.Packet) {
+	if svr.dedup != nil && ref != "" {
+		svr.dedup.complete(from, ref, resp)
+	}
+}
+
+// forget removes the record of the request with the given sender and ref, if
+// duplicate suppression is enabled.
+func (svr *UDPServer) forget(from, ref string) {
+	if svr.dedup != nil && ref != "" {
+		svr.dedup.forget(from, ref)
+	}
+}
+
 // processOutgoing runs the given `pkt` through the client pipelines and when
 // done, sends the final data to be written to the connection (through the
 // server `writeStream`).
 func (svr *UDPServer) processOutgoing(pkt packet.Packet) {
+	defer svr.inFlight.Done()
 	defer svr.pc.PutBack(pkt)
 	if bin, err := pkt.Marshal(); err == nil {
 		if addr, err := net.ResolveUDPAddr("udp", pkt.Dest()); err == nil {
@@ -194,48 +372,61 @@ func (svr *UDPServer) processOutgoing(pkt packet.Packet) {
 				PipelineName: "_out_",
 			}
 			if bin, err := svr.pipelines.data.Process(transformCtx, bin); err != nil {
-				svr.send() <- svr.pc.NewErrPkt(pkt.Meta().Get(packet.KeyRef),
-					pkt.Dest(), "pipeline error: "+err.Error())
+				svr.send(svr.pc.NewErrPkt(pkt.Meta().Get(packet.KeyRef),
+					pkt.Dest(), "pipeline error: "+err.Error()))
 			} else if transformCtx.Stat != core.CodeStopNoop {
-				svr.dist() <- writePacket{
+				svr.dist(writePacket{
 					data: bin,
 					addr: addr,
-				}
+				})
 			}
 		}
 	}
 }
 
-// read is a routune which reads and decodes packets from the underlying
-// connection and spawns a routine to process each packet read. It is the only
-// writer to the server's `shutdown` channel.
+// readPkts is a routine which reads packets from the underlying connection and
+// spawns a routine to process each packet read. Packets read while the server
+// is shutting down are discarded. It returns once reading fails, which is the
+// case after the server has been stopped.
 func (svr *UDPServer) readPkts(wg *sync.WaitGroup) {
 	defer wg.Done()
 	for {
 		if data, senderAddr, err := svr.th.ReadFrom(); err != nil {
 			return
-		} else {
+		} else if svr.accept() {
 			go svr.processIncoming(data, senderAddr)
 		}
 	}
 }
 
-// write is a routine which distributes packets by writing them over the
-// underlying UDP connection. Any encoding/write errors are ignored. It is the
+// writePkts is a routine which distributes packets by writing them over the
+// underlying UDP connection. Any encoding/write errors are ignored, other than
+// being reported to the server's Controller as losses. It is the
 // only consumer of writeStream. It also serves the purpose of throttling the
 // packet-write-rate of the server.
 func (svr *UDPServer) writePkts() {
-	var pkt writePacket
-	for pkt = range svr.writeStream { // throttled write operation
-		svr.th.WriteTo(pkt.data, pkt.addr)
+	for {
+		select {
+		case <-svr.shutdown:
+			return
+		case pkt := <-svr.writeStream: // throttled write operation
+			if _, err := svr.th.WriteTo(pkt.data, pkt.addr); err != nil && svr.ctrl != nil {
+				svr.ctrl.OnLoss()
+			}
+			svr.inFlight.Done()
+		}
 	}
 }
 
 // sendPkts is a routine which processes packets before they are written over
 // the conecction. It is the only consumer of sendStream.
 func (svr *UDPServer) sendPkts() {
-	var pkt packet.Packet
-	for pkt = range svr.sendStream {
-		go svr.processOutgoing(pkt)
+	for {
+		select {
+		case <-svr.shutdown:
+			return
+		case pkt := <-svr.sendStream:
+			go svr.processOutgoing(pkt)
+		}
 	}
 }
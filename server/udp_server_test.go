@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/navaz-alani/concord/client"
+	"github.com/navaz-alani/concord/core"
+	"github.com/navaz-alani/concord/core/clock/clocktest"
+	throttle "github.com/navaz-alani/concord/core/throttle"
+	"github.com/navaz-alani/concord/packet"
+)
+
+// newTestUDPServer starts a UDPServer on a loopback port, with an "app.count"
+// target which responds with nothing but counts the requests it executes. The
+// server is configured with `setup` before it is served.
+func newTestUDPServer(t *testing.T, pc packet.PacketCreator, setup func(svr *UDPServer)) (*UDPServer, *int64) {
+	svr, err := NewUDPServer(&net.UDPAddr{IP: []byte{127, 0, 0, 1}}, 4096, pc, throttle.Rate10k)
+	if err != nil {
+		t.Fatalf("NewUDPServer: %v", err)
+	}
+	var executed int64
+	svr.PacketProcessor().AddCallback("app.count", func(ctx *core.TargetCtx, pw packet.Writer) {
+		atomic.AddInt64(&executed, 1)
+		ctx.Stat = core.CodeStopCloseSend
+	})
+	setup(svr)
+	go svr.Serve()
+	t.Cleanup(func() { svr.Shutdown(context.Background()) })
+	return svr, &executed
+}
+
+// testRequester sends requests to a UDPServer over a raw connection, so that
+// requests can be sent with chosen refs.
+type testRequester struct {
+	t    *testing.T
+	pc   packet.PacketCreator
+	conn *net.UDPConn
+	to   net.Addr
+}
+
+func newTestRequester(t *testing.T, pc packet.PacketCreator, svr *UDPServer) *testRequester {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: []byte{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testRequester{t: t, pc: pc, conn: conn, to: svr.conn.LocalAddr()}
+}
+
+// request sends a request to "app.count" with the given ref and returns the
+// response, or nil if there is none within `wait`.
+func (r *testRequester) request(ref string, wait time.Duration) packet.Packet {
+	r.send(ref)
+	return r.receive(wait)
+}
+
+// send sends a request to "app.count" with the given ref.
+func (r *testRequester) send(ref string) {
+	pkt := r.pc.NewPkt(ref, "")
+	pkt.Meta().Add(packet.KeyTarget, "app.count")
+	bin, err := pkt.Marshal()
+	if err != nil {
+		r.t.Fatalf("marshal: %v", err)
+	}
+	if _, err := r.conn.WriteTo(bin, r.to); err != nil {
+		r.t.Fatalf("write: %v", err)
+	}
+}
+
+// receive returns the next packet received from the server, or nil if there
+// is none within `wait`.
+func (r *testRequester) receive(wait time.Duration) packet.Packet {
+	buff := make([]byte, 4096)
+	r.conn.SetReadDeadline(time.Now().Add(wait))
+	n, _, err := r.conn.ReadFrom(buff)
+	if err != nil {
+		return nil
+	}
+	resp := r.pc.NewPkt("", "")
+	if err := resp.Unmarshal(buff[:n]); err != nil {
+		r.t.Fatalf("unmarshal: %v", err)
+	}
+	return resp
+}
+
+func TestUDPServerDedupRateLimited(t *testing.T) {
+	for _, policy := range []throttle.OverLimitPolicy{throttle.PolicyReject, throttle.PolicyDrop} {
+		pc := packet.NewJSONPktCreator(10)
+		clk := clocktest.NewManual(time.Unix(0, 0))
+		svr, executed := newTestUDPServer(t, pc, func(svr *UDPServer) {
+			svr.SetDuplicateSuppression(time.Minute)
+			pl := throttle.NewPeerLimiter(1, 1, policy)
+			pl.SetClock(clk)
+			svr.PacketProcessor().Use(pl.Middleware)
+		})
+		r := newTestRequester(t, pc, svr)
+		if resp := r.request("first", time.Second); resp == nil {
+			t.Fatalf("policy %d: no response to the first request", policy)
+		}
+		// over the limit: rejected (or dropped), without being executed
+		resp := r.request("second", 100*time.Millisecond)
+		if policy == throttle.PolicyReject && (resp == nil || resp.Meta().Get(throttle.KeyRetryAfter) == "") {
+			t.Fatalf("policy %d: over-limit request not rejected", policy)
+		} else if policy == throttle.PolicyDrop && resp != nil {
+			t.Fatalf("policy %d: over-limit request not dropped", policy)
+		}
+		// once the peer is within its limit, a retry with the same ref is
+		// executed, rather than being suppressed as a duplicate
+		clk.Advance(time.Second)
+		resp = r.request("second", time.Second)
+		if resp == nil || resp.Meta().Get(packet.KeySvrStatus) == "-1" {
+			t.Fatalf("policy %d: retry of a rate limited request not processed", policy)
+		}
+		if n := atomic.LoadInt64(executed); n != 2 {
+			t.Errorf("policy %d: executed %d requests, want 2", policy, n)
+		}
+		// a duplicate of a processed request is still suppressed
+		clk.Advance(time.Second)
+		r.request("second", time.Second)
+		if n := atomic.LoadInt64(executed); n != 2 {
+			t.Errorf("policy %d: duplicate executed (%d requests executed, want 2)", policy, n)
+		}
+	}
+}
+
+// countingController is a Controller which counts the signals it is given.
+type countingController struct {
+	successes, losses int32
+}
+
+func (c *countingController) OnSuccess() { atomic.AddInt32(&c.successes, 1) }
+func (c *countingController) OnLoss()    { atomic.AddInt32(&c.losses, 1) }
+
+func TestUDPServerController(t *testing.T) {
+	pc := packet.NewJSONPktCreator(10)
+	ctrl := &countingController{}
+	svr, _ := newTestUDPServer(t, pc, func(svr *UDPServer) {
+		svr.SetDuplicateSuppression(time.Minute)
+		svr.SetController(ctrl)
+	})
+	r := newTestRequester(t, pc, svr)
+	// new requests are successes and retransmissions are losses, but the
+	// responses written are neither
+	for _, ref := range []string{"first", "second", "second"} {
+		if resp := r.request(ref, time.Second); resp == nil {
+			t.Fatalf("no response to request %q", ref)
+		}
+	}
+	successes, losses := atomic.LoadInt32(&ctrl.successes), atomic.LoadInt32(&ctrl.losses)
+	if successes != 2 || losses != 1 {
+		t.Errorf("Controller told of %d successes and %d losses, want 2 and 1", successes, losses)
+	}
+}
+
+// newBlockingUDPServer starts a UDPServer like newTestUDPServer, but whose
+// requests block before their callback queue is executed until `release` is
+// closed. `entered` receives a value as each request blocks and `served`
+// receives the error returned by Serve.
+func newBlockingUDPServer(t *testing.T, pc packet.PacketCreator) (svr *UDPServer,
+	executed *int64, entered chan struct{}, release func(), served chan error) {
+	svr, err := NewUDPServer(&net.UDPAddr{IP: []byte{127, 0, 0, 1}}, 4096, pc, throttle.Rate10k)
+	if err != nil {
+		t.Fatalf("NewUDPServer: %v", err)
+	}
+	executed = new(int64)
+	svr.PacketProcessor().AddCallback("app.count", func(ctx *core.TargetCtx, pw packet.Writer) {
+		atomic.AddInt64(executed, 1)
+		ctx.Stat = core.CodeStopCloseSend
+	})
+	entered = make(chan struct{}, 1)
+	released := make(chan struct{})
+	var once sync.Once
+	release = func() { once.Do(func() { close(released) }) }
+	svr.PacketProcessor().Use(func(next core.TargetCallback) core.TargetCallback {
+		return func(ctx *core.TargetCtx, pw packet.Writer) {
+			entered <- struct{}{}
+			<-released
+			next(ctx, pw)
+		}
+	})
+	served = make(chan error, 1)
+	go func() { served <- svr.Serve() }()
+	t.Cleanup(func() {
+		release()
+		svr.Shutdown(context.Background())
+	})
+	return svr, executed, entered, release, served
+}
+
+// waitServed checks that Serve returns ErrServerClosed once the server has
+// been shut down.
+func waitServed(t *testing.T, served chan error) {
+	t.Helper()
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Errorf("Serve = %v, want ErrServerClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Serve did not return after Shutdown")
+	}
+}
+
+func TestUDPServerShutdownDrains(t *testing.T) {
+	pc := packet.NewJSONPktCreator(10)
+	svr, executed, entered, release, served := newBlockingUDPServer(t, pc)
+	r := newTestRequester(t, pc, svr)
+	r.send("inflight")
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("request not processed by the server")
+	}
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- svr.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown = %v before the in-flight request was processed", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatalf("Shutdown = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return once the in-flight request was processed")
+	}
+	// the response was written before Shutdown returned
+	if resp := r.receive(time.Second); resp == nil || resp.Meta().Get(packet.KeyRef) != "inflight" {
+		t.Error("no response to the in-flight request")
+	}
+	if n := atomic.LoadInt64(executed); n != 1 {
+		t.Errorf("executed %d requests, want 1", n)
+	}
+	waitServed(t, served)
+}
+
+func TestUDPServerShutdownContext(t *testing.T) {
+	pc := packet.NewJSONPktCreator(10)
+	svr, _, entered, _, served := newBlockingUDPServer(t, pc)
+	r := newTestRequester(t, pc, svr)
+	r.send("stuck")
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("request not processed by the server")
+	}
+	// the request is never released, so Shutdown gives up when ctx expires
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- svr.Shutdown(ctx) }()
+	select {
+	case err := <-shutdown:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("Shutdown = %v, want context.DeadlineExceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return once its context expired")
+	}
+	waitServed(t, served)
+}
+
+func TestUDPServerRetransmission(t *testing.T) {
+	pc := packet.NewJSONPktCreator(10)
+	var (
+		mu   sync.Mutex
+		refs []string // refs of the requests received
+	)
+	var responses int32
+	svr, executed := newTestUDPServer(t, pc, func(svr *UDPServer) {
+		svr.SetDuplicateSuppression(time.Minute)
+		svr.DataProcessor().AddTransform("_in_", func(ctx *core.TransformContext, buff []byte) []byte {
+			pkt := pc.NewPkt("", "")
+			if err := pkt.Unmarshal(buff); err == nil {
+				mu.Lock()
+				refs = append(refs, pkt.Meta().Get(packet.KeyRef))
+				mu.Unlock()
+			}
+			pc.PutBack(pkt)
+			return buff
+		})
+		// the first response is lost, so the client must retransmit
+		svr.DataProcessor().AddTransform("_out_", func(ctx *core.TransformContext, buff []byte) []byte {
+			if atomic.AddInt32(&responses, 1) == 1 {
+				ctx.Stat = core.CodeStopNoop
+			}
+			return buff
+		})
+	})
+	cl, err := client.NewUDPClient(svr.conn.LocalAddr().(*net.UDPAddr),
+		&net.UDPAddr{IP: []byte{127, 0, 0, 1}}, 4096, pc, throttle.Rate10k)
+	if err != nil {
+		t.Fatalf("NewUDPClient: %v", err)
+	}
+	defer cl.Cleanup()
+	cl.(*client.UDPClient).SetRetryPolicy(client.RetryPolicy{Retries: 3, Backoff: 50 * time.Millisecond})
+	req := pc.NewPkt("", "")
+	req.Meta().Add(packet.KeyTarget, "app.count")
+	resp, err := cl.Request(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Request = %v, want a response", err)
+	}
+	ref := req.Meta().Get(packet.KeyRef)
+	if got := resp.Meta().Get(packet.KeyRef); got != ref {
+		t.Errorf("response ref = %q, want %q", got, ref)
+	}
+	// no other response is delivered to the client
+	select {
+	case pkt := <-cl.Misc():
+		t.Errorf("extra response %q delivered as a miscellaneous packet", pkt.Meta().Get(packet.KeyRef))
+	case <-time.After(200 * time.Millisecond):
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(refs) < 2 {
+		t.Fatalf("server received %d copies of the request, want a retransmission", len(refs))
+	}
+	for i, got := range refs {
+		if got != ref {
+			t.Errorf("copy %d of the request has ref %q, want %q", i, got, ref)
+		}
+	}
+	// the duplicate was answered from the dedup cache
+	if n := atomic.LoadInt64(executed); n != 1 {
+		t.Errorf("executed %d requests, want 1", n)
+	}
+	if n := atomic.LoadInt32(&responses); n != int32(len(refs)) {
+		t.Errorf("server sent %d responses to %d copies of the request", n, len(refs))
+	}
+}